@@ -0,0 +1,91 @@
+package ast
+
+// node 以下を深さ優先で辿り、各ノードで f を呼ぶ (Modify と違い、子より先に親を訪れる)
+// f が false を返したノードの子は辿らない
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		for _, s := range node.Statements {
+			Inspect(s, f)
+		}
+	case *BlockStatement:
+		for _, s := range node.Statements {
+			Inspect(s, f)
+		}
+	case *ExpressionStatement:
+		inspectExpression(node.Expression, f)
+	case *LetStatement:
+		inspectExpression(node.Value, f)
+	case *ExportStatement:
+		if node.Statement != nil {
+			Inspect(node.Statement, f)
+		}
+	case *ReturnStatement:
+		inspectExpression(node.ReturnValue, f)
+	case *ThrowStatement:
+		inspectExpression(node.Value, f)
+	case *WhileStatement:
+		inspectExpression(node.Condition, f)
+		Inspect(node.Body, f)
+	case *ForStatement:
+		inspectExpression(node.Iterable, f)
+		Inspect(node.Body, f)
+	case *PrefixExpression:
+		inspectExpression(node.Right, f)
+	case *InfixExpression:
+		inspectExpression(node.Left, f)
+		inspectExpression(node.Right, f)
+	case *LogicalExpression:
+		inspectExpression(node.Left, f)
+		inspectExpression(node.Right, f)
+	case *IndexExpression:
+		inspectExpression(node.Left, f)
+		inspectExpression(node.Index, f)
+	case *SliceExpression:
+		inspectExpression(node.Left, f)
+		inspectExpression(node.Start, f)
+		inspectExpression(node.End, f)
+		inspectExpression(node.Step, f)
+	case *AssignExpression:
+		inspectExpression(node.Target, f)
+		inspectExpression(node.Value, f)
+	case *IfExpression:
+		inspectExpression(node.Condition, f)
+		Inspect(node.Consequence, f)
+		if node.Alternative != nil {
+			Inspect(node.Alternative, f)
+		}
+	case *TryExpression:
+		Inspect(node.Block, f)
+		Inspect(node.Handler, f)
+	case *FunctionLiteral:
+		Inspect(node.Body, f)
+	case *MacroLiteral:
+		Inspect(node.Body, f)
+	case *CallExpression:
+		inspectExpression(node.Function, f)
+		for _, a := range node.Arguments {
+			inspectExpression(a, f)
+		}
+	case *ArrayLiteral:
+		for _, el := range node.Elements {
+			inspectExpression(el, f)
+		}
+	case *HashLiteral:
+		for _, pair := range node.Pairs {
+			inspectExpression(pair.Key, f)
+			inspectExpression(pair.Value, f)
+		}
+	}
+}
+
+// 省略可能な式 (nil のインターフェース値) を飛ばして辿る
+func inspectExpression(exp Expression, f func(Node) bool) {
+	if exp != nil {
+		Inspect(exp, f)
+	}
+}
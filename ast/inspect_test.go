@@ -0,0 +1,52 @@
+package ast
+
+import "testing"
+
+func TestInspect(t *testing.T) {
+	one := &IntegerLiteral{Value: 1}
+	two := &IntegerLiteral{Value: 2}
+	three := &IntegerLiteral{Value: 3}
+
+	program := &Program{
+		Statements: []Statement{
+			&ExportStatement{Statement: &LetStatement{Name: &Identifier{Value: "x"}, Value: one}},
+			&ExpressionStatement{Expression: &IfExpression{
+				Condition:   &InfixExpression{Left: two, Operator: "<", Right: three},
+				Consequence: &BlockStatement{Statements: []Statement{&ReturnStatement{ReturnValue: two}}},
+			}},
+			&ExpressionStatement{Expression: &FunctionLiteral{
+				Body: &BlockStatement{Statements: []Statement{&ReturnStatement{ReturnValue: three}}},
+			}},
+		},
+	}
+
+	var integers []int64
+	returns := 0
+	Inspect(program, func(node Node) bool {
+		switch node := node.(type) {
+		case *FunctionLiteral:
+			// 関数の中は辿らない
+			return false
+		case *ReturnStatement:
+			returns += 1
+		case *IntegerLiteral:
+			integers = append(integers, node.Value)
+		}
+		return true
+	})
+
+	if returns != 1 {
+		t.Errorf("wrong number of return statements. expected = 1, got = %d", returns)
+	}
+
+	expected := []int64{1, 2, 3, 2}
+	if len(integers) != len(expected) {
+		t.Fatalf("wrong integers. expected = %v, got = %v", expected, integers)
+	}
+	for i, v := range expected {
+		if integers[i] != v {
+			t.Errorf("wrong integers. expected = %v, got = %v", expected, integers)
+			break
+		}
+	}
+}
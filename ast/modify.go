@@ -2,66 +2,157 @@ package ast
 
 type ModifierFunc func(Node) Node
 
+// node 以下を深さ優先で辿り、各ノードに modifier を適用した結果を返す
+// 子を持つノードは浅いコピーを作ってから子を差し替えるので、元の木の構造は変更されない
+// (マクロ本体の AST を quote/unquote が書き換えてしまわないようにするため)
 func Modify(node Node, modifier ModifierFunc) Node {
 	switch node := node.(type) {
 	case *Program:
+		copied := *node
+		copied.Statements = make([]Statement, len(node.Statements))
 		for i, statement := range node.Statements {
-			node.Statements[i], _ = Modify(statement, modifier).(Statement)
+			copied.Statements[i], _ = Modify(statement, modifier).(Statement)
 		}
+		return modifier(&copied)
 
 	case *ExpressionStatement:
-		node.Expression, _ = Modify(node.Expression, modifier).(Expression)
+		copied := *node
+		copied.Expression, _ = Modify(node.Expression, modifier).(Expression)
+		return modifier(&copied)
 
 	case *InfixExpression:
-		node.Left, _ = Modify(node.Left, modifier).(Expression)
-		node.Right, _ = Modify(node.Right, modifier).(Expression)
+		copied := *node
+		copied.Left, _ = Modify(node.Left, modifier).(Expression)
+		copied.Right, _ = Modify(node.Right, modifier).(Expression)
+		return modifier(&copied)
+
+	case *LogicalExpression:
+		copied := *node
+		copied.Left, _ = Modify(node.Left, modifier).(Expression)
+		copied.Right, _ = Modify(node.Right, modifier).(Expression)
+		return modifier(&copied)
 
 	case *PrefixExpression:
-		node.Right, _ = Modify(node.Right, modifier).(Expression)
+		copied := *node
+		copied.Right, _ = Modify(node.Right, modifier).(Expression)
+		return modifier(&copied)
 
 	case *IndexExpression:
-		node.Left, _ = Modify(node.Left, modifier).(Expression)
-		node.Index, _ = Modify(node.Index, modifier).(Expression)
+		copied := *node
+		copied.Left, _ = Modify(node.Left, modifier).(Expression)
+		copied.Index, _ = Modify(node.Index, modifier).(Expression)
+		return modifier(&copied)
+
+	case *SliceExpression:
+		copied := *node
+		copied.Left, _ = Modify(node.Left, modifier).(Expression)
+		if node.Start != nil {
+			copied.Start, _ = Modify(node.Start, modifier).(Expression)
+		}
+		if node.End != nil {
+			copied.End, _ = Modify(node.End, modifier).(Expression)
+		}
+		if node.Step != nil {
+			copied.Step, _ = Modify(node.Step, modifier).(Expression)
+		}
+		return modifier(&copied)
+
+	case *AssignExpression:
+		copied := *node
+		copied.Target, _ = Modify(node.Target, modifier).(Expression)
+		copied.Value, _ = Modify(node.Value, modifier).(Expression)
+		return modifier(&copied)
 
 	case *IfExpression:
-		node.Condition, _ = Modify(node.Condition, modifier).(Expression)
-		node.Consequence, _ = Modify(node.Consequence, modifier).(*BlockStatement)
+		copied := *node
+		copied.Condition, _ = Modify(node.Condition, modifier).(Expression)
+		copied.Consequence, _ = Modify(node.Consequence, modifier).(*BlockStatement)
 
 		if node.Alternative != nil {
-			node.Alternative, _ = Modify(node.Alternative, modifier).(*BlockStatement)
+			copied.Alternative, _ = Modify(node.Alternative, modifier).(*BlockStatement)
 		}
+		return modifier(&copied)
 
 	case *BlockStatement:
+		copied := *node
+		copied.Statements = make([]Statement, len(node.Statements))
 		for i := range node.Statements {
-			node.Statements[i], _ = Modify(node.Statements[i], modifier).(Statement)
+			copied.Statements[i], _ = Modify(node.Statements[i], modifier).(Statement)
 		}
+		return modifier(&copied)
 
 	case *ReturnStatement:
-		node.ReturnValue, _ = Modify(node.ReturnValue, modifier).(Expression)
+		copied := *node
+		copied.ReturnValue, _ = Modify(node.ReturnValue, modifier).(Expression)
+		return modifier(&copied)
+
+	case *ThrowStatement:
+		copied := *node
+		copied.Value, _ = Modify(node.Value, modifier).(Expression)
+		return modifier(&copied)
+
+	case *WhileStatement:
+		copied := *node
+		copied.Condition, _ = Modify(node.Condition, modifier).(Expression)
+		copied.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+		return modifier(&copied)
+
+	case *ForStatement:
+		copied := *node
+		copied.Iterable, _ = Modify(node.Iterable, modifier).(Expression)
+		copied.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+		return modifier(&copied)
+
+	case *TryExpression:
+		copied := *node
+		copied.Block, _ = Modify(node.Block, modifier).(*BlockStatement)
+		copied.Handler, _ = Modify(node.Handler, modifier).(*BlockStatement)
+		return modifier(&copied)
 
 	case *LetStatement:
-		node.Value, _ = Modify(node.Value, modifier).(Expression)
+		copied := *node
+		copied.Value, _ = Modify(node.Value, modifier).(Expression)
+		return modifier(&copied)
+
+	case *ExportStatement:
+		copied := *node
+		copied.Statement, _ = Modify(node.Statement, modifier).(*LetStatement)
+		return modifier(&copied)
 
 	case *FunctionLiteral:
+		copied := *node
+		copied.Parameters = make([]*Identifier, len(node.Parameters))
 		for i := range node.Parameters {
-			node.Parameters[i], _ = Modify(node.Parameters[i], modifier).(*Identifier)
+			copied.Parameters[i], _ = Modify(node.Parameters[i], modifier).(*Identifier)
 		}
-		node.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+		copied.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+		return modifier(&copied)
+
+	case *CallExpression:
+		copied := *node
+		copied.Function, _ = Modify(node.Function, modifier).(Expression)
+		copied.Arguments = make([]Expression, len(node.Arguments))
+		for i := range node.Arguments {
+			copied.Arguments[i], _ = Modify(node.Arguments[i], modifier).(Expression)
+		}
+		return modifier(&copied)
 
 	case *ArrayLiteral:
+		copied := *node
+		copied.Elements = make([]Expression, len(node.Elements))
 		for i := range node.Elements {
-			node.Elements[i], _ = Modify(node.Elements[i], modifier).(Expression)
+			copied.Elements[i], _ = Modify(node.Elements[i], modifier).(Expression)
 		}
+		return modifier(&copied)
 
 	case *HashLiteral:
-		newPairs := make(map[Expression]Expression)
-		for key, val := range node.Pairs {
-			newKey, _ := Modify(key, modifier).(Expression)
-			newVal, _ := Modify(val, modifier).(Expression)
-			newPairs[newKey] = newVal
+		copied := *node
+		copied.Pairs = make([]HashPair, len(node.Pairs))
+		for i, pair := range node.Pairs {
+			copied.Pairs[i].Key, _ = Modify(pair.Key, modifier).(Expression)
+			copied.Pairs[i].Value, _ = Modify(pair.Value, modifier).(Expression)
 		}
-
-		node.Pairs = newPairs
+		return modifier(&copied)
 
 	}
 
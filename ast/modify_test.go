@@ -51,6 +51,14 @@ func TestModify(t *testing.T) {
 			&InfixExpression{Left: two(), Operator: "+", Right: one()},
 			&InfixExpression{Left: two(), Operator: "+", Right: two()},
 		},
+		{
+			&SliceExpression{Left: one(), End: one(), Step: one()},
+			&SliceExpression{Left: two(), End: two(), Step: two()},
+		},
+		{
+			&LogicalExpression{Left: one(), Operator: "&&", Right: one()},
+			&LogicalExpression{Left: two(), Operator: "&&", Right: two()},
+		},
 		{
 			&PrefixExpression{Operator: "-", Right: one()},
 			&PrefixExpression{Operator: "-", Right: two()},
@@ -95,6 +103,76 @@ func TestModify(t *testing.T) {
 			&LetStatement{Value: one()},
 			&LetStatement{Value: two()},
 		},
+		{
+			&WhileStatement{
+				Condition: one(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: one()},
+					},
+				},
+			},
+			&WhileStatement{
+				Condition: two(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: two()},
+					},
+				},
+			},
+		},
+		{
+			&ForStatement{
+				Variables: []*Identifier{{Value: "x"}},
+				Iterable:  one(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: one()},
+					},
+				},
+			},
+			&ForStatement{
+				Variables: []*Identifier{{Value: "x"}},
+				Iterable:  two(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: two()},
+					},
+				},
+			},
+		},
+		{
+			&ThrowStatement{Value: one()},
+			&ThrowStatement{Value: two()},
+		},
+		{
+			&TryExpression{
+				Block: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: one()},
+					},
+				},
+				Parameter: &Identifier{Value: "e"},
+				Handler: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: one()},
+					},
+				},
+			},
+			&TryExpression{
+				Block: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: two()},
+					},
+				},
+				Parameter: &Identifier{Value: "e"},
+				Handler: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: two()},
+					},
+				},
+			},
+		},
 		{
 			&FunctionLiteral{
 				Parameters: []*Identifier{},
@@ -113,10 +191,18 @@ func TestModify(t *testing.T) {
 				},
 			},
 		},
+		{
+			&AssignExpression{Target: &Identifier{Value: "x"}, Operator: "+=", Value: one()},
+			&AssignExpression{Target: &Identifier{Value: "x"}, Operator: "+=", Value: two()},
+		},
 		{
 			&ArrayLiteral{Elements: []Expression{one(), one()}},
 			&ArrayLiteral{Elements: []Expression{two(), two()}},
 		},
+		{
+			&CallExpression{Function: one(), Arguments: []Expression{one(), one()}},
+			&CallExpression{Function: two(), Arguments: []Expression{two(), two()}},
+		},
 	}
 
 	for _, tt := range tests {
@@ -147,23 +233,45 @@ func TestHashModify(t *testing.T) {
 	}
 
 	hashLiteral := &HashLiteral{
-		Pairs: map[Expression]Expression{
-			one(): one(),
-			one(): one(),
+		Pairs: []HashPair{
+			{Key: one(), Value: one()},
+			{Key: one(), Value: one()},
 		},
 	}
 
 	Modify(hashLiteral, turnOneIntoTwo)
 
-	for key, val := range hashLiteral.Pairs {
-		key, _ := key.(*IntegerLiteral)
+	for _, pair := range hashLiteral.Pairs {
+		key, _ := pair.Key.(*IntegerLiteral)
 		if key.Value != 2 {
 			t.Errorf("key.Value is not %d. got = %d", 2, key.Value)
 		}
 
-		val, _ := val.(*IntegerLiteral)
+		val, _ := pair.Value.(*IntegerLiteral)
 		if val.Value != 2 {
 			t.Errorf("val.Value is not %d. got = %d", 2, val.Value)
 		}
 	}
 }
+
+func TestModifyDoesNotChangeOriginalTree(t *testing.T) {
+	one := &IntegerLiteral{Value: 1}
+	original := &InfixExpression{Left: one, Operator: "+", Right: one}
+
+	replaceWithTwo := func(node Node) Node {
+		if _, ok := node.(*IntegerLiteral); ok {
+			return &IntegerLiteral{Value: 2}
+		}
+		return node
+	}
+
+	modified := Modify(original, replaceWithTwo).(*InfixExpression)
+
+	if modified == original {
+		t.Fatalf("Modify returned the original node.")
+	}
+
+	if original.Left != one || original.Right != one {
+		t.Errorf("original tree was changed. got = %#v", original)
+	}
+}
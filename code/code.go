@@ -0,0 +1,308 @@
+package code
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"monkey/token"
+	"sort"
+)
+
+type Instructions []byte
+
+func (ins Instructions) String() string {
+	var out bytes.Buffer
+
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			i += 1
+			continue
+		}
+
+		operands, read := ReadOperands(def, ins[i+1:])
+
+		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+
+		i += 1 + read
+	}
+
+	return out.String()
+}
+
+func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
+	operandCount := len(def.OperandWidths)
+
+	if len(operands) != operandCount {
+		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), operandCount)
+	}
+
+	switch operandCount {
+	case 0:
+		return def.Name
+	case 1:
+		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
+	}
+
+	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
+}
+
+type Opcode byte
+
+const (
+	OpConstant Opcode = iota
+	OpPop
+	OpDup  // スタックの先頭を複製する
+	OpDup2 // スタックの先頭ふたつを複製する
+
+	// 演算子
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEqual
+	OpNotEqual
+	OpGreaterThan
+	OpLessThan
+	OpGreaterEqual
+	OpLessEqual
+	OpMod
+	OpPow
+	OpBitAnd
+	OpBitOr
+	OpBitXor
+	OpShiftLeft
+	OpShiftRight
+	OpMinus
+	OpBang
+	OpBitNot
+
+	// リテラル
+	OpTrue
+	OpFalse
+	OpNull
+	OpArray
+	OpHash
+	OpIndex
+	OpSetIndex // 配列の要素・ハッシュの値を書き換える
+	OpSlice    // a[start:end:step] (省略した位置は null を積む)
+
+	// 分岐
+	OpJumpNotTruthy
+	OpJump
+
+	// 変数
+	OpGetGlobal
+	OpSetGlobal
+	OpGetLocal
+	OpSetLocal
+	OpGetBuiltin
+	OpGetFree
+	OpSetFree
+	OpAssignGlobal // 定義済みのグローバル変数だけを書き換える
+	OpCaptureLocal // クロージャで共有するためにローカル変数を取り出す
+	OpCaptureFree  // 自由変数をさらに内側のクロージャに渡す
+	OpCurrentClosure
+	OpTryGetLocal // 値が入っていればローカル変数を積んでジャンプする
+	OpTryGetFree  // 値が入っていれば自由変数を積んでジャンプする
+	OpTrySetLocal // 値が入っていればローカル変数に代入してジャンプする
+	OpTrySetFree  // 値が入っていれば自由変数に代入してジャンプする
+
+	// 関数
+	OpClosure
+	OpCall
+	OpReturnValue
+	OpReturn
+
+	// ループ
+	OpIter     // コレクションから for-in 用のイテレータを作る
+	OpIterNext // 次の値を積む。尽きたらイテレータを捨ててジャンプする
+
+	// 例外処理
+	OpTry    // catch 節の位置を登録する
+	OpEndTry // try ブロックを抜けたので登録を外す
+	OpThrow
+
+	// モジュール
+	OpImport // 初めてならモジュールを評価してグローバル変数に格納し、モジュールを積む
+	OpModule // export された変数のハッシュからモジュールを作る
+)
+
+type Definition struct {
+	Name          string
+	OperandWidths []int // 各オペランドのバイト数
+}
+
+var definitions = map[Opcode]*Definition{
+	OpConstant: {"OpConstant", []int{2}}, // 定数プールのインデックス
+	OpPop:      {"OpPop", []int{}},
+	OpDup:      {"OpDup", []int{}},
+	OpDup2:     {"OpDup2", []int{}},
+
+	OpAdd:          {"OpAdd", []int{}},
+	OpSub:          {"OpSub", []int{}},
+	OpMul:          {"OpMul", []int{}},
+	OpDiv:          {"OpDiv", []int{}},
+	OpEqual:        {"OpEqual", []int{}},
+	OpNotEqual:     {"OpNotEqual", []int{}},
+	OpGreaterThan:  {"OpGreaterThan", []int{}},
+	OpLessThan:     {"OpLessThan", []int{}},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}},
+	OpLessEqual:    {"OpLessEqual", []int{}},
+	OpMod:          {"OpMod", []int{}},
+	OpPow:          {"OpPow", []int{}},
+	OpBitAnd:       {"OpBitAnd", []int{}},
+	OpBitOr:        {"OpBitOr", []int{}},
+	OpBitXor:       {"OpBitXor", []int{}},
+	OpShiftLeft:    {"OpShiftLeft", []int{}},
+	OpShiftRight:   {"OpShiftRight", []int{}},
+	OpMinus:        {"OpMinus", []int{}},
+	OpBang:         {"OpBang", []int{}},
+	OpBitNot:       {"OpBitNot", []int{}},
+
+	OpTrue:     {"OpTrue", []int{}},
+	OpFalse:    {"OpFalse", []int{}},
+	OpNull:     {"OpNull", []int{}},
+	OpArray:    {"OpArray", []int{2}}, // 要素数
+	OpHash:     {"OpHash", []int{2}},  // キーと値の合計数
+	OpIndex:    {"OpIndex", []int{}},
+	OpSetIndex: {"OpSetIndex", []int{}},
+	OpSlice:    {"OpSlice", []int{}},
+
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}}, // ジャンプ先のオフセット
+	OpJump:          {"OpJump", []int{2}},
+
+	OpGetGlobal:      {"OpGetGlobal", []int{2}}, // グローバル変数のインデックス
+	OpSetGlobal:      {"OpSetGlobal", []int{2}},
+	OpGetLocal:       {"OpGetLocal", []int{1}}, // ローカル変数のインデックス
+	OpSetLocal:       {"OpSetLocal", []int{1}},
+	OpGetBuiltin:     {"OpGetBuiltin", []int{1, 2}}, // 組み込み関数のインデックス, 同じ名前のグローバル変数のインデックス
+	OpGetFree:        {"OpGetFree", []int{1}},       // 自由変数のインデックス
+	OpSetFree:        {"OpSetFree", []int{1}},
+	OpAssignGlobal:   {"OpAssignGlobal", []int{2}},
+	OpCaptureLocal:   {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:    {"OpCaptureFree", []int{1}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpTryGetLocal:    {"OpTryGetLocal", []int{1, 2}}, // ローカル変数のインデックス, 値が入っていたときのジャンプ先
+	OpTryGetFree:     {"OpTryGetFree", []int{1, 2}},  // 自由変数のインデックス, 値が入っていたときのジャンプ先
+	OpTrySetLocal:    {"OpTrySetLocal", []int{1, 2}}, // ローカル変数のインデックス, 値が入っていたときのジャンプ先
+	OpTrySetFree:     {"OpTrySetFree", []int{1, 2}},  // 自由変数のインデックス, 値が入っていたときのジャンプ先
+
+	OpClosure:     {"OpClosure", []int{2, 1}}, // 関数の定数インデックス, 自由変数の数
+	OpCall:        {"OpCall", []int{1}},       // 引数の数
+	OpReturnValue: {"OpReturnValue", []int{}},
+	OpReturn:      {"OpReturn", []int{}},
+
+	OpIter:     {"OpIter", []int{1}},     // ループ変数の数 (2 ならキーも積む)
+	OpIterNext: {"OpIterNext", []int{2}}, // 値が尽きたときのジャンプ先
+
+	OpTry:    {"OpTry", []int{2}}, // catch 節のオフセット
+	OpEndTry: {"OpEndTry", []int{}},
+	OpThrow:  {"OpThrow", []int{}},
+
+	OpImport: {"OpImport", []int{2, 2}}, // モジュールの関数の定数インデックス, モジュールを格納するグローバル変数のインデックス
+	OpModule: {"OpModule", []int{2}},    // モジュール名の定数インデックス
+}
+
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+
+	return def, nil
+}
+
+// オペコードとオペランドからひとつの命令を組み立てる
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	instructionLen := 1
+	for _, w := range def.OperandWidths {
+		instructionLen += w
+	}
+
+	instruction := make([]byte, instructionLen)
+	instruction[0] = byte(op)
+
+	offset := 1
+	for i, o := range operands {
+		width := def.OperandWidths[i]
+		switch width {
+		case 2:
+			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 1:
+			instruction[offset] = byte(o)
+		}
+		offset += width
+	}
+
+	return instruction
+}
+
+// 命令のオペランド部分をデコードし、読み込んだバイト数と一緒に返す
+func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
+		}
+
+		offset += width
+	}
+
+	return operands, offset
+}
+
+func ReadUint16(ins Instructions) uint16 {
+	return binary.BigEndian.Uint16(ins)
+}
+
+func ReadUint8(ins Instructions) uint8 {
+	return uint8(ins[0])
+}
+
+// 命令のオフセットとソースコード上の位置の対応表
+// 実行時エラーの位置を求めるのに使う
+type SourceMap struct {
+	offsets   []int
+	positions []token.Position
+}
+
+// offset 以降の命令の位置として pos を記録する
+// 命令が取り除かれた後に同じオフセットへ記録し直した場合は、古い記録を捨てる
+func (sm *SourceMap) Add(offset int, pos token.Position) {
+	for len(sm.offsets) > 0 && sm.offsets[len(sm.offsets)-1] >= offset {
+		sm.offsets = sm.offsets[:len(sm.offsets)-1]
+		sm.positions = sm.positions[:len(sm.positions)-1]
+	}
+
+	if len(sm.positions) > 0 && sm.positions[len(sm.positions)-1] == pos {
+		return
+	}
+
+	sm.offsets = append(sm.offsets, offset)
+	sm.positions = append(sm.positions, pos)
+}
+
+// offset の命令に対応する位置を返す
+func (sm *SourceMap) Lookup(offset int) token.Position {
+	idx := sort.SearchInts(sm.offsets, offset+1) - 1
+	if idx < 0 {
+		return token.Position{}
+	}
+
+	return sm.positions[idx]
+}
@@ -0,0 +1,1058 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/code"
+	"monkey/evaluator"
+	"monkey/object"
+	"monkey/token"
+	"strings"
+)
+
+// AST をバイトコードに変換する
+//
+// 変数はコンパイル時にレキシカルに解決する。どのスコープにも見つからない名前は
+// グローバル変数として扱い、実行時までに定義されていなければ VM が
+// 評価器と同じ "Identifier Not Found" エラーを返す。
+//
+// 評価器は実行時に内側の環境から順に名前を探すので、関数の中の let で定義する変数は
+// 関数の本体をコンパイルする前にすべて定義しておき、まだ値が入っていないかもしれない変数を
+// 読むときは、値がなければ外側 (グローバル変数か組み込み関数) を読む命令にする。
+// 組み込み関数も、同じ名前のグローバル変数が定義されていればそちらを読む。
+type Compiler struct {
+	constants []object.Object
+
+	symbolTable *SymbolTable
+
+	scopes     []CompilationScope
+	scopeIndex int
+
+	pos token.Position // 現在コンパイル中のノードの位置 (命令に記録する)
+
+	importing  []string                          // コンパイル中のモジュールの絶対パス (循環 import の検出用)
+	readModule func(file string) ([]byte, error) // モジュールのソースを読む関数 (nil なら OS のファイルを読む)
+}
+
+type EmittedInstruction struct {
+	Opcode   code.Opcode
+	Position int
+}
+
+// 関数ごとの命令列
+type CompilationScope struct {
+	instructions        code.Instructions
+	sourceMap           code.SourceMap
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+
+	loops    []*loopContext // コンパイル中のループ (内側が末尾)
+	tryDepth int            // 入れ子になった try ブロックの数
+	operands int            // コンパイル中の式が先に積んで、スタックに残したままの値の数
+}
+
+// break のジャンプ先はループを最後までコンパイルしてから書き換える
+type loopContext struct {
+	start      int   // continue のジャンプ先
+	breakJumps []int // break の OpJump の位置
+	tryDepth   int   // ループに入ったときの try の深さ
+	operands   int   // ループに入ったときにスタックに残っていた値の数
+	iterator   bool  // for-in ならスタックにイテレータが積まれている
+}
+
+type Bytecode struct {
+	Instructions code.Instructions
+	Constants    []object.Object
+	SourceMap    code.SourceMap
+	GlobalNames  []string // グローバル変数名 (未定義エラーの表示用)
+}
+
+func New() *Compiler {
+	mainScope := CompilationScope{
+		instructions:        code.Instructions{},
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+
+	symbolTable := NewSymbolTable()
+	for i, name := range evaluator.BuiltinNames() {
+		symbolTable.DefineBuiltin(i, name)
+	}
+
+	return &Compiler{
+		constants:   []object.Object{},
+		symbolTable: symbolTable,
+		scopes:      []CompilationScope{mainScope},
+		scopeIndex:  0,
+	}
+}
+
+// REPL のように入力をまたいでグローバル変数と定数を引き継ぐ場合に使う
+func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
+	compiler := New()
+	compiler.symbolTable = s
+	compiler.constants = constants
+	return compiler
+}
+
+// import するモジュールのソースを読む関数を設定する (evaluator.NewModuleReader で作る)
+func (c *Compiler) SetModuleReader(read func(file string) ([]byte, error)) {
+	c.readModule = read
+}
+
+// NewWithState に渡すための、組み込み関数を定義済みのシンボルテーブルを返す
+func NewGlobalSymbolTable() *SymbolTable {
+	return New().symbolTable
+}
+
+func (c *Compiler) Compile(node ast.Node) error {
+	// 子ノードのコンパイルが終わったら、自分の位置に戻す
+	prevPos := c.pos
+	if pos := node.Pos(); pos.IsValid() {
+		c.pos = pos
+	}
+	defer func() { c.pos = prevPos }()
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			err := c.Compile(s)
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.ExpressionStatement:
+		err := c.Compile(node.Expression)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpPop)
+
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			err := c.Compile(s)
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.LetStatement:
+		var symbol Symbol
+
+		// 関数は自分自身を参照できるように先に定義しておく
+		// それ以外は評価器と同じく、右辺を評価してから束縛する
+		if _, ok := node.Value.(*ast.FunctionLiteral); ok {
+			symbol = c.symbolTable.Define(node.Name.Value)
+		}
+
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		if symbol.Name == "" {
+			symbol = c.symbolTable.Define(node.Name.Value)
+		}
+
+		if symbol.Scope == GlobalScope {
+			c.emit(code.OpSetGlobal, symbol.Index)
+		} else {
+			c.emit(code.OpSetLocal, symbol.Index)
+		}
+
+	case *ast.ExportStatement:
+		return c.Compile(node.Statement)
+
+	case *ast.ImportStatement:
+		return c.compileImportStatement(node)
+
+	case *ast.ReturnStatement:
+		err := c.Compile(node.ReturnValue)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpReturnValue)
+
+	case *ast.Identifier:
+		c.compileIdentifier(node)
+
+	case *ast.IntegerLiteral:
+		integer := &object.Integer{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(integer))
+
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
+
+	case *ast.StringLiteral:
+		str := &object.String{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(str))
+
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+
+	case *ast.PrefixExpression:
+		err := c.Compile(node.Right)
+		if err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "!":
+			c.emit(code.OpBang)
+		case "-":
+			c.emit(code.OpMinus)
+		case "~":
+			c.emit(code.OpBitNot)
+		default:
+			return fmt.Errorf("unknown operator %s", node.Operator)
+		}
+
+	case *ast.InfixExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		err = c.compileOperand(node.Right, 1)
+		if err != nil {
+			return err
+		}
+
+		op, ok := infixOpcodes[node.Operator]
+		if !ok {
+			return fmt.Errorf("unknown operator %s", node.Operator)
+		}
+		c.emit(op)
+
+	case *ast.LogicalExpression:
+		return c.compileLogicalExpression(node)
+
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(node)
+
+	case *ast.IfExpression:
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		// ジャンプ先は後から書き換える
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		err = c.compileBlockValue(node.Consequence)
+		if err != nil {
+			return err
+		}
+
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		afterConsequencePos := len(c.currentInstructions())
+		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+
+		if node.Alternative == nil {
+			c.emit(code.OpNull)
+		} else {
+			err := c.compileBlockValue(node.Alternative)
+			if err != nil {
+				return err
+			}
+		}
+
+		afterAlternativePos := len(c.currentInstructions())
+		c.changeOperand(jumpPos, afterAlternativePos)
+
+	case *ast.TryExpression:
+		// エラーが起きたら VM がスタックを try の時点に戻し、エラーの値を積んで catch 節に飛ぶ
+		tryPos := c.emit(code.OpTry, 9999)
+
+		c.scopes[c.scopeIndex].tryDepth += 1
+		err := c.compileBlockValue(node.Block)
+		c.scopes[c.scopeIndex].tryDepth -= 1
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpEndTry)
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		afterBlockPos := len(c.currentInstructions())
+		c.changeOperand(tryPos, afterBlockPos)
+
+		// 評価器と同じく、catch の変数は let と同じスコープに束縛する
+		symbol := c.symbolTable.Define(node.Parameter.Value)
+		if symbol.Scope == GlobalScope {
+			c.emit(code.OpSetGlobal, symbol.Index)
+		} else {
+			c.emit(code.OpSetLocal, symbol.Index)
+		}
+
+		err = c.compileBlockValue(node.Handler)
+		if err != nil {
+			return err
+		}
+
+		afterHandlerPos := len(c.currentInstructions())
+		c.changeOperand(jumpPos, afterHandlerPos)
+
+	case *ast.WhileStatement:
+		loop := c.enterLoop()
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpJump, loop.start)
+
+		afterLoopPos := len(c.currentInstructions())
+		c.changeOperand(jumpNotTruthyPos, afterLoopPos)
+		c.leaveLoop(afterLoopPos)
+
+	case *ast.ForStatement:
+		// イテレータはループの間スタックに積んだままにしておく
+		// 値が尽きたら OpIterNext が、break なら break の直前で捨てる
+		err := c.Compile(node.Iterable)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpIter, len(node.Variables))
+
+		loop := c.enterLoop()
+		loop.iterator = true
+		iterNextPos := c.emit(code.OpIterNext, 9999)
+
+		// キー、値の順に積まれるので逆順に束縛する
+		for i := len(node.Variables) - 1; i >= 0; i-- {
+			symbol := c.symbolTable.Define(node.Variables[i].Value)
+			if symbol.Scope == GlobalScope {
+				c.emit(code.OpSetGlobal, symbol.Index)
+			} else {
+				c.emit(code.OpSetLocal, symbol.Index)
+			}
+		}
+
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpJump, loop.start)
+
+		afterLoopPos := len(c.currentInstructions())
+		c.changeOperand(iterNextPos, afterLoopPos)
+		c.leaveLoop(afterLoopPos)
+
+	case *ast.BreakStatement, *ast.ContinueStatement:
+		scope := &c.scopes[c.scopeIndex]
+		if len(scope.loops) == 0 {
+			return fmt.Errorf("%s: %s outside loop", node.Pos(), node.TokenLiteral())
+		}
+		loop := scope.loops[len(scope.loops)-1]
+
+		// ループの内側で入った try ブロックから抜ける
+		for i := loop.tryDepth; i < scope.tryDepth; i++ {
+			c.emit(code.OpEndTry)
+		}
+
+		// 式の途中で抜けるときは、それまでに積んだ値を捨てる
+		for i := loop.operands; i < scope.operands; i++ {
+			c.emit(code.OpPop)
+		}
+
+		if _, ok := node.(*ast.BreakStatement); ok {
+			if loop.iterator {
+				c.emit(code.OpPop)
+			}
+			loop.breakJumps = append(loop.breakJumps, c.emit(code.OpJump, 9999))
+		} else {
+			c.emit(code.OpJump, loop.start)
+		}
+
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+
+	case *ast.ArrayLiteral:
+		for i, el := range node.Elements {
+			err := c.compileOperand(el, i)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpArray, len(node.Elements))
+
+	case *ast.HashLiteral:
+		// 書かれた順にキーと値を積む
+		for i, pair := range node.Pairs {
+			err := c.compileOperand(pair.Key, i*2)
+			if err != nil {
+				return err
+			}
+			err = c.compileOperand(pair.Value, i*2+1)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpHash, len(node.Pairs)*2)
+
+	case *ast.IndexExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		err = c.compileOperand(node.Index, 1)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpIndex)
+
+	case *ast.SliceExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		for i, bound := range []ast.Expression{node.Start, node.End, node.Step} {
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+			if err := c.compileOperand(bound, i+1); err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpSlice)
+
+	case *ast.FunctionLiteral:
+		c.enterScope()
+
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+
+		for _, p := range node.Parameters {
+			c.symbolTable.Define(p.Value)
+			c.symbolTable.MarkDefinite(p.Value)
+		}
+		c.declareLocals(node.Body)
+
+		for _, s := range node.Body.Statements {
+			err := c.Compile(s)
+			if err != nil {
+				return err
+			}
+
+			// 本体の直下の let より後では、その変数は必ず定義されている
+			if let, ok := s.(*ast.LetStatement); ok {
+				c.symbolTable.MarkDefinite(let.Name.Value)
+			}
+		}
+
+		// 最後の式の値を戻り値にする
+		if c.lastInstructionIs(code.OpPop) {
+			c.replaceLastPopWithReturn()
+		}
+		if !c.lastInstructionIs(code.OpReturnValue) {
+			c.emit(code.OpReturn)
+		}
+
+		freeSymbols := c.symbolTable.FreeSymbols
+		numLocals := c.symbolTable.numDefinitions
+		localNames := c.symbolTable.Names()
+		sourceMap := c.scopes[c.scopeIndex].sourceMap
+		instructions := c.leaveScope()
+
+		// 自由変数は値ではなく、代入を共有できるように変数そのものを渡す
+		for _, s := range freeSymbols {
+			c.captureSymbol(s)
+		}
+
+		compiledFn := &object.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     numLocals,
+			NumParameters: len(node.Parameters),
+			LocalNames:    localNames,
+			Name:          node.Name,
+			SourceMap:     sourceMap,
+			Parameters:    node.Parameters,
+			Body:          node.Body,
+		}
+
+		fnIndex := c.addConstant(compiledFn)
+		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+
+	case *ast.CallExpression:
+		// quote/unquote は AST を値として扱うので、評価器でしか実行できない
+		if name := node.Function.TokenLiteral(); name == "quote" || name == "unquote" {
+			return fmt.Errorf("%s: %s is not supported by the compiler", node.Pos(), name)
+		}
+
+		err := c.Compile(node.Function)
+		if err != nil {
+			return err
+		}
+
+		for i, a := range node.Arguments {
+			err := c.compileOperand(a, i+1)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpCall, len(node.Arguments))
+
+	case *ast.MacroLiteral:
+		return fmt.Errorf("%s: macro literal is not supported by the compiler", node.Pos())
+
+	default:
+		return fmt.Errorf("%s: unsupported node %T", node.Pos(), node)
+	}
+
+	return nil
+}
+
+var infixOpcodes = map[string]code.Opcode{
+	"+":  code.OpAdd,
+	"-":  code.OpSub,
+	"*":  code.OpMul,
+	"/":  code.OpDiv,
+	"==": code.OpEqual,
+	"!=": code.OpNotEqual,
+	">":  code.OpGreaterThan,
+	"<":  code.OpLessThan,
+	">=": code.OpGreaterEqual,
+	"<=": code.OpLessEqual,
+	"%":  code.OpMod,
+	"**": code.OpPow,
+	"&":  code.OpBitAnd,
+	"|":  code.OpBitOr,
+	"^":  code.OpBitXor,
+	"<<": code.OpShiftLeft,
+	">>": code.OpShiftRight,
+}
+
+func (c *Compiler) Bytecode() *Bytecode {
+	return &Bytecode{
+		Instructions: c.currentInstructions(),
+		Constants:    c.constants,
+		SourceMap:    c.scopes[c.scopeIndex].sourceMap,
+		GlobalNames:  c.symbolTable.Outermost().Names(),
+	}
+}
+
+// ブロックを値を残す式としてコンパイルする
+// 最後の文が式文ならその値を残し、そうでなければ (空のブロックや let で終わる場合) null を残す
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	startPos := len(c.currentInstructions())
+
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	if len(c.currentInstructions()) > startPos && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	return nil
+}
+
+// モジュールはトップレベルを引数のない関数としてコンパイルし、OpImport で初めて実行したときに
+// 評価したモジュールをグローバル変数に格納する。モジュールの変数もグローバル変数になるので、
+// 評価器と同じく関数から後で定義される変数を参照できる
+//
+//	import "m" -> OpImport (モジュールの関数), (モジュールを格納するグローバル変数), (m に格納)
+func (c *Compiler) compileImportStatement(node *ast.ImportStatement) error {
+	file, key := evaluator.ResolveModule(node.Pos(), node.Path)
+
+	module, ok := c.symbolTable.ResolveModule(key)
+	if !ok {
+		if err := evaluator.ImportCycleError(c.importing, key); err != nil {
+			return fmt.Errorf("%s: %s", node.Pos(), err.Message)
+		}
+
+		src, loadErr := evaluator.LoadModule(file, key, c.readModule)
+		if loadErr != nil {
+			if loadErr.Pos.IsValid() {
+				return fmt.Errorf("%s: %s", loadErr.Pos, loadErr.Message)
+			}
+			return fmt.Errorf("%s: %s", node.Pos(), loadErr.Message)
+		}
+
+		constant, err := c.compileModule(src)
+		if err != nil {
+			return err
+		}
+		module = c.symbolTable.DefineModule(key, constant)
+	}
+
+	c.emit(code.OpImport, module.Constant, module.Global)
+
+	symbol := c.symbolTable.Define(node.Name.Value)
+	if symbol.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, symbol.Index)
+	} else {
+		c.emit(code.OpSetLocal, symbol.Index)
+	}
+
+	return nil
+}
+
+// モジュールのトップレベルをコンパイルし、関数の定数インデックスを返す
+// 関数は export された変数を名前をキーにしたハッシュにまとめ、モジュールにして返す
+func (c *Compiler) compileModule(src *evaluator.ModuleSource) (int, error) {
+	c.importing = append(c.importing, src.Path)
+	symbolTable := c.symbolTable
+	c.enterScope()
+	c.symbolTable = NewModuleSymbolTable(symbolTable)
+	for i, name := range evaluator.BuiltinNames() {
+		c.symbolTable.DefineBuiltin(i, name)
+	}
+
+	defer func() {
+		c.importing = c.importing[:len(c.importing)-1]
+		c.symbolTable = symbolTable
+	}()
+
+	err := c.Compile(src.Program)
+	if err != nil {
+		c.leaveScope()
+		return 0, err
+	}
+
+	for _, name := range src.Exports {
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: name}))
+		symbol, _ := c.symbolTable.Resolve(name)
+		c.loadSymbol(symbol)
+	}
+	c.emit(code.OpHash, len(src.Exports)*2)
+	c.emit(code.OpModule, c.addConstant(&object.String{Value: src.Name}))
+	c.emit(code.OpReturnValue)
+
+	sourceMap := c.scopes[c.scopeIndex].sourceMap
+	instructions := c.leaveScope()
+
+	compiledFn := &object.CompiledFunction{
+		Instructions: instructions,
+		Name:         evaluator.ModuleFrameName(src.Name),
+		SourceMap:    sourceMap,
+	}
+	return c.addConstant(compiledFn), nil
+}
+
+// 左辺の値を複製して真偽を調べ、右辺を評価しないときは複製した左辺を結果として残す
+//
+//	&&: <left> OpDup OpJumpNotTruthy(end) OpPop <right> end:
+//	||: <left> OpDup OpJumpNotTruthy(rhs) OpJump(end) rhs: OpPop <right> end:
+func (c *Compiler) compileLogicalExpression(node *ast.LogicalExpression) error {
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+
+	c.emit(code.OpDup)
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	var jumpEndPos int
+	if node.Operator == "||" {
+		jumpEndPos = c.emit(code.OpJump, 9999)
+		c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+	}
+
+	c.emit(code.OpPop)
+	if err := c.Compile(node.Right); err != nil {
+		return err
+	}
+
+	afterRightPos := len(c.currentInstructions())
+	if node.Operator == "||" {
+		c.changeOperand(jumpEndPos, afterRightPos)
+	} else {
+		c.changeOperand(jumpNotTruthyPos, afterRightPos)
+	}
+
+	return nil
+}
+
+// 代入式の値は代入した値になる
+//
+//	x = v    -> v, OpDup, (x に格納)
+//	x += v   -> x, v, OpAdd, OpDup, (x に格納)
+//	a[i] = v -> a, i, v, OpSetIndex
+//	a[i] += v -> a, i, OpDup2, OpIndex, v, OpAdd, OpSetIndex
+func (c *Compiler) compileAssignExpression(node *ast.AssignExpression) error {
+	var op code.Opcode
+	if node.Operator != "=" {
+		var ok bool
+		op, ok = infixOpcodes[strings.TrimSuffix(node.Operator, "=")]
+		if !ok {
+			return fmt.Errorf("unknown operator %s", node.Operator)
+		}
+	}
+
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.ResolveAssignable(target.Value)
+		if !ok {
+			// 実行時までに定義されていなければ VM がエラーにする
+			symbol = c.symbolTable.Outermost().Define(target.Value)
+		}
+		if symbol.Scope == BuiltinScope {
+			return fmt.Errorf("%s: cannot assign to builtin function %s", node.Pos(), target.Value)
+		}
+
+		operands := 0
+		if node.Operator != "=" {
+			c.loadVariable(symbol)
+			operands = 1
+		}
+
+		err := c.compileOperand(node.Value, operands)
+		if err != nil {
+			return err
+		}
+
+		if node.Operator != "=" {
+			c.emit(op)
+		}
+		c.emit(code.OpDup)
+		c.storeVariable(symbol)
+
+	case *ast.IndexExpression:
+		err := c.Compile(target.Left)
+		if err != nil {
+			return err
+		}
+
+		err = c.compileOperand(target.Index, 1)
+		if err != nil {
+			return err
+		}
+
+		operands := 2
+		if node.Operator != "=" {
+			c.emit(code.OpDup2)
+			c.emit(code.OpIndex)
+			operands = 3
+		}
+
+		err = c.compileOperand(node.Value, operands)
+		if err != nil {
+			return err
+		}
+
+		if node.Operator != "=" {
+			c.emit(op)
+		}
+		c.emit(code.OpSetIndex)
+
+	default:
+		return fmt.Errorf("%s: cannot assign to %s", node.Pos(), node.Target.String())
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileIdentifier(node *ast.Identifier) {
+	symbol, ok := c.symbolTable.Resolve(node.Value)
+	if !ok {
+		// 後から定義されるかもしれないグローバル変数として扱う
+		symbol = c.symbolTable.Outermost().Define(node.Value)
+	}
+	c.loadVariable(symbol)
+}
+
+// 変数を読む
+// まだ定義されていないかもしれないローカル変数や自由変数は、値がなければ外側の変数を読む
+//
+//	OpTryGetLocal (変数), (end) <外側の変数を読む命令> end:
+func (c *Compiler) loadVariable(symbol Symbol) {
+	var tryPositions []int
+	for !c.symbolTable.IsDefinite(symbol) {
+		switch symbol.Scope {
+		case LocalScope:
+			tryPositions = append(tryPositions, c.emit(code.OpTryGetLocal, symbol.Index, 9999))
+		case FreeScope:
+			tryPositions = append(tryPositions, c.emit(code.OpTryGetFree, symbol.Index, 9999))
+		}
+
+		outer, ok := c.symbolTable.ResolveOuter(symbol)
+		if !ok {
+			outer = c.symbolTable.Outermost().Define(symbol.Name)
+		}
+		symbol = outer
+	}
+	c.loadSymbol(symbol)
+
+	for _, pos := range tryPositions {
+		c.changeJumpTarget(pos, len(c.currentInstructions()))
+	}
+}
+
+// スタックの一番上の値を変数に代入する
+// まだ定義されていないかもしれないローカル変数や自由変数は、値がなければ外側の変数に代入する
+//
+//	OpTrySetLocal (変数), (end) <外側の変数に代入する命令> end:
+func (c *Compiler) storeVariable(symbol Symbol) {
+	var tryPositions []int
+	for !c.symbolTable.IsDefinite(symbol) {
+		switch symbol.Scope {
+		case LocalScope:
+			tryPositions = append(tryPositions, c.emit(code.OpTrySetLocal, symbol.Index, 9999))
+		case FreeScope:
+			tryPositions = append(tryPositions, c.emit(code.OpTrySetFree, symbol.Index, 9999))
+		}
+
+		outer, ok := c.symbolTable.ResolveOuterAssignable(symbol)
+		if !ok {
+			outer = c.symbolTable.Outermost().Define(symbol.Name)
+		}
+		symbol = outer
+	}
+
+	switch symbol.Scope {
+	case GlobalScope:
+		c.emit(code.OpAssignGlobal, symbol.Index)
+	case BuiltinScope:
+		// 組み込み関数と同じ名前のグローバル変数が定義されていなければ VM がエラーにする
+		_, global, _ := c.symbolTable.ResolveBuiltin(symbol.Name)
+		c.emit(code.OpAssignGlobal, global.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, symbol.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, symbol.Index)
+	}
+
+	for _, pos := range tryPositions {
+		c.changeJumpTarget(pos, len(c.currentInstructions()))
+	}
+}
+
+// 条件付きで読み書きする命令 (OpTryGetLocal など) の、成功したときの飛び先を書き換える
+func (c *Compiler) changeJumpTarget(pos int, target int) {
+	ins := c.currentInstructions()
+	op := code.Opcode(ins[pos])
+	index := code.ReadUint8(ins[pos+1:])
+	c.replaceInstruction(pos, code.Make(op, int(index), target))
+}
+
+// 関数の本体で定義される変数を、本体をコンパイルする前にすべて定義しておく
+// 内側の関数から、後で定義される変数を参照できるようにするため (内側の関数の本体は辿らない)
+// 変数の順番は、本体をコンパイルしたときに定義される順と同じにする
+func (c *Compiler) declareLocals(node ast.Node) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FunctionLiteral, *ast.MacroLiteral:
+			return false
+		case *ast.LetStatement:
+			if _, ok := node.Value.(*ast.FunctionLiteral); ok {
+				c.symbolTable.Define(node.Name.Value)
+				return false
+			}
+			c.declareLocals(node.Value)
+			c.symbolTable.Define(node.Name.Value)
+			return false
+		case *ast.ForStatement:
+			c.declareLocals(node.Iterable)
+			for i := len(node.Variables) - 1; i >= 0; i-- {
+				c.symbolTable.Define(node.Variables[i].Value)
+			}
+			c.declareLocals(node.Body)
+			return false
+		case *ast.TryExpression:
+			c.declareLocals(node.Block)
+			c.symbolTable.Define(node.Parameter.Value)
+			c.declareLocals(node.Handler)
+			return false
+		case *ast.ImportStatement:
+			c.symbolTable.Define(node.Name.Value)
+		}
+		return true
+	})
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		// 組み込み関数と同じ名前のグローバル変数は、定義されていなければ組み込み関数を読む
+		if builtin, global, ok := c.symbolTable.ResolveBuiltin(s.Name); ok && global == s {
+			c.emit(code.OpGetBuiltin, builtin.Index, global.Index)
+		} else {
+			c.emit(code.OpGetGlobal, s.Index)
+		}
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case BuiltinScope:
+		_, global, _ := c.symbolTable.ResolveBuiltin(s.Name)
+		c.emit(code.OpGetBuiltin, s.Index, global.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
+
+// クロージャに渡す自由変数を積む
+// ローカル変数と自由変数は、内側と外側で代入を共有できるように VM がセルに入れて渡す
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	c.constants = append(c.constants, obj)
+	return len(c.constants) - 1
+}
+
+// 命令を追加し、その開始位置を返す
+func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	ins := code.Make(op, operands...)
+	pos := c.addInstruction(ins)
+
+	c.scopes[c.scopeIndex].sourceMap.Add(pos, c.pos)
+	c.setLastInstruction(op, pos)
+
+	return pos
+}
+
+func (c *Compiler) addInstruction(ins []byte) int {
+	posNewInstruction := len(c.currentInstructions())
+	updatedInstructions := append(c.currentInstructions(), ins...)
+
+	c.scopes[c.scopeIndex].instructions = updatedInstructions
+
+	return posNewInstruction
+}
+
+func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
+	previous := c.scopes[c.scopeIndex].lastInstruction
+	last := EmittedInstruction{Opcode: op, Position: pos}
+
+	c.scopes[c.scopeIndex].previousInstruction = previous
+	c.scopes[c.scopeIndex].lastInstruction = last
+}
+
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
+}
+
+func (c *Compiler) removeLastPop() {
+	last := c.scopes[c.scopeIndex].lastInstruction
+	previous := c.scopes[c.scopeIndex].previousInstruction
+
+	old := c.currentInstructions()
+	new := old[:last.Position]
+
+	c.scopes[c.scopeIndex].instructions = new
+	c.scopes[c.scopeIndex].lastInstruction = previous
+}
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+}
+
+func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
+	ins := c.currentInstructions()
+
+	for i := 0; i < len(newInstruction); i++ {
+		ins[pos+i] = newInstruction[i]
+	}
+}
+
+func (c *Compiler) changeOperand(opPos int, operand int) {
+	op := code.Opcode(c.currentInstructions()[opPos])
+	newInstruction := code.Make(op, operand)
+
+	c.replaceInstruction(opPos, newInstruction)
+}
+
+// 現在の位置から始まるループに入る
+// 先に積んだ n 個の値をスタックに残したまま、式をコンパイルする
+// 式の中の break・continue が、残した値を捨ててからループを抜けられるように数えておく
+func (c *Compiler) compileOperand(node ast.Node, n int) error {
+	c.scopes[c.scopeIndex].operands += n
+	err := c.Compile(node)
+	c.scopes[c.scopeIndex].operands -= n
+	return err
+}
+
+func (c *Compiler) enterLoop() *loopContext {
+	scope := &c.scopes[c.scopeIndex]
+	loop := &loopContext{start: len(scope.instructions), tryDepth: scope.tryDepth, operands: scope.operands}
+	scope.loops = append(scope.loops, loop)
+	return loop
+}
+
+// ループを抜け、break のジャンプ先を afterLoopPos に書き換える
+func (c *Compiler) leaveLoop(afterLoopPos int) {
+	scope := &c.scopes[c.scopeIndex]
+	loop := scope.loops[len(scope.loops)-1]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, afterLoopPos)
+	}
+}
+
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+func (c *Compiler) enterScope() {
+	scope := CompilationScope{
+		instructions:        code.Instructions{},
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+	c.scopes = append(c.scopes, scope)
+	c.scopeIndex += 1
+
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveScope() code.Instructions {
+	instructions := c.currentInstructions()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex -= 1
+
+	c.symbolTable = c.symbolTable.Outer
+
+	return instructions
+}
@@ -0,0 +1,654 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"monkey/code"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type compilerTestCase struct {
+	input                string
+	expectedConstants    []interface{}
+	expectedInstructions []code.Instructions
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// < は左右を入れ替えずに評価順を保つ
+			input:             "1 < 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 <= 2 % 3",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpMod),
+				code.Make(code.OpLessEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "~1 << 2 ** 3",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpBitNot),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPow),
+				code.Make(code.OpShiftLeft),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-1",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (true) { 10 }; 3333;",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 10), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpJump, 11),          // 0007
+				code.Make(code.OpNull),              // 0010
+				code.Make(code.OpPop),               // 0011
+				code.Make(code.OpConstant, 1),       // 0012
+				code.Make(code.OpPop),               // 0015
+			},
+		},
+		{
+			// 値を残さないブロックは null になる
+			input:             "if (true) { }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),             // 0000
+				code.Make(code.OpJumpNotTruthy, 8), // 0001
+				code.Make(code.OpNull),             // 0004
+				code.Make(code.OpJump, 9),          // 0005
+				code.Make(code.OpNull),             // 0008
+				code.Make(code.OpPop),              // 0009
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "true && false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),             // 0000
+				code.Make(code.OpDup),              // 0001
+				code.Make(code.OpJumpNotTruthy, 7), // 0002
+				code.Make(code.OpPop),              // 0005
+				code.Make(code.OpFalse),            // 0006
+				code.Make(code.OpPop),              // 0007
+			},
+		},
+		{
+			input:             "false || true",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFalse),            // 0000
+				code.Make(code.OpDup),              // 0001
+				code.Make(code.OpJumpNotTruthy, 8), // 0002
+				code.Make(code.OpJump, 10),         // 0005
+				code.Make(code.OpPop),              // 0008
+				code.Make(code.OpTrue),             // 0009
+				code.Make(code.OpPop),              // 0010
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `while (true) { break; continue; }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 13), // 0001
+				code.Make(code.OpJump, 13),          // 0004
+				code.Make(code.OpJump, 0),           // 0007
+				code.Make(code.OpJump, 0),           // 0010
+			},
+		},
+		{
+			input:             `for (x in []) { break; }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),     // 0000
+				code.Make(code.OpIter, 1),      // 0003
+				code.Make(code.OpIterNext, 18), // 0005
+				code.Make(code.OpSetGlobal, 0), // 0008
+				code.Make(code.OpPop),          // 0011
+				code.Make(code.OpJump, 18),     // 0012
+				code.Make(code.OpJump, 5),      // 0015
+			},
+		},
+		{
+			// 式の途中の break は、先に積んだ左辺を捨ててから抜ける
+			input:             `while (true) { 1 + if (true) { break; } }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 25), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpTrue),              // 0007
+				code.Make(code.OpJumpNotTruthy, 19), // 0008
+				code.Make(code.OpPop),               // 0011
+				code.Make(code.OpJump, 25),          // 0012
+				code.Make(code.OpNull),              // 0015
+				code.Make(code.OpJump, 20),          // 0016
+				code.Make(code.OpNull),              // 0019
+				code.Make(code.OpAdd),               // 0020
+				code.Make(code.OpPop),               // 0021
+				code.Make(code.OpJump, 0),           // 0022
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `try { 1 } catch (e) { e }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTry, 10),      // 0000
+				code.Make(code.OpConstant, 0),  // 0003
+				code.Make(code.OpEndTry),       // 0006
+				code.Make(code.OpJump, 16),     // 0007
+				code.Make(code.OpSetGlobal, 0), // 0010
+				code.Make(code.OpGetGlobal, 0), // 0013
+				code.Make(code.OpPop),          // 0016
+			},
+		},
+		{
+			input:             `throw "oops"`,
+			expectedConstants: []interface{}{"oops"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0), // 0000
+				code.Make(code.OpThrow),       // 0003
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let one = 1; let two = one; two;",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 未定義の名前は後から定義されるグローバル変数として扱う
+			input:             "later; let later = 1;",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(a) { let b = a; b }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(a) { fn(b) { a + b } }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "let countDown = fn(x) { countDown(x - 1); }; countDown(1);",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let x = 1; x += 2;",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpDup),
+				code.Make(code.OpAssignGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = [1]; a[0] = 2;",
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 省略した位置には null を積む
+			input:             "[1][:0]",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpNull),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpNull),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `let h = {}; h["a"] -= 1;`,
+			expectedConstants: []interface{}{"a", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpDup2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSub),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let c = 0; fn() { c = c + 1 } }",
+			expectedConstants: []interface{}{
+				0,
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpDup),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "len([]);",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltin, builtinIndex("len"), 0),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestUnsupportedNodes(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"quote(1 + 2)", "1:6: quote is not supported by the compiler"},
+		{"macro(x) { x }", "1:1: macro literal is not supported by the compiler"},
+		{"len = 1", "1:5: cannot assign to builtin function len"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Errorf("expected compile error for %q", tt.input)
+			continue
+		}
+
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong error. expected = %q, got = %q", tt.expectedError, err.Error())
+		}
+	}
+}
+
+func TestImports(t *testing.T) {
+	dir := t.TempDir()
+	modules := map[string]string{
+		"m.mk": "let x = 2; export let y = x;",
+		"a.mk": `import "b";`,
+		"b.mk": `import "a";`,
+	}
+	for name, src := range modules {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compile := func(input string) (*Compiler, error) {
+		compiler := New()
+		l := lexer.NewWithFilename(filepath.Join(dir, "main.mk"), input)
+		return compiler, compiler.Compile(parser.New(l).ParseProgram())
+	}
+
+	// モジュールの変数は同じ名前でも別のグローバル変数になり、2 回目の import はコンパイルし直さない
+	compiler, err := compile(`let x = 1; import "m"; import "m" as n;`)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	key, _ := filepath.Abs(filepath.Join(dir, "m.mk"))
+	expectedNames := []string{"x", "x", "y", key, "m", "n"}
+	names := compiler.Bytecode().GlobalNames
+	if strings.Join(names, ",") != strings.Join(expectedNames, ",") {
+		t.Errorf("wrong global names. expected = %q, got = %q", expectedNames, names)
+	}
+
+	imports := 0
+	for ip := 0; ip < len(compiler.Bytecode().Instructions); {
+		def, _ := code.Lookup(compiler.Bytecode().Instructions[ip])
+		_, read := code.ReadOperands(def, compiler.Bytecode().Instructions[ip+1:])
+		if def.Name == "OpImport" {
+			imports += 1
+		}
+		ip += 1 + read
+	}
+	if imports != 2 {
+		t.Errorf("wrong number of OpImport. expected = 2, got = %d", imports)
+	}
+
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{`import "a"`, filepath.Join(dir, "b.mk") + ":1:1: import cycle: a.mk -> b.mk -> a.mk"},
+		{`import "missing"`, filepath.Join(dir, "main.mk") + ":1:1: module not found: " + filepath.Join(dir, "missing.mk")},
+	}
+
+	for _, tt := range tests {
+		_, err := compile(tt.input)
+		if err == nil {
+			t.Errorf("expected compile error for %q", tt.input)
+			continue
+		}
+
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong error. expected = %q, got = %q", tt.expectedError, err.Error())
+		}
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("let a = 1;\na + true;"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	// OpConstant(3) OpSetGlobal(3) OpGetGlobal(3) OpTrue(1) OpAdd
+	addPos := bytecode.SourceMap.Lookup(10)
+	if addPos.String() != "2:3" {
+		t.Errorf("wrong position for OpAdd. got = %s", addPos)
+	}
+
+	getPos := bytecode.SourceMap.Lookup(6)
+	if getPos.String() != "2:1" {
+		t.Errorf("wrong position for OpGetGlobal. got = %s", getPos)
+	}
+}
+
+func builtinIndex(name string) int {
+	for i, n := range evaluator.BuiltinNames() {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		msg := testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if msg != "" {
+			t.Fatalf("%s: testInstructions failed: %s", tt.input, msg)
+		}
+
+		msg = testConstants(tt.expectedConstants, bytecode.Constants)
+		if msg != "" {
+			t.Fatalf("%s: testConstants failed: %s", tt.input, msg)
+		}
+	}
+}
+
+func concatInstructions(s []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+	return out
+}
+
+func testInstructions(expected []code.Instructions, actual code.Instructions) string {
+	concatted := concatInstructions(expected)
+
+	if len(actual) != len(concatted) || string(actual) != string(concatted) {
+		return "wrong instructions.\nexpected =\n" + concatted.String() + "got =\n" + actual.String()
+	}
+
+	return ""
+}
+
+func testConstants(expected []interface{}, actual []object.Object) string {
+	if len(expected) != len(actual) {
+		return "wrong number of constants. got = " + inspectAll(actual)
+	}
+
+	for i, constant := range expected {
+		switch constant := constant.(type) {
+		case int:
+			integer, ok := actual[i].(*object.Integer)
+			if !ok || integer.Value != int64(constant) {
+				return "constant is not the expected integer. got = " + actual[i].Inspect()
+			}
+
+		case string:
+			str, ok := actual[i].(*object.String)
+			if !ok || str.Value != constant {
+				return "constant is not the expected string. got = " + actual[i].Inspect()
+			}
+
+		case []code.Instructions:
+			fn, ok := actual[i].(*object.CompiledFunction)
+			if !ok {
+				return "constant is not a function. got = " + actual[i].Inspect()
+			}
+
+			err := testInstructions(constant, fn.Instructions)
+			if err != "" {
+				return "constant is not the expected function: " + err
+			}
+		}
+	}
+
+	return ""
+}
+
+func inspectAll(objs []object.Object) string {
+	s := []string{}
+	for _, o := range objs {
+		s = append(s, o.Inspect())
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,303 @@
+package compiler
+
+type SymbolScope string
+
+const (
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	BuiltinScope  SymbolScope = "BUILTIN"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
+)
+
+type Symbol struct {
+	Name  string
+	Scope SymbolScope
+	Index int
+}
+
+type SymbolTable struct {
+	Outer *SymbolTable
+
+	store          map[string]Symbol
+	numDefinitions int
+	names          []string // インデックス順の変数名
+
+	globals *globalSlots // グローバル変数のスロット (最も外側のテーブルだけが持つ)
+
+	// 組み込み関数と、それと同じ名前のグローバル変数 (最も外側のテーブルだけが持つ)
+	// 評価器と同じく、グローバル変数が定義されていれば組み込み関数より優先する
+	builtins map[string]Symbol
+	shadows  map[string]Symbol
+
+	// 読む時点で必ず値が入っている変数 (引数と、関数の本体の直下の let で定義済みのもの)
+	definite map[Symbol]bool
+
+	FreeSymbols []Symbol // 外側のスコープから捕捉した変数
+
+	// 名前で参照する変数がまだ定義されていないときのために捕捉した、外側の変数 (外側のシンボルごと)
+	outerFree map[Symbol]Symbol
+}
+
+// グローバル変数のスロット
+// モジュールのトップレベルの変数もグローバル変数なので、プログラムとモジュールのテーブルで
+// ひとつを共有し、名前が同じでも別のスロットを割り当てる
+type globalSlots struct {
+	names   []string                // インデックス順の変数名
+	modules map[string]ModuleSymbol // コンパイル済みのモジュール (絶対パスごと)
+}
+
+// コンパイル済みのモジュール
+type ModuleSymbol struct {
+	Constant int // モジュールのトップレベルをコンパイルした関数の定数インデックス
+	Global   int // 評価したモジュールを格納するグローバル変数のインデックス
+}
+
+func NewSymbolTable() *SymbolTable {
+	s := make(map[string]Symbol)
+	free := []Symbol{}
+	return &SymbolTable{store: s, definite: map[Symbol]bool{}, FreeSymbols: free}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+// 変数を定義する
+// 同じスコープに同名の変数があれば、そのスロットを使い回す (評価器の let による上書きと同じ振る舞い)
+func (s *SymbolTable) Define(name string) Symbol {
+	if symbol, ok := s.store[name]; ok && (symbol.Scope == GlobalScope || symbol.Scope == LocalScope) {
+		return symbol
+	}
+
+	var symbol Symbol
+	if _, ok := s.builtins[name]; ok && s.Outer == nil {
+		symbol = s.shadowingGlobal(name)
+	} else if s.Outer == nil {
+		slots := s.globalSlots()
+		symbol = Symbol{Name: name, Scope: GlobalScope, Index: len(slots.names)}
+		slots.names = append(slots.names, name)
+	} else {
+		symbol = Symbol{Name: name, Scope: LocalScope, Index: s.numDefinitions}
+		s.names = append(s.names, name)
+	}
+
+	s.store[name] = symbol
+	s.numDefinitions += 1
+	return symbol
+}
+
+func (s *SymbolTable) globalSlots() *globalSlots {
+	if s.globals == nil {
+		s.globals = &globalSlots{modules: make(map[string]ModuleSymbol)}
+	}
+	return s.globals
+}
+
+// モジュールのトップレベルのシンボルテーブルを作る
+// プログラムの変数は見えないが、グローバル変数のスロットは program と共有する
+func NewModuleSymbolTable(program *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.globals = program.Outermost().globalSlots()
+	return s
+}
+
+// コンパイル済みのモジュールを探す
+func (s *SymbolTable) ResolveModule(path string) (ModuleSymbol, bool) {
+	module, ok := s.Outermost().globalSlots().modules[path]
+	return module, ok
+}
+
+// コンパイルしたモジュールを登録し、評価したモジュールを格納するグローバル変数を割り当てる
+func (s *SymbolTable) DefineModule(path string, constant int) ModuleSymbol {
+	slots := s.Outermost().globalSlots()
+	module := ModuleSymbol{Constant: constant, Global: len(slots.names)}
+	slots.names = append(slots.names, path)
+	slots.modules[path] = module
+	return module
+}
+
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
+	s.store[name] = symbol
+	if s.builtins == nil {
+		s.builtins = make(map[string]Symbol)
+	}
+	s.builtins[name] = symbol
+	return symbol
+}
+
+// name の組み込み関数と、それと同じ名前のグローバル変数を返す (name が組み込み関数でなければ false)
+// グローバル変数はまだ定義されていなくても割り当てておき、後の let で同じスロットを使う
+func (s *SymbolTable) ResolveBuiltin(name string) (builtin, global Symbol, ok bool) {
+	outermost := s.Outermost()
+	builtin, ok = outermost.builtins[name]
+	if !ok {
+		return Symbol{}, Symbol{}, false
+	}
+	return builtin, outermost.shadowingGlobal(name), true
+}
+
+func (s *SymbolTable) shadowingGlobal(name string) Symbol {
+	if symbol, ok := s.shadows[name]; ok {
+		return symbol
+	}
+
+	slots := s.globalSlots()
+	symbol := Symbol{Name: name, Scope: GlobalScope, Index: len(slots.names)}
+	slots.names = append(slots.names, name)
+
+	if s.shadows == nil {
+		s.shadows = make(map[string]Symbol)
+	}
+	s.shadows[name] = symbol
+	return symbol
+}
+
+// 変数が必ず定義済みであることを記録する
+func (s *SymbolTable) MarkDefinite(name string) {
+	s.definite[s.store[name]] = true
+}
+
+// 読む時点で必ず値が入っているかどうか
+// let で定義する変数は、評価器では実行するまで存在しないので、定義される前に読まれうる
+func (s *SymbolTable) IsDefinite(symbol Symbol) bool {
+	switch symbol.Scope {
+	case LocalScope, FreeScope:
+		return s.definite[symbol]
+	default:
+		return true
+	}
+}
+
+// 関数自身の名前を定義する (再帰呼び出しで自分自身のクロージャを参照するため)
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	symbol := s.capture(original)
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) capture(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1}
+	symbol.Scope = FreeScope
+
+	// 内側の関数は捕捉した時点より後に呼ばれるので、その時点で定義済みなら必ず定義されている
+	s.definite[symbol] = s.Outer.IsDefinite(original)
+	return symbol
+}
+
+// symbol (このテーブルで解決した変数) がまだ定義されていないときに代わりに参照する、外側の変数を返す
+// 評価器が外側の環境を辿るのと同じ順に解決し、外側の関数の変数は名前とは別に自由変数として捕捉する
+// グローバル変数まで辿っても見つからなければ false を返す
+func (s *SymbolTable) ResolveOuter(symbol Symbol) (Symbol, bool) {
+	return s.resolveOuter(symbol, (*SymbolTable).Resolve)
+}
+
+// ResolveOuter の代入先版 (関数自身の名前は、その関数を束縛している外側の変数に解決する)
+func (s *SymbolTable) ResolveOuterAssignable(symbol Symbol) (Symbol, bool) {
+	return s.resolveOuter(symbol, (*SymbolTable).ResolveAssignable)
+}
+
+func (s *SymbolTable) resolveOuter(symbol Symbol, resolve func(*SymbolTable, string) (Symbol, bool)) (Symbol, bool) {
+	var outer Symbol
+	var ok bool
+	switch {
+	case s.Outer == nil:
+		return Symbol{}, false
+	case symbol.Scope == LocalScope:
+		outer, ok = resolve(s.Outer, symbol.Name)
+	case symbol.Scope == FreeScope:
+		outer, ok = s.Outer.resolveOuter(s.FreeSymbols[symbol.Index], resolve)
+	default:
+		return Symbol{}, false
+	}
+	if !ok || outer.Scope == GlobalScope || outer.Scope == BuiltinScope {
+		return outer, ok
+	}
+
+	if free, ok := s.outerFree[outer]; ok {
+		return free, true
+	}
+	if s.outerFree == nil {
+		s.outerFree = make(map[Symbol]Symbol)
+	}
+	free := s.capture(outer)
+	s.outerFree[outer] = free
+	return free, true
+}
+
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	obj, ok := s.store[name]
+	if !ok && s.Outer != nil {
+		obj, ok = s.Outer.Resolve(name)
+		if !ok {
+			return obj, ok
+		}
+
+		// グローバル変数と組み込み関数はそのまま参照できる
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+			return obj, ok
+		}
+
+		// 外側の関数のローカル変数は自由変数として捕捉する
+		free := s.defineFree(obj)
+		return free, true
+	}
+
+	return obj, ok
+}
+
+// 代入先の変数を解決する
+// 関数自身の名前は、その関数を束縛している外側の変数を指すように解決し直す
+func (s *SymbolTable) ResolveAssignable(name string) (Symbol, bool) {
+	obj, ok := s.store[name]
+	if ok && obj.Scope == FreeScope && s.FreeSymbols[obj.Index].Scope == FunctionScope {
+		// 外側の関数の名前を捕捉していた場合は、捕捉する変数を差し替える
+		original, ok := s.Outer.ResolveAssignable(name)
+		if ok {
+			s.FreeSymbols[obj.Index] = original
+		}
+		return obj, ok
+	}
+	if ok && obj.Scope != FunctionScope {
+		return obj, true
+	}
+
+	delete(s.store, name)
+	if s.Outer == nil {
+		return Symbol{}, false
+	}
+
+	obj, ok = s.Outer.ResolveAssignable(name)
+	if !ok || obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		return obj, ok
+	}
+
+	return s.defineFree(obj), true
+}
+
+// 最も外側 (グローバル) のシンボルテーブル
+func (s *SymbolTable) Outermost() *SymbolTable {
+	if s.Outer == nil {
+		return s
+	}
+	return s.Outer.Outermost()
+}
+
+// インデックス順の変数名の一覧
+func (s *SymbolTable) Names() []string {
+	if s.Outer == nil {
+		return s.globalSlots().names
+	}
+	return s.names
+}
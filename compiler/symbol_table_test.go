@@ -0,0 +1,85 @@
+package compiler
+
+import "testing"
+
+func TestDefine(t *testing.T) {
+	global := NewSymbolTable()
+
+	a := global.Define("a")
+	if a != (Symbol{Name: "a", Scope: GlobalScope, Index: 0}) {
+		t.Errorf("a wrong. got = %+v", a)
+	}
+
+	b := global.Define("b")
+	if b != (Symbol{Name: "b", Scope: GlobalScope, Index: 1}) {
+		t.Errorf("b wrong. got = %+v", b)
+	}
+
+	// 同じスコープで再定義したら同じスロットを使う
+	again := global.Define("a")
+	if again != a {
+		t.Errorf("redefined a wrong. got = %+v", again)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	c := local.Define("c")
+	if c != (Symbol{Name: "c", Scope: LocalScope, Index: 0}) {
+		t.Errorf("c wrong. got = %+v", c)
+	}
+
+	if names := global.Names(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("global names wrong. got = %q", names)
+	}
+}
+
+func TestResolveFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	global.DefineBuiltin(0, "len")
+
+	firstLocal := NewEnclosedSymbolTable(global)
+	firstLocal.Define("b")
+
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+	secondLocal.Define("c")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "len", Scope: BuiltinScope, Index: 0},
+		{Name: "b", Scope: FreeScope, Index: 0},
+		{Name: "c", Scope: LocalScope, Index: 0},
+	}
+
+	for _, sym := range expected {
+		result, ok := secondLocal.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got = %+v", sym.Name, sym, result)
+		}
+	}
+
+	if len(secondLocal.FreeSymbols) != 1 || secondLocal.FreeSymbols[0].Scope != LocalScope {
+		t.Errorf("free symbols wrong. got = %+v", secondLocal.FreeSymbols)
+	}
+
+	if _, ok := secondLocal.Resolve("unknown"); ok {
+		t.Errorf("unknown should not be resolvable")
+	}
+}
+
+func TestDefineFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+
+	result, ok := global.Resolve("a")
+	if !ok {
+		t.Fatalf("function name a not resolvable")
+	}
+
+	if result != (Symbol{Name: "a", Scope: FunctionScope, Index: 0}) {
+		t.Errorf("a wrong. got = %+v", result)
+	}
+}
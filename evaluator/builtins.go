@@ -1,41 +1,160 @@
 package evaluator
 
 import (
-	"fmt"
+	"math"
+	"math/big"
 	"monkey/object"
+	"sort"
+	"strconv"
+	"unicode/utf8"
 )
 
-var builtins = map[string]*object.Builtin{
+// I/O を行わない組み込み関数
+var pureBuiltins = map[string]*object.Builtin{
 	"len":   &object.Builtin{Fn: builtinLen},
 	"first": &object.Builtin{Fn: builtinFirst},
 	"last":  &object.Builtin{Fn: builtinLast},
 	"rest":  &object.Builtin{Fn: builtinRest},
 	"push":  &object.Builtin{Fn: builtinPush},
-	"puts":  &object.Builtin{Fn: builtinPuts},
+	"int":   &object.Builtin{Fn: builtinInt},
+	"float": &object.Builtin{Fn: builtinFloat},
+	"error": &object.Builtin{Fn: builtinError},
+
+	// 文字列
+	"split":       &object.Builtin{Fn: builtinSplit},
+	"join":        &object.Builtin{Fn: builtinJoin},
+	"trim":        &object.Builtin{Fn: builtinTrim},
+	"replace":     &object.Builtin{Fn: builtinReplace},
+	"contains":    &object.Builtin{Fn: builtinContains},
+	"starts_with": &object.Builtin{Fn: builtinStartsWith},
+	"ends_with":   &object.Builtin{Fn: builtinEndsWith},
+	"upper":       &object.Builtin{Fn: builtinUpper},
+	"lower":       &object.Builtin{Fn: builtinLower},
+	"substr":      &object.Builtin{Fn: builtinSubstr},
+	"repeat":      &object.Builtin{Fn: builtinRepeat, Cost: repeatCost},
+	"index_of":    &object.Builtin{Fn: builtinIndexOf},
+	"format":      &object.Builtin{Fn: builtinFormat},
+
+	// 配列
+	"map":     &object.Builtin{Fn: builtinMap},
+	"filter":  &object.Builtin{Fn: builtinFilter},
+	"reduce":  &object.Builtin{Fn: builtinReduce},
+	"sort":    &object.Builtin{Fn: builtinSort},
+	"reverse": &object.Builtin{Fn: builtinReverse},
+	"range":   &object.Builtin{Fn: builtinRange, Cost: rangeCost},
+	"zip":     &object.Builtin{Fn: builtinZip},
+	"any":     &object.Builtin{Fn: builtinAny},
+	"all":     &object.Builtin{Fn: builtinAll},
+	"concat":  &object.Builtin{Fn: builtinConcat},
+
+	// ハッシュ
+	"keys":    &object.Builtin{Fn: builtinKeys},
+	"values":  &object.Builtin{Fn: builtinValues},
+	"entries": &object.Builtin{Fn: builtinEntries},
+	"has":     &object.Builtin{Fn: builtinHas},
+	"delete":  &object.Builtin{Fn: builtinDelete},
+	"merge":   &object.Builtin{Fn: builtinMerge},
+}
+
+// 出力やファイル・時計を使う組み込み関数 (I/O は渡された Host を通して行う)
+var hostBuiltins = map[string]func(host Host) object.BuiltinFunction{
+	"puts":       builtinPuts,
+	"read_file":  builtinReadFile,
+	"write_file": builtinWriteFile,
+	"now":        builtinNow,
+}
+
+// 既定の組み込み関数 (OS の標準出力・ファイル・時計を使い、すべて公開する)
+var builtins = NewBuiltins(OSHost{}, nil)
+
+// 組み込み関数名の一覧 (コンパイラと VM はこの並びのインデックスで組み込み関数を参照する)
+var builtinNames = sortedBuiltinNames()
+
+func sortedBuiltinNames() []string {
+	names := make([]string, 0, len(pureBuiltins)+len(hostBuiltins))
+	for name := range pureBuiltins {
+		names = append(names, name)
+	}
+	for name := range hostBuiltins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func BuiltinNames() []string {
+	return builtinNames
 }
 
-func builtinLen(args ...object.Object) object.Object {
+// 組み込み関数を呼び出し、処理した量を exec のステップとして数える (exec が nil なら数えない)
+// 処理の量は Cost の見積もりか、作った文字列のバイト数・配列とハッシュの要素数にする
+func CallBuiltin(exec *object.Execution, builtin *object.Builtin, apply object.ApplyFunction, args []object.Object) object.Object {
+	if exec != nil && builtin.Cost != nil {
+		if err := exec.StepN(builtin.Cost(args)); err != nil {
+			return err
+		}
+	}
+
+	result := builtin.Fn(apply, args...)
+
+	if exec != nil && builtin.Cost == nil {
+		if err := exec.StepN(resultSize(result)); err != nil {
+			return err
+		}
+	}
+	return result
+}
+
+func resultSize(obj object.Object) int64 {
+	switch obj := obj.(type) {
+	case *object.String:
+		return int64(len(obj.Value))
+	case *object.Array:
+		return int64(len(obj.Elements))
+	case *object.Hash:
+		return int64(len(obj.Keys))
+	default:
+		return 0
+	}
+}
+
+// exec で使える組み込み関数を探す
+// exec.Builtins が設定されていればその表から、なければ既定の組み込み関数から探す
+func LookupBuiltin(exec *object.Execution, name string) (*object.Builtin, bool) {
+	table := builtins
+	if exec != nil && exec.Builtins != nil {
+		table = exec.Builtins
+	}
+
+	builtin, ok := table[name]
+	return builtin, ok
+}
+
+func builtinLen(_ object.ApplyFunction, args ...object.Object) object.Object {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got = %d, want = 1", len(args))
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1", len(args))
 	}
 
 	switch arg := args[0].(type) {
 	case *object.String:
-		return &object.Integer{Value: int64(len(arg.Value))}
+		// バイト数ではなく文字数を返す
+		return &object.Integer{Value: int64(utf8.RuneCountInString(arg.Value))}
 	case *object.Array:
 		return &object.Integer{Value: int64(len(arg.Elements))}
+	case *object.Hash:
+		return &object.Integer{Value: int64(len(arg.Keys))}
 	default:
-		return newError("argument to `len` is not supported. got = %s", args[0].Type())
+		return newError(object.TYPE_ERROR, "argument to `len` is not supported. got = %s", args[0].Type())
 	}
 }
 
-func builtinFirst(args ...object.Object) object.Object {
+func builtinFirst(_ object.ApplyFunction, args ...object.Object) object.Object {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got = %d, want = 1", len(args))
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1", len(args))
 	}
 
 	if args[0].Type() != object.ARRAY_OBJ {
-		return newError("argument to `first` must be ARRAY. got = %s", args[0].Type())
+		return newError(object.TYPE_ERROR, "argument to `first` must be ARRAY. got = %s", args[0].Type())
 	}
 
 	arr := args[0].(*object.Array)
@@ -46,13 +165,13 @@ func builtinFirst(args ...object.Object) object.Object {
 	return NULL
 }
 
-func builtinLast(args ...object.Object) object.Object {
+func builtinLast(_ object.ApplyFunction, args ...object.Object) object.Object {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got = %d, want = 1", len(args))
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1", len(args))
 	}
 
 	if args[0].Type() != object.ARRAY_OBJ {
-		return newError("argument to `last` must be ARRAY. got = %s", args[0].Type())
+		return newError(object.TYPE_ERROR, "argument to `last` must be ARRAY. got = %s", args[0].Type())
 	}
 
 	arr := args[0].(*object.Array)
@@ -64,13 +183,13 @@ func builtinLast(args ...object.Object) object.Object {
 	return NULL
 }
 
-func builtinRest(args ...object.Object) object.Object {
+func builtinRest(_ object.ApplyFunction, args ...object.Object) object.Object {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got = %d, want = 1", len(args))
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1", len(args))
 	}
 
 	if args[0].Type() != object.ARRAY_OBJ {
-		return newError("argument to `rest` must be ARRAY. got = %s", args[0].Type())
+		return newError(object.TYPE_ERROR, "argument to `rest` must be ARRAY. got = %s", args[0].Type())
 	}
 
 	arr := args[0].(*object.Array)
@@ -84,13 +203,13 @@ func builtinRest(args ...object.Object) object.Object {
 	return NULL
 }
 
-func builtinPush(args ...object.Object) object.Object {
+func builtinPush(_ object.ApplyFunction, args ...object.Object) object.Object {
 	if len(args) != 2 {
-		return newError("wrong number of arguments. got = %d, want = 2", len(args))
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 2", len(args))
 	}
 
 	if args[0].Type() != object.ARRAY_OBJ {
-		return newError("argument to `push` must be ARRAY. got = %s", args[0].Type())
+		return newError(object.TYPE_ERROR, "argument to `push` must be ARRAY. got = %s", args[0].Type())
 	}
 
 	arr := args[0].(*object.Array)
@@ -103,10 +222,71 @@ func builtinPush(args ...object.Object) object.Object {
 	return &object.Array{Elements: newElements}
 }
 
-func builtinPuts(args ...object.Object) object.Object {
-	for _, arg := range args {
-		fmt.Println(arg.Inspect())
+// 数値または数値を表す文字列を整数にする (浮動小数点数は 0 方向に切り捨てる)
+func builtinInt(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1", len(args))
 	}
 
-	return NULL
+	switch arg := args[0].(type) {
+	case *object.Integer, *object.BigInteger:
+		return arg
+	case *object.Float:
+		if math.IsNaN(arg.Value) || math.IsInf(arg.Value, 0) {
+			return newError(object.ARGUMENT_ERROR, "cannot convert %s to INTEGER", arg.Inspect())
+		}
+		if arg.Value >= math.MinInt64 && arg.Value < math.MaxInt64 {
+			return &object.Integer{Value: int64(arg.Value)}
+		}
+		value, _ := big.NewFloat(arg.Value).Int(nil)
+		return newBigInteger(value)
+	case *object.String:
+		value, ok := new(big.Int).SetString(arg.Value, 10)
+		if !ok {
+			return newError(object.ARGUMENT_ERROR, "could not parse %q as INTEGER", arg.Value)
+		}
+		return newBigInteger(value)
+	default:
+		return newError(object.TYPE_ERROR, "argument to `int` is not supported. got = %s", args[0].Type())
+	}
+}
+
+// 数値または数値を表す文字列を浮動小数点数にする
+func builtinFloat(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1", len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Integer:
+		return &object.Float{Value: float64(arg.Value)}
+	case *object.BigInteger:
+		return &object.Float{Value: bigToFloat(arg.Value)}
+	case *object.Float:
+		return arg
+	case *object.String:
+		value, err := strconv.ParseFloat(arg.Value, 64)
+		if err != nil {
+			return newError(object.ARGUMENT_ERROR, "could not parse %q as FLOAT", arg.Value)
+		}
+		return &object.Float{Value: value}
+	default:
+		return newError(object.TYPE_ERROR, "argument to `float` is not supported. got = %s", args[0].Type())
+	}
+}
+
+// エラーを投げる (throw と同じ)。2 つ目の引数でエラーの種類を指定できる
+func builtinError(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if len(args) != 1 && len(args) != 2 {
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1 or 2", len(args))
+	}
+
+	if len(args) == 1 {
+		return thrownError(args[0], nil)
+	}
+
+	if args[1].Type() != object.STRING_OBJ {
+		return newError(object.TYPE_ERROR, "kind passed to `error` must be STRING. got = %s", args[1].Type())
+	}
+	return thrownError(args[0], args[1])
 }
@@ -0,0 +1,326 @@
+package evaluator
+
+import (
+	"math"
+	"monkey/object"
+	"sort"
+)
+
+// 配列を扱う高階関数などの組み込み関数
+// コールバックは apply で呼び出し、エラーが返ったらそのまま呼び出し元に返す
+
+// range が作る配列の要素数の上限 (range(2 ** 40) でメモリを使い果たさないように)
+const maxRangeElements = 1 << 24
+
+// 各要素に f を適用した結果の配列を返す
+func builtinMap(apply object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("map", args, 2, object.ARRAY_OBJ, ""); err != nil {
+		return err
+	}
+
+	elements := args[0].(*object.Array).Elements
+	result := make([]object.Object, len(elements))
+	for i, el := range elements {
+		value := apply(args[1], el)
+		if isError(value) {
+			return value
+		}
+		result[i] = value
+	}
+
+	return &object.Array{Elements: result}
+}
+
+// f の結果が真になる要素だけを集めた配列を返す
+func builtinFilter(apply object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("filter", args, 2, object.ARRAY_OBJ, ""); err != nil {
+		return err
+	}
+
+	result := []object.Object{}
+	for _, el := range args[0].(*object.Array).Elements {
+		keep := apply(args[1], el)
+		if isError(keep) {
+			return keep
+		}
+		if isTruthy(keep) {
+			result = append(result, el)
+		}
+	}
+
+	return &object.Array{Elements: result}
+}
+
+// reduce(arr, initial, f) は initial から順に f(acc, el) を畳み込む
+// reduce(arr, f) は最初の要素を初期値にする
+func builtinReduce(apply object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("reduce", args, 2, object.ARRAY_OBJ, "", ""); err != nil {
+		return err
+	}
+
+	elements := args[0].(*object.Array).Elements
+	f := args[len(args)-1]
+
+	var acc object.Object
+	if len(args) == 3 {
+		acc = args[1]
+	} else {
+		if len(elements) == 0 {
+			return newError(object.ARGUMENT_ERROR, "reduce of empty array with no initial value")
+		}
+		acc, elements = elements[0], elements[1:]
+	}
+
+	for _, el := range elements {
+		acc = apply(f, acc, el)
+		if isError(acc) {
+			return acc
+		}
+	}
+
+	return acc
+}
+
+// 並べ替えた新しい配列を返す (安定ソート)
+// 比較関数 cmp(a, b) を渡す場合は、a を先にするなら負、後にするなら正の整数を返す
+// 省略した場合は数値同士・文字列同士を昇順に並べる
+func builtinSort(apply object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("sort", args, 1, object.ARRAY_OBJ, ""); err != nil {
+		return err
+	}
+
+	elements := args[0].(*object.Array).Elements
+	sorted := make([]object.Object, len(elements))
+	copy(sorted, elements)
+
+	// sort.SliceStable は途中で止められないので、最初のエラーを覚えておいて残りの比較は飛ばす
+	var sortErr object.Object
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+
+		var result object.Object
+		if len(args) == 2 {
+			result = apply(args[1], sorted[i], sorted[j])
+		} else {
+			result = compareObjects(sorted[i], sorted[j])
+		}
+
+		switch result := result.(type) {
+		case *object.Integer:
+			return result.Value < 0
+		case *object.BigInteger:
+			return result.Value.Sign() < 0
+		case *object.Error:
+			sortErr = result
+		default:
+			sortErr = newError(object.TYPE_ERROR, "comparator passed to `sort` must return INTEGER. got = %s", result.Type())
+		}
+		return false
+	})
+
+	if sortErr != nil {
+		return sortErr
+	}
+	return &object.Array{Elements: sorted}
+}
+
+// sort の既定の比較 (-1, 0, 1 のいずれかを返す)
+func compareObjects(a, b object.Object) object.Object {
+	var less, greater bool
+
+	switch {
+	case a.Type() == object.STRING_OBJ && b.Type() == object.STRING_OBJ:
+		less = a.(*object.String).Value < b.(*object.String).Value
+		greater = a.(*object.String).Value > b.(*object.String).Value
+	case a.Type() == object.INTEGER_OBJ && b.Type() == object.INTEGER_OBJ:
+		less = compareIntegers(a, b) < 0
+		greater = compareIntegers(a, b) > 0
+	case isNumber(a) && isNumber(b):
+		less = toFloat(a) < toFloat(b)
+		greater = toFloat(a) > toFloat(b)
+	default:
+		return newError(object.TYPE_ERROR, "cannot compare %s and %s", a.Type(), b.Type())
+	}
+
+	switch {
+	case less:
+		return &object.Integer{Value: -1}
+	case greater:
+		return &object.Integer{Value: 1}
+	default:
+		return &object.Integer{Value: 0}
+	}
+}
+
+// 逆順にした新しい配列 (文字列なら文字を逆順にした文字列) を返す
+func builtinReverse(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 1", len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Array:
+		length := len(arg.Elements)
+		reversed := make([]object.Object, length)
+		for i, el := range arg.Elements {
+			reversed[length-1-i] = el
+		}
+		return &object.Array{Elements: reversed}
+	case *object.String:
+		runes := []rune(arg.Value)
+		for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+			runes[i], runes[j] = runes[j], runes[i]
+		}
+		return &object.String{Value: string(runes)}
+	default:
+		return newError(object.TYPE_ERROR, "argument to `reverse` is not supported. got = %s", args[0].Type())
+	}
+}
+
+// range(end), range(start, end), range(start, end, step) で end の手前までの整数の配列を返す
+func builtinRange(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("range", args, 1, object.INTEGER_OBJ, object.INTEGER_OBJ, object.INTEGER_OBJ); err != nil {
+		return err
+	}
+
+	start, end, step := int64(0), args[0].(*object.Integer).Value, int64(1)
+	if len(args) >= 2 {
+		start, end = end, args[1].(*object.Integer).Value
+	}
+	if len(args) == 3 {
+		step = args[2].(*object.Integer).Value
+	}
+
+	if step == 0 {
+		return newError(object.ARGUMENT_ERROR, "step passed to `range` must not be 0")
+	}
+
+	count := rangeLength(start, end, step)
+	if count > maxRangeElements {
+		return newError(object.ARGUMENT_ERROR, "result of `range` is too large. exceeds %d elements", maxRangeElements)
+	}
+
+	elements := make([]object.Object, count)
+	for i := range elements {
+		elements[i] = &object.Integer{Value: start + int64(i)*step}
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// range が作る配列の要素数 (引数が正しくなければ 0 にして、エラーは builtinRange に任せる)
+func rangeCost(args []object.Object) int64 {
+	bounds := make([]int64, len(args))
+	for i, arg := range args {
+		integer, ok := arg.(*object.Integer)
+		if !ok {
+			return 0
+		}
+		bounds[i] = integer.Value
+	}
+
+	start, end, step := int64(0), int64(0), int64(1)
+	switch len(bounds) {
+	case 1:
+		end = bounds[0]
+	case 2:
+		start, end = bounds[0], bounds[1]
+	case 3:
+		start, end, step = bounds[0], bounds[1], bounds[2]
+	default:
+		return 0
+	}
+
+	count := rangeLength(start, end, step)
+	if count > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(count)
+}
+
+// start から step ずつ進めて end の手前までの要素数
+// 差は int64 に収まらないことがあるので uint64 で数える
+func rangeLength(start, end, step int64) uint64 {
+	switch {
+	case step > 0 && start < end:
+		return (uint64(end)-uint64(start)-1)/uint64(step) + 1
+	case step < 0 && start > end:
+		return (uint64(start)-uint64(end)-1)/(-uint64(step)) + 1
+	default:
+		return 0
+	}
+}
+
+// 配列の同じ位置の要素を組にした配列を返す (一番短い配列の長さに揃える)
+func builtinZip(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if len(args) < 2 {
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = at least 2", len(args))
+	}
+
+	length := -1
+	for i, arg := range args {
+		arr, ok := arg.(*object.Array)
+		if !ok {
+			return newError(object.TYPE_ERROR, "argument %d to `zip` must be ARRAY. got = %s", i+1, arg.Type())
+		}
+		if length < 0 || len(arr.Elements) < length {
+			length = len(arr.Elements)
+		}
+	}
+
+	result := make([]object.Object, length)
+	for i := range result {
+		tuple := make([]object.Object, len(args))
+		for j, arg := range args {
+			tuple[j] = arg.(*object.Array).Elements[i]
+		}
+		result[i] = &object.Array{Elements: tuple}
+	}
+
+	return &object.Array{Elements: result}
+}
+
+// f の結果が真になる要素がひとつでもあれば true
+func builtinAny(apply object.ApplyFunction, args ...object.Object) object.Object {
+	return anyOrAll("any", true, apply, args)
+}
+
+// すべての要素で f の結果が真なら true
+func builtinAll(apply object.ApplyFunction, args ...object.Object) object.Object {
+	return anyOrAll("all", false, apply, args)
+}
+
+// stopWhen と同じ真偽値になる要素が見つかったら、残りは調べずに stopWhen を返す
+func anyOrAll(name string, stopWhen bool, apply object.ApplyFunction, args []object.Object) object.Object {
+	if err := checkArgs(name, args, 2, object.ARRAY_OBJ, ""); err != nil {
+		return err
+	}
+
+	for _, el := range args[0].(*object.Array).Elements {
+		result := apply(args[1], el)
+		if isError(result) {
+			return result
+		}
+		if isTruthy(result) == stopWhen {
+			return nativeBoolToBooleanObject(stopWhen)
+		}
+	}
+
+	return nativeBoolToBooleanObject(!stopWhen)
+}
+
+// 配列をつなげた新しい配列を返す
+func builtinConcat(_ object.ApplyFunction, args ...object.Object) object.Object {
+	result := []object.Object{}
+	for i, arg := range args {
+		arr, ok := arg.(*object.Array)
+		if !ok {
+			return newError(object.TYPE_ERROR, "argument %d to `concat` must be ARRAY. got = %s", i+1, arg.Type())
+		}
+		result = append(result, arr.Elements...)
+	}
+
+	return &object.Array{Elements: result}
+}
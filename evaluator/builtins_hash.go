@@ -0,0 +1,111 @@
+package evaluator
+
+import "monkey/object"
+
+// ハッシュを扱う組み込み関数
+// 結果の配列やハッシュはキーを追加した順に並ぶ。引数のハッシュは書き換えず、新しいハッシュを返す
+
+// キーの配列を返す
+func builtinKeys(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("keys", args, 1, object.HASH_OBJ); err != nil {
+		return err
+	}
+
+	pairs := args[0].(*object.Hash).OrderedPairs()
+	result := make([]object.Object, len(pairs))
+	for i, pair := range pairs {
+		result[i] = pair.Key
+	}
+
+	return &object.Array{Elements: result}
+}
+
+// 値の配列を返す
+func builtinValues(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("values", args, 1, object.HASH_OBJ); err != nil {
+		return err
+	}
+
+	pairs := args[0].(*object.Hash).OrderedPairs()
+	result := make([]object.Object, len(pairs))
+	for i, pair := range pairs {
+		result[i] = pair.Value
+	}
+
+	return &object.Array{Elements: result}
+}
+
+// [キー, 値] の配列を返す
+func builtinEntries(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("entries", args, 1, object.HASH_OBJ); err != nil {
+		return err
+	}
+
+	pairs := args[0].(*object.Hash).OrderedPairs()
+	result := make([]object.Object, len(pairs))
+	for i, pair := range pairs {
+		result[i] = &object.Array{Elements: []object.Object{pair.Key, pair.Value}}
+	}
+
+	return &object.Array{Elements: result}
+}
+
+// キーがあるかどうか
+func builtinHas(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("has", args, 2, object.HASH_OBJ, ""); err != nil {
+		return err
+	}
+
+	key, ok := object.HashKeyOf(args[1])
+	if !ok {
+		return newError(object.TYPE_ERROR, "unusable as hash key: %s", args[1].Type())
+	}
+
+	_, found := args[0].(*object.Hash).Get(key)
+	return nativeBoolToBooleanObject(found)
+}
+
+// key を取り除いたハッシュを返す
+func builtinDelete(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("delete", args, 2, object.HASH_OBJ, ""); err != nil {
+		return err
+	}
+
+	key, ok := object.HashKeyOf(args[1])
+	if !ok {
+		return newError(object.TYPE_ERROR, "unusable as hash key: %s", args[1].Type())
+	}
+
+	hash := copyHash(args[0].(*object.Hash))
+	hash.Delete(key)
+	return hash
+}
+
+// ハッシュをまとめたハッシュを返す
+// 同じキーは後の引数の値で上書きし、位置は最初に現れたところのままにする
+func builtinMerge(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if len(args) == 0 {
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = 0, want = at least 1")
+	}
+
+	result := object.NewHash()
+	for i, arg := range args {
+		hash, ok := arg.(*object.Hash)
+		if !ok {
+			return newError(object.TYPE_ERROR, "argument %d to `merge` must be HASH. got = %s", i+1, arg.Type())
+		}
+		for _, key := range hash.Keys {
+			result.Set(key, hash.Pairs[key])
+		}
+	}
+
+	return result
+}
+
+func copyHash(hash *object.Hash) *object.Hash {
+	copied := object.NewHash()
+	for _, key := range hash.Keys {
+		copied.Set(key, hash.Pairs[key])
+	}
+	return copied
+}
@@ -0,0 +1,64 @@
+package evaluator
+
+import (
+	"io"
+	"monkey/object"
+)
+
+// 出力やファイル・時計を使う組み込み関数
+// I/O は直接行わず Host を通すので、埋め込む側が出力先や読み書きできるファイルを決められる
+
+// 引数をそれぞれ 1 行ずつ出力する
+func builtinPuts(host Host) object.BuiltinFunction {
+	return func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		out := host.Stdout()
+		for _, arg := range args {
+			io.WriteString(out, arg.Inspect()+"\n")
+		}
+
+		return NULL
+	}
+}
+
+// ファイルの内容を文字列で返す
+func builtinReadFile(host Host) object.BuiltinFunction {
+	return func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		if err := checkArgs("read_file", args, 1, object.STRING_OBJ); err != nil {
+			return err
+		}
+
+		data, err := host.ReadFile(args[0].(*object.String).Value)
+		if err != nil {
+			return newError(object.IO_ERROR, "%s", err)
+		}
+
+		return &object.String{Value: string(data)}
+	}
+}
+
+// 文字列をファイルに書き込む
+func builtinWriteFile(host Host) object.BuiltinFunction {
+	return func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		if err := checkArgs("write_file", args, 2, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+			return err
+		}
+
+		name, data := args[0].(*object.String).Value, args[1].(*object.String).Value
+		if err := host.WriteFile(name, []byte(data)); err != nil {
+			return newError(object.IO_ERROR, "%s", err)
+		}
+
+		return NULL
+	}
+}
+
+// 現在時刻を UNIX 時間のミリ秒で返す
+func builtinNow(host Host) object.BuiltinFunction {
+	return func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		if len(args) != 0 {
+			return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = 0", len(args))
+		}
+
+		return &object.Integer{Value: host.Now().UnixMilli()}
+	}
+}
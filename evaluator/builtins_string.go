@@ -0,0 +1,332 @@
+package evaluator
+
+import (
+	"fmt"
+	"math"
+	"monkey/object"
+	"strings"
+	"unicode/utf8"
+)
+
+// 文字列を扱う組み込み関数
+// 位置や長さはすべてバイトではなく文字 (rune) 単位で数える
+
+// 組み込み関数が作る文字列のバイト数の上限 (repeat("a", 2 ** 62) などでメモリを使い果たさないように)
+const maxStringBytes = 1 << 30
+
+// split(s) は空白で、split(s, sep) は sep で区切った配列を返す (sep が "" なら 1 文字ずつ)
+func builtinSplit(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("split", args, 1, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	s := args[0].(*object.String).Value
+
+	var parts []string
+	if len(args) == 1 {
+		parts = strings.Fields(s)
+	} else {
+		parts = strings.Split(s, args[1].(*object.String).Value)
+	}
+
+	return stringArray(parts)
+}
+
+// 文字列の配列を sep でつなげる
+func builtinJoin(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("join", args, 2, object.ARRAY_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	elements := args[0].(*object.Array).Elements
+	sep := args[1].(*object.String).Value
+	parts := make([]string, len(elements))
+	size := 0
+	for i, el := range elements {
+		str, ok := el.(*object.String)
+		if !ok {
+			return newError(object.TYPE_ERROR, "elements of array passed to `join` must be STRING. got = %s", el.Type())
+		}
+		parts[i] = str.Value
+
+		if i > 0 {
+			size += len(sep)
+		}
+		size += len(str.Value)
+		if size > maxStringBytes {
+			return stringTooLarge("join")
+		}
+	}
+
+	return &object.String{Value: strings.Join(parts, sep)}
+}
+
+// trim(s) は前後の空白を、trim(s, chars) は前後にある chars のどれかの文字を取り除く
+func builtinTrim(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("trim", args, 1, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	s := args[0].(*object.String).Value
+	if len(args) == 1 {
+		return &object.String{Value: strings.TrimSpace(s)}
+	}
+	return &object.String{Value: strings.Trim(s, args[1].(*object.String).Value)}
+}
+
+// s に含まれるすべての old を new に置き換える
+func builtinReplace(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("replace", args, 3, object.STRING_OBJ, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	s := args[0].(*object.String).Value
+	old := args[1].(*object.String).Value
+	new := args[2].(*object.String).Value
+
+	// 置き換えるたびに len(new) - len(old) バイト増える (old が "" なら文字の間と前後に入る)
+	if growth := int64(len(new) - len(old)); growth > 0 {
+		if int64(strings.Count(s, old))*growth > int64(maxStringBytes-len(s)) {
+			return stringTooLarge("replace")
+		}
+	}
+
+	return &object.String{Value: strings.ReplaceAll(s, old, new)}
+}
+
+func builtinContains(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("contains", args, 2, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	s := args[0].(*object.String).Value
+	return nativeBoolToBooleanObject(strings.Contains(s, args[1].(*object.String).Value))
+}
+
+func builtinStartsWith(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("starts_with", args, 2, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	s := args[0].(*object.String).Value
+	return nativeBoolToBooleanObject(strings.HasPrefix(s, args[1].(*object.String).Value))
+}
+
+func builtinEndsWith(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("ends_with", args, 2, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	s := args[0].(*object.String).Value
+	return nativeBoolToBooleanObject(strings.HasSuffix(s, args[1].(*object.String).Value))
+}
+
+func builtinUpper(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("upper", args, 1, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	return &object.String{Value: strings.ToUpper(args[0].(*object.String).Value)}
+}
+
+func builtinLower(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("lower", args, 1, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	return &object.String{Value: strings.ToLower(args[0].(*object.String).Value)}
+}
+
+// substr(s, start) は start 以降を、substr(s, start, end) は end の手前までを返す
+// 負の位置は末尾から数え、範囲外の位置は文字列の端に切り詰める
+func builtinSubstr(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("substr", args, 2, object.STRING_OBJ, object.INTEGER_OBJ, object.INTEGER_OBJ); err != nil {
+		return err
+	}
+
+	runes := []rune(args[0].(*object.String).Value)
+	length := int64(len(runes))
+
+	start := clampIndex(args[1].(*object.Integer).Value, length)
+	end := length
+	if len(args) == 3 {
+		end = clampIndex(args[2].(*object.Integer).Value, length)
+	}
+
+	if start >= end {
+		return &object.String{Value: ""}
+	}
+	return &object.String{Value: string(runes[start:end])}
+}
+
+// s を n 回繰り返す
+func builtinRepeat(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("repeat", args, 2, object.STRING_OBJ, object.INTEGER_OBJ); err != nil {
+		return err
+	}
+
+	count := args[1].(*object.Integer).Value
+	if count < 0 {
+		return newError(object.ARGUMENT_ERROR, "count passed to `repeat` must not be negative. got = %d", count)
+	}
+
+	// len(s) * count は桁あふれしうるので、割り算で上限と比べる
+	s := args[0].(*object.String).Value
+	if len(s) > 0 && count > int64(maxStringBytes/len(s)) {
+		return stringTooLarge("repeat")
+	}
+
+	return &object.String{Value: strings.Repeat(s, int(count))}
+}
+
+// repeat が作る文字列のバイト数 (引数が正しくなければ 0 にして、エラーは builtinRepeat に任せる)
+func repeatCost(args []object.Object) int64 {
+	if len(args) != 2 {
+		return 0
+	}
+	s, ok := args[0].(*object.String)
+	count, ok2 := args[1].(*object.Integer)
+	if !ok || !ok2 || len(s.Value) == 0 || count.Value <= 0 {
+		return 0
+	}
+
+	if count.Value > math.MaxInt64/int64(len(s.Value)) {
+		return math.MaxInt64
+	}
+	return int64(len(s.Value)) * count.Value
+}
+
+// sub が最初に現れる位置を返す (見つからなければ -1)
+func builtinIndexOf(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if err := checkArgs("index_of", args, 2, object.STRING_OBJ, object.STRING_OBJ); err != nil {
+		return err
+	}
+
+	s := args[0].(*object.String).Value
+	idx := strings.Index(s, args[1].(*object.String).Value)
+	if idx < 0 {
+		return &object.Integer{Value: -1}
+	}
+
+	return &object.Integer{Value: int64(utf8.RuneCountInString(s[:idx]))}
+}
+
+// format("{} + {} = {}", 1, 2, 3) のように、{} を順に引数で置き換える
+// 文字列はそのまま、それ以外は Inspect() の表現で埋め込む。{{ と }} は { と } になる
+func builtinFormat(_ object.ApplyFunction, args ...object.Object) object.Object {
+	if len(args) == 0 {
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = 0, want = at least 1")
+	}
+	if args[0].Type() != object.STRING_OBJ {
+		return newError(object.TYPE_ERROR, "argument 1 to `format` must be STRING. got = %s", args[0].Type())
+	}
+
+	template := args[0].(*object.String).Value
+
+	// 組み立てる前に、埋め込む値を合わせた大きさを上限と比べる
+	values := make([]string, len(args)-1)
+	size := len(template)
+	for i, arg := range args[1:] {
+		values[i] = formatValue(arg)
+		size += len(values[i])
+		if size > maxStringBytes {
+			return stringTooLarge("format")
+		}
+	}
+
+	var out strings.Builder
+	used := 0
+
+	for i := 0; i < len(template); i++ {
+		ch := template[i]
+		next := byte(0)
+		if i+1 < len(template) {
+			next = template[i+1]
+		}
+
+		switch {
+		case ch == '{' && next == '{', ch == '}' && next == '}':
+			out.WriteByte(ch)
+			i++
+		case ch == '{' && next == '}':
+			if used < len(values) {
+				out.WriteString(values[used])
+			}
+			used++
+			i++
+		case ch == '{' || ch == '}':
+			return newError(object.ARGUMENT_ERROR, "unmatched %q in format string", string(ch))
+		default:
+			out.WriteByte(ch)
+		}
+	}
+
+	if used != len(values) {
+		return newError(object.ARGUMENT_ERROR, "format string has %d placeholders but got %d values", used, len(values))
+	}
+
+	return &object.String{Value: out.String()}
+}
+
+// 組み込み関数 name が作る文字列が maxStringBytes を超えるときのエラー
+func stringTooLarge(name string) *object.Error {
+	return newError(object.ARGUMENT_ERROR, "result of `%s` is too large. exceeds %d bytes", name, maxStringBytes)
+}
+
+func formatValue(obj object.Object) string {
+	if str, ok := obj.(*object.String); ok {
+		return str.Value
+	}
+	return obj.Inspect()
+}
+
+// 引数の数と型を確かめる
+// types が引数の型を順に表し ("" ならどの型でもよい)、required 個より後ろの引数は省略できる
+func checkArgs(name string, args []object.Object, required int, types ...object.ObjectType) *object.Error {
+	if len(args) < required || len(args) > len(types) {
+		want := fmt.Sprintf("%d", required)
+		if len(types) == required+1 {
+			want = fmt.Sprintf("%d or %d", required, len(types))
+		} else if len(types) > required {
+			want = fmt.Sprintf("%d to %d", required, len(types))
+		}
+		return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = %s", len(args), want)
+	}
+
+	for i, arg := range args {
+		if types[i] != "" && arg.Type() != types[i] {
+			if len(types) == 1 {
+				return newError(object.TYPE_ERROR, "argument to `%s` must be %s. got = %s", name, types[i], arg.Type())
+			}
+			return newError(object.TYPE_ERROR, "argument %d to `%s` must be %s. got = %s", i+1, name, types[i], arg.Type())
+		}
+		// 回数や位置として受け取る整数は int64 に収まるものに限る (値として受け取る引数はそのまま)
+		if _, ok := arg.(*object.BigInteger); ok && types[i] == object.INTEGER_OBJ {
+			return newError(object.ARGUMENT_ERROR, "argument %d to `%s` is too large. got = %s", i+1, name, arg.Inspect())
+		}
+	}
+
+	return nil
+}
+
+// 負の位置を末尾からの位置にし、0 から length の範囲に収める
+func clampIndex(idx, length int64) int64 {
+	if idx < 0 {
+		idx += length
+	}
+	if idx < 0 {
+		return 0
+	}
+	if idx > length {
+		return length
+	}
+	return idx
+}
+
+func stringArray(values []string) *object.Array {
+	elements := make([]object.Object, len(values))
+	for i, v := range values {
+		elements[i] = &object.String{Value: v}
+	}
+	return &object.Array{Elements: elements}
+}
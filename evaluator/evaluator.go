@@ -2,42 +2,75 @@ package evaluator
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"monkey/ast"
 	"monkey/object"
+	"monkey/token"
+	"strings"
+	"unicode/utf8"
 )
 
 // 固定オブジェクト参照
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL     = &object.Null{}
+	TRUE     = &object.Boolean{Value: true}
+	FALSE    = &object.Boolean{Value: false}
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
+// 関数呼び出しの深さの既定の上限 (Go のスタックを使い果たす前に止める)
+const MaxCallDepth = 1 << 16
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	var result object.Object
+	if err := env.Execution().Step(); err != nil {
+		result = err
+	} else {
+		result = evalNode(node, env)
+	}
+
+	// 位置を持たないエラーには、そのエラーを生んだ最も内側のノードの位置を付ける
+	if err, ok := result.(*object.Error); ok && !err.Pos.IsValid() && node != nil {
+		err.Pos = node.Pos()
+	}
+
+	return result
+}
+
+func evalNode(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
 		return evalProgram(node, env) // program -> 各 statement の評価
 	case *ast.LetStatement:
 		val := Eval(node.Value, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
 		env.Set(node.Name.Value, val)
+	case *ast.ExportStatement:
+		return Eval(node.Statement, env)
+	case *ast.ImportStatement:
+		return evalImportStatement(node, env)
 	case *ast.ExpressionStatement:
 		return Eval(node.Expression, env)
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
 		// 現在の Env のコピーを関数オブジェクト内に閉じ込める
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{Parameters: params, Env: env, Body: body, Name: node.Name}
 	case *ast.CallExpression:
 		if node.Function.TokenLiteral() == "quote" {
 			// quote は単一引数だけを受け取る
+			if len(node.Arguments) != 1 {
+				return newError(object.ARGUMENT_ERROR, "wrong number of arguments to `quote`. got = %d, want = 1", len(node.Arguments))
+			}
 			return quote(node.Arguments[0], env)
 		}
 
 		function := Eval(node.Function, env)
-		if isError(function) {
+		if isAbrupt(function) {
 			return function
 		}
 
@@ -47,36 +80,56 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		// これはどういう場合?
 		// -> evalExpresssions() がエラーを返した場合
 		// -> エラーを呼び出し元に返す
-		if len(args) == 1 && isError(args[0]) {
+		if len(args) == 1 && isAbrupt(args[0]) {
 			return args[0]
 		}
 
 		// 引数を渡して関数を適用
-		return applyFunction(function, args)
+		return applyFunction(function, args, node.Pos(), env.Execution())
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
 		// 前置式の右辺を先に評価し、その結果 + 前置演算子の評価結果を object として返す (右再帰性?)
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isAbrupt(left) {
 			return left
 		}
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
 		return evalInfixExpression(node.Operator, left, right)
+	case *ast.LogicalExpression:
+		return evalLogicalExpression(node, env)
 	case *ast.BlockStatement:
 		return evalBlockStatements(node.Statements, env)
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return evalForStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+		return thrownError(val, nil)
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
@@ -84,25 +137,45 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalIdentifier(node, env)
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
-		if len(elements) == 1 && isError(elements[0]) {
+		if len(elements) == 1 && isAbrupt(elements[0]) {
 			return elements[0]
 		}
 		return &object.Array{Elements: elements}
 	case *ast.IndexExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isAbrupt(left) {
 			return left
 		}
 
 		index := Eval(node.Index, env)
-		if isError(index) {
+		if isAbrupt(index) {
 			return index
 		}
 		return evalIndexExpression(left, index)
+	case *ast.SliceExpression:
+		left := Eval(node.Left, env)
+		if isAbrupt(left) {
+			return left
+		}
+
+		// 省略した位置は NULL として渡す
+		bounds := []object.Object{NULL, NULL, NULL}
+		for i, exp := range []ast.Expression{node.Start, node.End, node.Step} {
+			if exp == nil {
+				continue
+			}
+			bounds[i] = Eval(exp, env)
+			if isAbrupt(bounds[i]) {
+				return bounds[i]
+			}
+		}
+		return evalSliceExpression(left, bounds[0], bounds[1], bounds[2])
 	case *ast.HashLiteral:
 		return evalHashLiteral(node, env)
 	case *ast.Boolean:
@@ -140,7 +213,7 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	for _, e := range exps {
 		evaluated := Eval(e, env)
 
-		if isError(evaluated) {
+		if isAbrupt(evaluated) {
 			return []object.Object{evaluated}
 		}
 
@@ -158,8 +231,8 @@ func evalBlockStatements(stmts []ast.Statement, env *object.Environment) object.
 		if result != nil {
 			rt := result.Type()
 
-			// return 文もしくはエラーがある場合、それ以降は評価せずに戻り値を返す
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			// return 文・エラー・break・continue がある場合、それ以降は評価せずに戻り値を返す
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.BREAK_OBJ || rt == object.CONTINUE_OBJ {
 				return result // result を result.Value に Unwrap せずオブジェクトのまま返す
 			}
 		}
@@ -174,8 +247,10 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 		return evalBangOperatorExpression(right)
 	case "-":
 		return evalMinusPrefixOperatorExpression(right)
+	case "~":
+		return evalTildePrefixOperatorExpression(right)
 	default:
-		return newError("Unknown Operator: %s%s", operator, right.Type())
+		return newError(object.TYPE_ERROR, "Unknown Operator: %s%s", operator, right.Type())
 	}
 }
 
@@ -193,55 +268,103 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
-		return newError("Unknown Operator: -%s", right.Type())
+	switch right := right.(type) {
+	case *object.Integer:
+		if right.Value == math.MinInt64 {
+			return object.NewInteger(new(big.Int).Neg(big.NewInt(right.Value)))
+		}
+		return &object.Integer{Value: -right.Value}
+	case *object.BigInteger:
+		return object.NewInteger(new(big.Int).Neg(right.Value))
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
+		return newError(object.TYPE_ERROR, "Unknown Operator: -%s", right.Type())
 	}
+}
 
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+// ~ はビット反転で、整数にだけ使える
+func evalTildePrefixOperatorExpression(right object.Object) object.Object {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: ^right.Value}
+	case *object.BigInteger:
+		return object.NewInteger(new(big.Int).Not(right.Value))
+	default:
+		return newError(object.TYPE_ERROR, "Unknown Operator: ~%s", right.Type())
+	}
 }
 
 func evalInfixExpression(operator string, left object.Object, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
+	case isNumber(left) && isNumber(right):
+		// 片方が浮動小数点数なら、もう片方も浮動小数点数にして計算する
+		return evalFloatInfixExpression(operator, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(operator, left, right)
 	case operator == "==":
-		// TRUE と FALSE はオブジェクトを使いまわしているので、ポインタ比較すれば良い
-		return nativeBoolToBooleanObject(left == right)
+		return nativeBoolToBooleanObject(objectsEqual(left, right))
 	case operator == "!=":
-		return nativeBoolToBooleanObject(left != right)
+		return nativeBoolToBooleanObject(!objectsEqual(left, right))
 	case left.Type() != right.Type():
-		return newError("Type Mismatch: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "Type Mismatch: %s %s %s", left.Type(), operator, right.Type())
 	default:
-		return newError("Unknown Operator: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "Unknown Operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
-func evalIntegerInfixExpression(operator string, left object.Object, right object.Object) object.Object {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
+// && は左辺が偽なら、|| は左辺が真なら右辺を評価せずに左辺を返し、それ以外は右辺を返す
+// 結果は真偽値に変換せず、結果を決めたオペランドの値そのものになる (false || 2 は 2、1 && "a" は "a")
+func evalLogicalExpression(node *ast.LogicalExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isAbrupt(left) {
+		return left
+	}
+
+	if isTruthy(left) == (node.Operator == "||") {
+		return left
+	}
+
+	return Eval(node.Right, env)
+}
+
+func evalFloatInfixExpression(operator string, left object.Object, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
 
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return &object.Float{Value: leftVal + rightVal}
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return &object.Float{Value: leftVal - rightVal}
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return &object.Float{Value: leftVal * rightVal}
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		// / と違って Inf にはならず NaN になるので、整数と同じくエラーにする
+		if rightVal == 0 {
+			return newError(object.RUNTIME_ERROR, "modulo by zero")
+		}
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "**":
+		return &object.Float{Value: math.Pow(leftVal, rightVal)}
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
 		return nativeBoolToBooleanObject(leftVal != rightVal)
 	default:
-		return newError("Unknown Operator: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "Unknown Operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
@@ -257,69 +380,276 @@ func evalStringInfixExpression(operator string, left object.Object, right object
 	case "!=":
 		return nativeBoolToBooleanObject(leftVal != rightVal)
 	default:
-		return newError("Unknown Operator: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "Unknown Operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// == と != の等価性
+// 配列は要素を順に、ハッシュはキーの順序によらず同じキーの値同士を比べる
+// 関数など中身で比べられないオブジェクトは、同じオブジェクトのときだけ等しい
+func objectsEqual(a, b object.Object) bool {
+	return objectsEqualSeen(a, b, map[[2]object.Object]bool{})
+}
+
+// seen は比べている途中の組 (自分自身を含む配列やハッシュで無限に辿らないように、途中の組は等しいとみなす)
+func objectsEqualSeen(a, b object.Object, seen map[[2]object.Object]bool) bool {
+	// TRUE, FALSE, NULL はオブジェクトを使いまわしているので、ポインタ比較で決まる
+	if a == b {
+		return true
+	}
+
+	switch a := a.(type) {
+	case *object.Array:
+		b, ok := b.(*object.Array)
+		if !ok || len(a.Elements) != len(b.Elements) {
+			return false
+		}
+		if seen[[2]object.Object{a, b}] {
+			return true
+		}
+		seen[[2]object.Object{a, b}] = true
+
+		for i := range a.Elements {
+			if !objectsEqualSeen(a.Elements[i], b.Elements[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *object.Hash:
+		b, ok := b.(*object.Hash)
+		if !ok || len(a.Pairs) != len(b.Pairs) {
+			return false
+		}
+		if seen[[2]object.Object{a, b}] {
+			return true
+		}
+		seen[[2]object.Object{a, b}] = true
+
+		for key, pair := range a.Pairs {
+			other, ok := b.Pairs[key]
+			if !ok || !objectsEqualSeen(pair.Value, other.Value, seen) {
+				return false
+			}
+		}
+		return true
+	case *object.Null:
+		_, ok := b.(*object.Null)
+		return ok
 	}
+
+	if (isNumber(a) && isNumber(b)) || (a.Type() == object.STRING_OBJ && b.Type() == object.STRING_OBJ) {
+		return evalInfixExpression("==", a, b) == TRUE
+	}
+	return false
 }
 
 func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.ARRAY_OBJ:
+		return newError(object.TYPE_ERROR, "array index must be INTEGER. got = %s", index.Type())
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ:
+		return newError(object.TYPE_ERROR, "string index must be INTEGER. got = %s", index.Type())
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.MODULE_OBJ:
+		return evalModuleIndexExpression(left, index)
 	default:
-		return newError("index operator is not supported: %s", left.Type())
+		return newError(object.TYPE_ERROR, "index operator is not supported: %s", left.Type())
 	}
 }
 
 func evalArrayIndexExpression(array, index object.Object) object.Object {
 	arrayObject := array.(*object.Array)
 
-	indexValue := index.(*object.Integer).Value
-	max := int64(len(arrayObject.Elements) - 1)
+	// int64 に収まらない添字は常に範囲外
+	i, ok := index.(*object.Integer)
+	if !ok {
+		return NULL
+	}
 
-	if indexValue < 0 || indexValue > max {
+	indexValue, ok := elementIndex(i.Value, len(arrayObject.Elements))
+	if !ok {
 		return NULL
 	}
 
 	return arrayObject.Elements[indexValue]
 }
 
+// 文字列の添字はバイトではなく文字 (rune) 単位で数える
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	runes := []rune(str.(*object.String).Value)
+
+	i, ok := index.(*object.Integer)
+	if !ok {
+		return NULL
+	}
+
+	indexValue, ok := elementIndex(i.Value, len(runes))
+	if !ok {
+		return NULL
+	}
+
+	return &object.String{Value: string(runes[indexValue])}
+}
+
+// 負の添字を末尾からの位置にし、範囲内なら true を返す (a[-1] は最後の要素)
+func elementIndex(index int64, length int) (int64, bool) {
+	if index < 0 {
+		index += int64(length)
+	}
+	return index, index >= 0 && index < int64(length)
+}
+
+// a[start:end:step] の値を返す (省略した位置は NULL で渡す)
+// Python と同じく、負の位置は末尾から数え、範囲外の位置は端に切り詰める
+// step が負なら start から逆向きに取り出す (a[::-1] は逆順)
+func evalSliceExpression(left, start, end, step object.Object) object.Object {
+	var length int64
+	switch left := left.(type) {
+	case *object.Array:
+		length = int64(len(left.Elements))
+	case *object.String:
+		length = int64(utf8.RuneCountInString(left.Value))
+	default:
+		return newError(object.TYPE_ERROR, "slice operator is not supported: %s", left.Type())
+	}
+
+	stepVal, given, err := sliceBound(step)
+	if err != nil {
+		return err
+	}
+	if !given {
+		stepVal = 1
+	}
+	if stepVal == 0 {
+		return newError(object.INDEX_ERROR, "slice step cannot be zero")
+	}
+
+	// step の向きに取り出せる位置の範囲と、省略したときの開始・終了位置
+	// 逆向きでは、最初の要素の手前を表す -1 までになる
+	lower, upper := int64(0), length
+	from, to := lower, upper
+	if stepVal < 0 {
+		lower, upper = -1, length-1
+		from, to = upper, lower
+	}
+
+	startVal, given, err := sliceBound(start)
+	if err != nil {
+		return err
+	}
+	if given {
+		from = clampSliceIndex(startVal, length, lower, upper)
+	}
+
+	endVal, given, err := sliceBound(end)
+	if err != nil {
+		return err
+	}
+	if given {
+		to = clampSliceIndex(endVal, length, lower, upper)
+	}
+
+	// 取り出す要素の数 (from + k * step を k < count について取り出す)
+	count := int64(0)
+	if stepVal > 0 && from < to {
+		count = (to-from-1)/stepVal + 1
+	} else if stepVal < 0 && from > to {
+		count = (from-to-1)/-stepVal + 1
+	}
+
+	switch left := left.(type) {
+	case *object.Array:
+		elements := make([]object.Object, count)
+		for k := range elements {
+			elements[k] = left.Elements[from+int64(k)*stepVal]
+		}
+		return &object.Array{Elements: elements}
+	default:
+		runes := []rune(left.(*object.String).Value)
+		sliced := make([]rune, count)
+		for k := range sliced {
+			sliced[k] = runes[from+int64(k)*stepVal]
+		}
+		return &object.String{Value: string(sliced)}
+	}
+}
+
+// スライスの位置を int64 にする (NULL なら省略されたものとして given は false)
+// int64 に収まらない整数は、どちら向きにも端を超えた位置として扱う
+func sliceBound(obj object.Object) (value int64, given bool, err *object.Error) {
+	switch obj := obj.(type) {
+	case *object.Null:
+		return 0, false, nil
+	case *object.Integer:
+		// step の符号を反転しても桁あふれしないように、-math.MaxInt64 以上にする
+		if obj.Value < -math.MaxInt64 {
+			return -math.MaxInt64, true, nil
+		}
+		return obj.Value, true, nil
+	case *object.BigInteger:
+		if obj.Value.Sign() < 0 {
+			return -math.MaxInt64, true, nil
+		}
+		return math.MaxInt64, true, nil
+	default:
+		return 0, false, newError(object.TYPE_ERROR, "slice index must be INTEGER. got = %s", obj.Type())
+	}
+}
+
+// 負の位置を末尾からの位置にし、lower から upper の範囲に収める
+func clampSliceIndex(index, length, lower, upper int64) int64 {
+	if index < 0 {
+		index += length
+		if index < lower {
+			return lower
+		}
+		return index
+	}
+	if index > upper {
+		return upper
+	}
+	return index
+}
+
 func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
+	hash := object.NewHash()
 
-	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
-		if isError(key) {
+	for _, pairNode := range node.Pairs {
+		key := Eval(pairNode.Key, env)
+		if isAbrupt(key) {
 			return key
 		}
 
-		hashKey, ok := key.(object.Hashable)
+		hashKey, ok := object.HashKeyOf(key)
 		if !ok {
-			return newError("unusable as hash key: %s", key.Type())
+			return newError(object.TYPE_ERROR, "unusable as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
-		if isError(value) {
+		value := Eval(pairNode.Value, env)
+		if isAbrupt(value) {
 			return value
 		}
 
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{Key: key, Value: value}
+		hash.Set(hashKey, object.HashPair{Key: key, Value: value})
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
 
 func evalHashIndexExpression(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
 
-	key, ok := index.(object.Hashable)
+	key, ok := object.HashKeyOf(index)
 	if !ok {
-		return newError("unusable as hash key: %s", index.Type())
+		return newError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Get(key)
 	if !ok {
 		return NULL
 	}
@@ -327,9 +657,112 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 	return pair.Value
 }
 
+func evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	// "+=" なら "+" のように、複合代入で使う二項演算子
+	operator := strings.TrimSuffix(node.Operator, "=")
+
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		if _, ok := env.Get(target.Value); !ok {
+			if _, ok := LookupBuiltin(env.Execution(), target.Value); ok {
+				return newError(object.NAME_ERROR, "cannot assign to builtin function %s", target.Value)
+			}
+		}
+
+		var val object.Object
+		if operator != "" {
+			current := evalIdentifier(target, env)
+			if isAbrupt(current) {
+				return current
+			}
+
+			right := Eval(node.Value, env)
+			if isAbrupt(right) {
+				return right
+			}
+			val = evalInfixExpression(operator, current, right)
+		} else {
+			val = Eval(node.Value, env)
+		}
+		if isAbrupt(val) {
+			return val
+		}
+
+		if !env.Assign(target.Value, val) {
+			return newError(object.NAME_ERROR, "cannot assign to undefined variable: %s", target.Value)
+		}
+		return val
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env)
+		if isAbrupt(left) {
+			return left
+		}
+
+		index := Eval(target.Index, env)
+		if isAbrupt(index) {
+			return index
+		}
+
+		var val object.Object
+		if operator != "" {
+			current := evalIndexExpression(left, index)
+			if isAbrupt(current) {
+				return current
+			}
+
+			right := Eval(node.Value, env)
+			if isAbrupt(right) {
+				return right
+			}
+			val = evalInfixExpression(operator, current, right)
+		} else {
+			val = Eval(node.Value, env)
+		}
+		if isAbrupt(val) {
+			return val
+		}
+
+		return assignIndex(left, index, val)
+	default:
+		return newError(object.TYPE_ERROR, "cannot assign to %s", node.Target.String())
+	}
+}
+
+// 配列の要素やハッシュの値をその場で書き換え、代入した値を返す
+func assignIndex(left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		if index.Type() != object.INTEGER_OBJ {
+			return newError(object.TYPE_ERROR, "array index must be INTEGER. got = %s", index.Type())
+		}
+		// int64 に収まらない添字 (BigInteger) も範囲外
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return newError(object.INDEX_ERROR, "index out of range: %s (length %d)", index.Inspect(), len(left.Elements))
+		}
+		indexValue, ok := elementIndex(i.Value, len(left.Elements))
+		if !ok {
+			return newError(object.INDEX_ERROR, "index out of range: %s (length %d)", index.Inspect(), len(left.Elements))
+		}
+
+		left.Elements[indexValue] = val
+		return val
+	case *object.Hash:
+		key, ok := object.HashKeyOf(index)
+		if !ok {
+			return newError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
+		}
+
+		left.Set(key, object.HashPair{Key: index, Value: val})
+		return val
+	default:
+		return newError(object.TYPE_ERROR, "index assignment is not supported: %s", left.Type())
+	}
+}
+
 func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
 	condition := Eval(ie.Condition, env)
-	if isError(condition) {
+	if isAbrupt(condition) {
 		return condition
 	}
 
@@ -342,30 +775,219 @@ func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Obje
 	}
 }
 
+// ループは let と同じく値を持たない
+func evalWhileStatement(ws *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(ws.Condition, env)
+		if isAbrupt(condition) {
+			return condition
+		}
+
+		if !isTruthy(condition) {
+			return nil
+		}
+
+		if result, done := evalLoopBody(ws.Body, env); done {
+			return result
+		}
+	}
+}
+
+func evalForStatement(fs *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := Eval(fs.Iterable, env)
+	if isAbrupt(iterable) {
+		return iterable
+	}
+
+	items, err := loopItems(iterable, len(fs.Variables) == 2)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		// ループ変数は let と同じく現在のスコープに束縛する
+		if len(fs.Variables) == 2 {
+			env.Set(fs.Variables[0].Value, item.Key)
+			env.Set(fs.Variables[1].Value, item.Value)
+		} else {
+			env.Set(fs.Variables[0].Value, item.Value)
+		}
+
+		if result, done := evalLoopBody(fs.Body, env); done {
+			return result
+		}
+	}
+
+	return nil
+}
+
+// ループ本体を一回評価する。ループを抜ける場合は done が true になる
+func evalLoopBody(body *ast.BlockStatement, env *object.Environment) (object.Object, bool) {
+	switch result := Eval(body, env).(type) {
+	case *object.Break:
+		return nil, true
+	case *object.ReturnValue, *object.Error:
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
+// for-in で取り出すひとつ分の値
+type LoopItem struct {
+	Key   object.Object // 配列・文字列ならインデックス、ハッシュならキー
+	Value object.Object
+}
+
+// for-in で辿る値の一覧を返す
+// withKey が false なら Value だけを埋める (配列は要素、文字列は文字、ハッシュはキー)
+func loopItems(iterable object.Object, withKey bool) ([]LoopItem, *object.Error) {
+	var items []LoopItem
+
+	switch iterable := iterable.(type) {
+	case *object.Array:
+		for i, el := range iterable.Elements {
+			items = append(items, LoopItem{Key: &object.Integer{Value: int64(i)}, Value: el})
+		}
+	case *object.String:
+		i := 0
+		for _, r := range iterable.Value {
+			items = append(items, LoopItem{Key: &object.Integer{Value: int64(i)}, Value: &object.String{Value: string(r)}})
+			i += 1
+		}
+	case *object.Hash:
+		// キーを追加した順に辿る
+		for _, pair := range iterable.OrderedPairs() {
+			if withKey {
+				items = append(items, LoopItem{Key: pair.Key, Value: pair.Value})
+			} else {
+				items = append(items, LoopItem{Value: pair.Key})
+			}
+		}
+	default:
+		return nil, newError(object.TYPE_ERROR, "cannot iterate over %s", iterable.Type())
+	}
+
+	return items, nil
+}
+
+func evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	result := Eval(te.Block, env)
+
+	// return などエラー以外はそのまま外側に伝える
+	// 実行の制限によるエラーは捕まえさせない (catch 節で実行を続けられないようにする)
+	err, ok := result.(*object.Error)
+	if !ok || err.Kind == object.LIMIT_ERROR {
+		return result
+	}
+
+	// catch の変数は let と同じく現在のスコープに束縛する
+	env.Set(te.Parameter.Value, errorValue(err))
+	return Eval(te.Handler, env)
+}
+
+// throw された値をエラーにする
+// 文字列はそのままメッセージに、catch で受け取った値 (message を持つハッシュ) は
+// 元の種類のまま投げ直す。kind を渡した場合はその種類にする
+// LimitError は try で捕まえられないので、プログラムからは投げられない
+func thrownError(val object.Object, kind object.Object) *object.Error {
+	errorKind := object.USER_ERROR
+	message := val.Inspect()
+
+	if hash, ok := val.(*object.Hash); ok {
+		if msg, ok := hashString(hash, "message"); ok {
+			message = msg
+			if k, ok := hashString(hash, "kind"); ok {
+				errorKind = object.ErrorKind(k)
+			}
+		}
+	}
+
+	if k, ok := kind.(*object.String); ok {
+		errorKind = object.ErrorKind(k.Value)
+	}
+
+	if errorKind == object.LIMIT_ERROR {
+		return newError(object.ARGUMENT_ERROR, "cannot raise %s from a program", errorKind)
+	}
+	return newError(errorKind, "%s", message)
+}
+
+// catch で受け取るエラーの値 ({"kind": ..., "message": ..., "position": ...})
+func errorValue(err *object.Error) *object.Hash {
+	hash := object.NewHash()
+	set := func(k, v string) {
+		key := &object.String{Value: k}
+		hash.Set(key.HashKey(), object.HashPair{Key: key, Value: &object.String{Value: v}})
+	}
+
+	set("kind", string(err.Kind))
+	set("message", err.Message)
+	if err.Pos.IsValid() {
+		set("position", err.Pos.String())
+	}
+	return hash
+}
+
+func hashString(hash *object.Hash, key string) (string, bool) {
+	pair, ok := hash.Get((&object.String{Value: key}).HashKey())
+	if !ok {
+		return "", false
+	}
+
+	str, ok := pair.Value.(*object.String)
+	if !ok {
+		return "", false
+	}
+	return str.Value, true
+}
+
 func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
 	if val, ok := env.Get(node.Value); ok {
 		return val
 	}
 
-	if builtin, ok := builtins[node.Value]; ok {
+	if builtin, ok := LookupBuiltin(env.Execution(), node.Value); ok {
 		return builtin
 	}
 
-	return newError("Identifier Not Found: " + node.Value)
+	return newError(object.NAME_ERROR, "Identifier Not Found: %s", node.Value)
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// callPos は呼び出し位置 (関数本体でエラーが起きたときのスタックトレースに使う)
+// exec は組み込み関数の処理の量を数える実行 (関数はその関数の環境の実行で数える)
+func applyFunction(fn object.Object, args []object.Object, callPos token.Position, exec *object.Execution) object.Object {
 	switch fn := fn.(type) {
 	case *object.Function:
+		// 評価器と VM で同じく、余分な引数は捨て、足りなければエラーにする
+		if len(args) < len(fn.Parameters) {
+			return newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = %d", len(args), len(fn.Parameters))
+		}
+
+		exec := fn.Env.Execution()
+		if maxDepth := exec.MaxDepth(MaxCallDepth); exec.Depth >= maxDepth {
+			return object.StackOverflowError(maxDepth)
+		}
+
 		extendedEnv := extendFunctionEnv(fn, args)
+		exec.Depth++
 		evaluated := Eval(fn.Body, extendedEnv)
+		exec.Depth--
+		if err, ok := evaluated.(*object.Error); ok {
+			err.AddTrace(fn.Name, callPos)
+			return err
+		}
 
 		// 関数ブロック内の return が外側に波及しないように unwrap する
 		return unwrapReturnValue(evaluated)
 	case *object.Builtin:
-		return fn.Fn(args...)
+		// コールバックで呼ばれた関数のエラーにも、組み込み関数の呼び出し位置を記録する
+		apply := func(callback object.Object, args ...object.Object) object.Object {
+			return applyFunction(callback, args, callPos, exec)
+		}
+		return CallBuiltin(exec, fn, apply, args)
 	default:
-		return newError("Not a function: %s", fn.Type())
+		return newError(object.TYPE_ERROR, "Not a function: %s", fn.Type())
 	}
 }
 
@@ -373,8 +995,8 @@ func applyFunction(fn object.Object, args []object.Object) object.Object {
 // ユーティリティ
 //-------------------------------------
 
-func newError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+func newError(kind object.ErrorKind, format string, a ...interface{}) *object.Error {
+	return &object.Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
 }
 
 func isError(obj object.Object) bool {
@@ -385,6 +1007,40 @@ func isError(obj object.Object) bool {
 	return false
 }
 
+// 値の代わりに返る、評価を打ち切って外側に伝えるもの (エラー・return・break・continue) かどうか
+// 式の途中でこれが返ったら、残りは評価せずにそのまま返す
+func isAbrupt(obj object.Object) bool {
+	if obj == nil {
+		return false
+	}
+
+	switch obj.Type() {
+	case object.ERROR_OBJ, object.RETURN_VALUE_OBJ, object.BREAK_OBJ, object.CONTINUE_OBJ:
+		return true
+	default:
+		return false
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	t := obj.Type()
+	return t == object.INTEGER_OBJ || t == object.FLOAT_OBJ
+}
+
+// 整数または浮動小数点数を float64 にする (isNumber で確認してから呼ぶ)
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.BigInteger:
+		return bigToFloat(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return TRUE
@@ -423,3 +1079,59 @@ func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Enviro
 
 	return env
 }
+
+//-------------------------------------
+// VM と共有する意味論
+//-------------------------------------
+
+// VM が評価器と同じ結果・同じエラーメッセージを返せるように、演算の実装を公開する
+
+func EvalPrefix(operator string, right object.Object) object.Object {
+	return evalPrefixExpression(operator, right)
+}
+
+func EvalInfix(operator string, left, right object.Object) object.Object {
+	return evalInfixExpression(operator, left, right)
+}
+
+func EvalIndex(left, index object.Object) object.Object {
+	return evalIndexExpression(left, index)
+}
+
+func EvalSlice(left, start, end, step object.Object) object.Object {
+	return evalSliceExpression(left, start, end, step)
+}
+
+func AssignIndex(left, index, val object.Object) object.Object {
+	return assignIndex(left, index, val)
+}
+
+func IsTruthy(obj object.Object) bool {
+	return isTruthy(obj)
+}
+
+func LoopItems(iterable object.Object, withKey bool) ([]LoopItem, *object.Error) {
+	return loopItems(iterable, withKey)
+}
+
+func ThrownError(val object.Object) *object.Error {
+	return thrownError(val, nil)
+}
+
+func ErrorValue(err *object.Error) object.Object {
+	return errorValue(err)
+}
+
+//-------------------------------------
+// 埋め込み用
+//-------------------------------------
+
+// Go のプログラムから Monkey の関数 (関数や組み込み関数) を呼び出す
+func ApplyFunction(fn object.Object, args ...object.Object) object.Object {
+	return applyFunction(fn, args, token.Position{}, nil)
+}
+
+// ApplyFunction と同じだが、組み込み関数を直接呼び出したときも処理の量を exec のステップとして数える
+func ApplyFunctionIn(exec *object.Execution, fn object.Object, args ...object.Object) object.Object {
+	return applyFunction(fn, args, token.Position{}, exec)
+}
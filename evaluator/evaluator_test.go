@@ -1,10 +1,15 @@
 package evaluator
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
+	"time"
 )
 
 func testEval(input string) object.Object {
@@ -33,6 +38,22 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+
+	if !ok {
+		t.Errorf("object is not Float Object. got = %T (%+v).", obj, obj)
+		return false
+	}
+
+	if result.Value != expected {
+		t.Errorf("object has wrong value. expected = %g, got = %g", expected, result.Value)
+		return false
+	}
+
+	return true
+}
+
 func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
 	result, ok := obj.(*object.Boolean)
 
@@ -81,6 +102,90 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"5 ** 0", 1},
+		{"12 & 10", 8},
+		{"12 | 10", 14},
+		{"12 ^ 10", 6},
+		{"1 << 4", 16},
+		{"-16 >> 2", -4},
+		{"1 << 64 >> 60", 16},
+		{"~5", -6},
+		{"1 + 2 << 3 & 255", 24},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testIntegerObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestBigIntegers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// int64 を超えると多倍長整数になる
+		{"9223372036854775807 + 1", "9223372036854775808"},
+		{"-9223372036854775807 - 2", "-9223372036854775809"},
+		{"-(-9223372036854775807 - 1)", "9223372036854775808"},
+		{"4294967296 * 4294967296", "18446744073709551616"},
+		{"2 ** 100", "1267650600228229401496703205376"},
+		{"1 << 70", "1180591620717411303424"},
+		{"let f = fn(n) { if (n == 0) { 1 } else { n * f(n - 1) } }; f(25)", "15511210043330985984000000"},
+		{"(-9223372036854775807 - 1) / -1", "9223372036854775808"},
+		// 多倍長整数同士・整数との演算
+		{"2 ** 100 - 2 ** 100 + 1", "1"},
+		{"2 ** 100 / 2 ** 98", "4"},
+		{"-(2 ** 64) % 7", "-2"},
+		{"(2 ** 64) >> 60", "16"},
+		{"-(2 ** 70) >> 100", "-1"},
+		{"~(2 ** 64)", "-18446744073709551617"},
+		{"(2 ** 64 + 5) & 7", "5"},
+		{"1 ** (2 ** 64)", "1"},
+		{"2 ** 64 * 0.5", "9.223372036854776e+18"},
+		// 比較と等価性は表現によらない
+		{"2 ** 64 > 2 ** 63", "true"},
+		{"2 ** 63 > 9223372036854775807", "true"},
+		{"-(2 ** 63) == -9223372036854775807 - 1", "true"},
+		{"2 ** 64 == 2 ** 64", "true"},
+		{"2 ** 64 != 2 ** 64 + 1", "true"},
+		{"2 ** 64 == 2.0 ** 64", "true"},
+		{"{2 ** 64: 1}[2 ** 32 * 2 ** 32]", "1"},
+		{"{2.0 ** 64: 1}[2 ** 64]", "1"},
+		{"{2 ** 63 - 1: 1}[9223372036854775807]", "1"},
+		{"sort([2 ** 64, -(2 ** 64), 1])", "[-18446744073709551616, 1, 18446744073709551616]"},
+		// 変換
+		{`int("123456789012345678901234567890")`, "123456789012345678901234567890"},
+		{"int(1e20)", "100000000000000000000"},
+		{"float(2 ** 64)", "1.8446744073709552e+19"},
+		// int64 の範囲外の添字は範囲外として扱う
+		{"[1][2 ** 64]", "null"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected = %s, got = %s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestBigIntegerDemotion(t *testing.T) {
+	// int64 に収まる結果は Integer に戻る
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"9223372036854775807 + 1 - 1", 9223372036854775807},
+		{"-(2 ** 63)", -1 << 63},
+		{"2 ** 64 / 2 ** 10", 1 << 54},
+		{"2 ** 64 - 2 ** 64", 0},
+		{"(2 ** 64) >> 64", 1},
 	}
 
 	for _, tt := range tests {
@@ -89,6 +194,105 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"2.5", 2.5},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3},
+		{"1 + 0.5", 1.5},
+		{"0.5 + 1", 1.5},
+		{"10 - 2.5", 7.5},
+		{"2 * 1.25", 2.5},
+		{"7 / 2.0", 3.5},
+		{"1.0 / 4", 0.25},
+		{"(1 + 2.0) * 3", 9},
+		{"float(3) / 2", 1.5},
+		{"7.5 % 2", 1.5},
+		{"2 ** -1", 0.5},
+		{"4 ** 0.5", 2},
+		{`float("2.25")`, 2.25},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestFloatComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1.5 < 2", true},
+		{"2 < 1.5", false},
+		{"2.5 > 2.4", true},
+		{"1 == 1.0", true},
+		{"1.0 != 1", false},
+		{"0.1 + 0.2 == 0.3", false},
+		{"!0.0", false},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"2.5", "2.5"},
+		{"2.0", "2.0"},
+		{"1.0 / 3", "0.3333333333333333"},
+		{"1e21", "1e+21"},
+		{"1.0 / 0", "+Inf"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong inspect for %q. expected = %q, got = %q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestFloatHashKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`{1.5: "a"}[1.5]`, "a"},
+		{`{1: "a"}[1.0]`, "a"},
+		{`{2.0: "a"}[2]`, "a"},
+		{`{0.5: "a"}[0.25 * 2]`, "a"},
+		{`{1.5: "a"}[1]`, nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if expected, ok := tt.expected.(string); ok {
+			str, ok := evaluated.(*object.String)
+			if !ok || str.Value != expected {
+				t.Errorf("wrong value for %q. expected = %q, got = %s", tt.input, expected, evaluated.Inspect())
+			}
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+
+	// 1 と 1.0 は同じキーになる
+	hash, ok := testEval(`{1: "a", 1.0: "b"}`).(*object.Hash)
+	if !ok || len(hash.Pairs) != 1 {
+		t.Errorf("1 and 1.0 should be the same hash key. got = %+v", hash)
+	}
+}
+
 func TestStringLiteral(t *testing.T) {
 	input := `"Hello World!"`
 
@@ -104,6 +308,270 @@ func TestStringLiteral(t *testing.T) {
 	}
 }
 
+func TestStringEscapesAndUnicode(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"say \"hi\""`, `say "hi"`},
+		{`"a\tb"`, "a\tb"},
+		{`len("日本")`, 2},
+		{`len("\u{1F600}")`, 1},
+		{`"日本語"[1]`, "本"},
+		{`"abc"[0]`, "a"},
+		{`"abc"[3]`, nil},
+		{`"abc"[-1]`, "c"},
+		{`"日本語"[-3]`, "日"},
+		{`"abc"[-4]`, nil},
+		{`let 名前 = "モンキー"; 名前`, "モンキー"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. got = %T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong value for %s. expected = %q, got = %q", tt.input, expected, str.Value)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestStringBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`split("a,b,c", ",")`, []string{"a", "b", "c"}},
+		{`split("  a  b ")`, []string{"a", "b"}},
+		{`split("日本", "")`, []string{"日", "本"}},
+		{`join(["a", "b", "c"], "-")`, "a-b-c"},
+		{`join([], "-")`, ""},
+		{`trim("  hi \n")`, "hi"},
+		{`trim("xxhixx", "x")`, "hi"},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`contains("monkey", "key")`, true},
+		{`contains("monkey", "dog")`, false},
+		{`starts_with("monkey", "mon")`, true},
+		{`ends_with("monkey", "mon")`, false},
+		{`upper("Monkey")`, "MONKEY"},
+		{`lower("Monkey")`, "monkey"},
+		{`substr("日本語です", 1, 3)`, "本語"},
+		{`substr("monkey", 3)`, "key"},
+		{`substr("monkey", -3)`, "key"},
+		{`substr("monkey", 4, 100)`, "ey"},
+		{`substr("monkey", 4, 2)`, ""},
+		{`repeat("ab", 3)`, "ababab"},
+		{`index_of("日本語", "語")`, 2},
+		{`index_of("monkey", "z")`, -1},
+		{`format("{} + {} = {}", 1, 2, 3)`, "1 + 2 = 3"},
+		{`format("name: {}, tags: {}", "monkey", ["a"])`, "name: monkey, tags: [a]"},
+		{`format("{{}} {}", true)`, "{} true"},
+		// エラー
+		{`split(1, ",")`, errorMessage("argument 1 to `split` must be STRING. got = INTEGER")},
+		{`split("a", ",", "b")`, errorMessage("wrong number of arguments. got = 3, want = 1 or 2")},
+		{`join(["a", 1], "")`, errorMessage("elements of array passed to `join` must be STRING. got = INTEGER")},
+		{`replace("a", "b")`, errorMessage("wrong number of arguments. got = 2, want = 3")},
+		{`upper(1)`, errorMessage("argument to `upper` must be STRING. got = INTEGER")},
+		{`substr("abc")`, errorMessage("wrong number of arguments. got = 1, want = 2 or 3")},
+		{`substr("abc", "1")`, errorMessage("argument 2 to `substr` must be INTEGER. got = STRING")},
+		{`repeat("a", -1)`, errorMessage("count passed to `repeat` must not be negative. got = -1")},
+		{`repeat("a", 9223372036854775807)`, errorMessage("result of `repeat` is too large. exceeds 1073741824 bytes")},
+		{`repeat("ab", 4611686018427387904)`, errorMessage("result of `repeat` is too large. exceeds 1073741824 bytes")},
+		{`repeat("", 9223372036854775807)`, ""},
+		// 大きな文字列を作る前に上限と比べる (同じ 1 MiB の文字列を何度も使う)
+		{`let s = repeat("x", 1 << 20); join(map(range(1025), fn(i) { s }), "")`, errorMessage("result of `join` is too large. exceeds 1073741824 bytes")},
+		{`replace(repeat("x", 1 << 20), "x", repeat("y", 1025))`, errorMessage("result of `replace` is too large. exceeds 1073741824 bytes")},
+		{`replace(repeat("x", 1 << 20), "", repeat("y", 1024))`, errorMessage("result of `replace` is too large. exceeds 1073741824 bytes")},
+		{`let s = repeat("x", 1 << 20); format("{}"` + strings.Repeat(", s", 1025) + `)`, errorMessage("result of `format` is too large. exceeds 1073741824 bytes")},
+		{`format()`, errorMessage("wrong number of arguments. got = 0, want = at least 1")},
+		{`format("{} {}", 1)`, errorMessage("format string has 2 placeholders but got 1 values")},
+		{`format("{", 1)`, errorMessage("unmatched \"{\" in format string")},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("%s: object is not String. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong value for %s. expected = %q, got = %q", tt.input, expected, str.Value)
+			}
+		case []string:
+			arr, ok := evaluated.(*object.Array)
+			if !ok {
+				t.Errorf("%s: object is not Array. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if len(arr.Elements) != len(expected) {
+				t.Errorf("wrong number of elements for %s. expected = %d, got = %d", tt.input, len(expected), len(arr.Elements))
+				continue
+			}
+			for i, want := range expected {
+				if arr.Elements[i].Inspect() != want {
+					t.Errorf("wrong element %d for %s. expected = %q, got = %q", i, tt.input, want, arr.Elements[i].Inspect())
+				}
+			}
+		case errorMessage:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%s: object is not Error. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != string(expected) {
+				t.Errorf("wrong error message for %s. expected = %q, got = %q", tt.input, expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestArrayBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`map([1, 2, 3], fn(x) { x * x })`, "[1, 4, 9]"},
+		{`map([], fn(x) { x })`, "[]"},
+		{`map(["a", "bc"], len)`, "[1, 2]"},
+		{`filter([1, 2, 3, 4], fn(x) { x > 2 })`, "[3, 4]"},
+		{`reduce([1, 2, 3], 10, fn(acc, x) { acc + x })`, 16},
+		{`reduce([1, 2, 3], fn(acc, x) { acc * x })`, 6},
+		{`sort([3, 1.5, 2])`, "[1.5, 2, 3]"},
+		{`sort(["b", "c", "a"])`, "[a, b, c]"},
+		{`sort([[2, "a"], [1, "b"], [2, "c"]], fn(a, b) { a[0] - b[0] })`, "[[1, b], [2, a], [2, c]]"},
+		{`let xs = [2, 1]; sort(xs); xs`, "[2, 1]"},
+		{`reverse([1, 2, 3])`, "[3, 2, 1]"},
+		{`reverse("日本語")`, "語本日"},
+		{`range(4)`, "[0, 1, 2, 3]"},
+		{`range(2, 5)`, "[2, 3, 4]"},
+		{`range(5, 0, -2)`, "[5, 3, 1]"},
+		{`range(9223372036854775805, 9223372036854775807, 5)`, "[9223372036854775805]"},
+		{`zip([1, 2, 3], ["a", "b"])`, "[[1, a], [2, b]]"},
+		{`any([1, 2, 3], fn(x) { x > 2 })`, true},
+		{`any([], fn(x) { true })`, false},
+		{`all([1, 2, 3], fn(x) { x > 0 })`, true},
+		{`all([1, 2, 3], fn(x) { x > 1 })`, false},
+		// 結果が決まったら残りの要素には f を呼ばない
+		{`any([1, 2, true], fn(x) { x + 1 > 1 })`, true},
+		{`concat([1], [], [2, 3])`, "[1, 2, 3]"},
+		// エラー
+		{`map(1, fn(x) { x })`, errorMessage("argument 1 to `map` must be ARRAY. got = INTEGER")},
+		{`map([1])`, errorMessage("wrong number of arguments. got = 1, want = 2")},
+		{`map([1], 1)`, errorMessage("Not a function: INTEGER")},
+		{`filter([1], fn(x) { x + true })`, errorMessage("Type Mismatch: INTEGER + BOOLEAN")},
+		{`reduce([], fn(acc, x) { acc })`, errorMessage("reduce of empty array with no initial value")},
+		{`sort([1, "a"])`, errorMessage("cannot compare STRING and INTEGER")},
+		{`sort([1, 2], fn(a, b) { true })`, errorMessage("comparator passed to `sort` must return INTEGER. got = BOOLEAN")},
+		{`reverse(1)`, errorMessage("argument to `reverse` is not supported. got = INTEGER")},
+		{`range(1, 5, 0)`, errorMessage("step passed to `range` must not be 0")},
+		{`range(0, 1 << 40)`, errorMessage("result of `range` is too large. exceeds 16777216 elements")},
+		{`range(9223372036854775807, -9223372036854775807 - 1, -1)`, errorMessage("result of `range` is too large. exceeds 16777216 elements")},
+		{`zip([1])`, errorMessage("wrong number of arguments. got = 1, want = at least 2")},
+		{`zip([1], 2)`, errorMessage("argument 2 to `zip` must be ARRAY. got = INTEGER")},
+		{`concat([1], "a")`, errorMessage("argument 2 to `concat` must be ARRAY. got = STRING")},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			if evaluated.Inspect() != expected {
+				t.Errorf("wrong value for %s. expected = %q, got = %q", tt.input, expected, evaluated.Inspect())
+			}
+		case errorMessage:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%s: object is not Error. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != string(expected) {
+				t.Errorf("wrong error message for %s. expected = %q, got = %q", tt.input, expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestHashBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`keys({"b": 1, "a": 2, 3: 3})`, "[b, a, 3]"},
+		{`values({"b": 1, "a": 2})`, "[1, 2]"},
+		{`entries({"b": 1, "a": 2})`, "[[b, 1], [a, 2]]"},
+		{`keys({})`, "[]"},
+		{`has({"a": 1}, "a")`, true},
+		{`has({"a": 1}, "b")`, false},
+		{`has({1: 1}, 1.0)`, true},
+		{`delete({"a": 1, "b": 2, "c": 3}, "b")`, "{a: 1, c: 3}"},
+		{`delete({"a": 1}, "z")`, "{a: 1}"},
+		{`let h = {"a": 1}; delete(h, "a"); h`, "{a: 1}"},
+		{`merge({"a": 1, "b": 2}, {"c": 3, "a": 4})`, "{a: 4, b: 2, c: 3}"},
+		{`merge({"a": 1})`, "{a: 1}"},
+		{`len({"a": 1, "b": 2})`, 2},
+		// 上書きしても位置は変わらず、新しいキーは末尾に付く
+		{`let h = {"b": 1, "a": 2}; h["b"] = 3; h["c"] = 4; h`, "{b: 3, a: 2, c: 4}"},
+		{`let h = delete({"a": 1, "b": 2}, "a"); h["a"] = 3; keys(h)`, "[b, a]"},
+		// エラー
+		{`keys([1])`, errorMessage("argument to `keys` must be HASH. got = ARRAY")},
+		{`has({}, [len])`, errorMessage("unusable as hash key: ARRAY")},
+		{`delete({}, fn() {})`, errorMessage("unusable as hash key: FUNCTION")},
+		{`merge()`, errorMessage("wrong number of arguments. got = 0, want = at least 1")},
+		{`merge({}, 1)`, errorMessage("argument 2 to `merge` must be HASH. got = INTEGER")},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			if evaluated.Inspect() != expected {
+				t.Errorf("wrong value for %s. expected = %q, got = %q", tt.input, expected, evaluated.Inspect())
+			}
+		case errorMessage:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%s: object is not Error. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != string(expected) {
+				t.Errorf("wrong error message for %s. expected = %q, got = %q", tt.input, expected, errObj.Message)
+			}
+		}
+	}
+}
+
+// テーブルの期待値で、文字列の値とエラーメッセージを区別するための型
+type errorMessage string
+
 func TestStringConcatenation(t *testing.T) {
 	input := `"Hello" + " " + "World!"`
 
@@ -134,6 +602,13 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"1 != 1", false},
 		{"1 == 2", false},
 		{"1 != 2", true},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"2.5 >= 2", true},
+		{"2 <= 1.5", false},
 		{"true == true", true},
 		{"false == false", true},
 		{"true == false", false},
@@ -151,6 +626,74 @@ func TestEvalBooleanExpression(t *testing.T) {
 	}
 }
 
+func TestStructuralEquality(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"[1, 2] == [1, 2]", true},
+		{"[1, 2] != [1, 2]", false},
+		{"[1, 2] == [2, 1]", false},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[] == []", true},
+		{`[1, "a", [true, [2.0]]] == [1, "a", [true, [2]]]`, true},
+		{`{"a": 1, "b": [2]} == {"a": 1, "b": [2]}`, true},
+		// ハッシュはキーの順序によらない
+		{`{"a": 1, "b": 2} == {"b": 2, "a": 1}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} == {"b": 1}`, false},
+		{`{"a": 1} == {"a": 1, "b": 2}`, false},
+		{"{} == {}", true},
+		{"[1] == {}", false},
+		{"[1] == 1", false},
+		{"if (false) { 1 } == if (false) { 2 }", true},
+		{"[if (false) { 1 }] == [if (false) { 2 }]", true},
+		{"if (false) { 1 } == false", false},
+		// 関数は同じ関数のときだけ等しい
+		{"let f = fn() { 1 }; [f] == [f]", true},
+		{"[fn() { 1 }] == [fn() { 1 }]", false},
+		// 自分自身を含む配列
+		{"let a = [1, 0]; a[1] = a; let b = [1, 0]; b[1] = b; a == b", true},
+		{"let a = [1, 0]; a[1] = a; a == a", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestArrayHashKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`{[1, 2]: "a"}[[1, 2]]`, "a"},
+		{`{[1, 2]: "a"}[[2, 1]]`, nil},
+		{`{[1, [2, "x"]]: 3}[[1.0, [2, "x"]]]`, 3},
+		{`let h = {}; h[[0, 0]] = 1; h[[0, 0]] += 1; h[[0, 0]]`, 2},
+		{`len({[1]: 1, [1]: 2, [[1]]: 3})`, 2},
+		{`has({[]: true}, [])`, true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok || str.Value != expected {
+				t.Errorf("%s: expected = %q, got = %s", tt.input, expected, evaluated.Inspect())
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
 func TestBangOperator(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -170,6 +713,39 @@ func TestBangOperator(t *testing.T) {
 	}
 }
 
+func TestLogicalExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		// 結果を決めたオペランドの値を返す
+		{"1 && 2", 2},
+		{"0 || 3", 0},
+		{"if (false) { 1 } || 4", 4},
+		// 右辺は必要なときだけ評価する
+		{"false && undefined", false},
+		{"true || 1 / 0", true},
+		{"let x = 0; false && (x = 1); true || (x = 2); x", 0},
+		// || は && より、&& は == より優先順位が低い
+		{"1 == 1 && 2 < 1 || true", true},
+		{"true || false && false", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		}
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3 + 3]"
 
@@ -232,6 +808,14 @@ func TestArrayIndexExpressions(t *testing.T) {
 		},
 		{
 			"[1, 2, 3][-1]",
+			3,
+		},
+		{
+			"[1, 2, 3][-3]",
+			1,
+		},
+		{
+			"[1, 2, 3][-4]",
 			nil,
 		},
 	}
@@ -247,6 +831,55 @@ func TestArrayIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3, 4, 5][1:3]", "[2, 3]"},
+		{"[1, 2, 3, 4, 5][:2]", "[1, 2]"},
+		{"[1, 2, 3, 4, 5][3:]", "[4, 5]"},
+		{"[1, 2, 3, 4, 5][:]", "[1, 2, 3, 4, 5]"},
+		{"[1, 2, 3, 4, 5][::2]", "[1, 3, 5]"},
+		{"[1, 2, 3, 4, 5][1::2]", "[2, 4]"},
+		// 負の位置は末尾から数える
+		{"[1, 2, 3, 4, 5][-2:]", "[4, 5]"},
+		{"[1, 2, 3, 4, 5][:-1]", "[1, 2, 3, 4]"},
+		{"[1, 2, 3, 4, 5][-4:-2]", "[2, 3]"},
+		// 負の step は逆向きに取り出す
+		{"[1, 2, 3, 4, 5][::-1]", "[5, 4, 3, 2, 1]"},
+		{"[1, 2, 3, 4, 5][3:0:-1]", "[4, 3, 2]"},
+		{"[1, 2, 3, 4, 5][:1:-2]", "[5, 3]"},
+		{"[1, 2, 3, 4, 5][-1:-4:-1]", "[5, 4, 3]"},
+		// 範囲外の位置は端に切り詰める
+		{"[1, 2, 3][1:100]", "[2, 3]"},
+		{"[1, 2, 3][-100:1]", "[1]"},
+		{"[1, 2, 3][2:1]", "[]"},
+		{"[1, 2, 3][5:]", "[]"},
+		{"[1, 2, 3][100:-100:-1]", "[3, 2, 1]"},
+		{"[1, 2, 3][-(2 ** 64):2 ** 64]", "[1, 2, 3]"},
+		{"[1, 2, 3][::2 ** 64]", "[1]"},
+		{"[1, 2, 3][::-9223372036854775807 - 1]", "[3]"},
+		{"[][::-1]", "[]"},
+		// null は位置を省略したのと同じ
+		{"[1, 2, 3][if (false) { 1 }:2]", "[1, 2]"},
+		// 文字列は文字 (rune) 単位で切り出す
+		{`"hello"[1:4]`, "ell"},
+		{`"hello"[::-1]`, "olleh"},
+		{`"日本語テキスト"[-4:]`, "テキスト"},
+		{`"abc"[5:]`, ""},
+		// 元の配列は変わらない
+		{"let a = [1, 2, 3]; let b = a[:]; b[0] = 9; a", "[1, 2, 3]"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected = %q, got = %q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `let two = "two";
 	{
@@ -434,6 +1067,87 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		// 以前は Go の panic でプロセスごと落ちていたもの
+		{
+			"1 / 0",
+			"division by zero",
+		},
+		{
+			"1 % 0",
+			"modulo by zero",
+		},
+		{
+			"1.5 % 0.0",
+			"modulo by zero",
+		},
+		{
+			"[1, 2][::0]",
+			"slice step cannot be zero",
+		},
+		{
+			`[1, 2]["a":]`,
+			"slice index must be INTEGER. got = STRING",
+		},
+		{
+			`{"a": 1}[0:1]`,
+			"slice operator is not supported: HASH",
+		},
+		{
+			"2 ** 64 % 0",
+			"modulo by zero",
+		},
+		{
+			"2 ** 2 ** 30",
+			"integer overflow. result exceeds 1048576 bits",
+		},
+		{
+			"1 << (2 ** 64)",
+			"integer overflow. result exceeds 1048576 bits",
+		},
+		{
+			"let a = [1]; a[2 ** 64] = 2",
+			"index out of range: 18446744073709551616 (length 1)",
+		},
+		{
+			`repeat("a", 2 ** 64)`,
+			"argument 2 to `repeat` is too large. got = 18446744073709551616",
+		},
+		{
+			"1 << -1",
+			"negative shift count: -1",
+		},
+		{
+			"~1.5",
+			"Unknown Operator: ~FLOAT",
+		},
+		{
+			"1.5 & 1",
+			"Unknown Operator: FLOAT & INTEGER",
+		},
+		{
+			`"a" <= "b"`,
+			"Unknown Operator: STRING <= STRING",
+		},
+		{
+			"let add = fn(a, b) { a + b }; add(1)",
+			"wrong number of arguments. got = 1, want = 2",
+		},
+		{
+			"quote()",
+			"wrong number of arguments to `quote`. got = 0, want = 1",
+		},
+		{
+			"quote(1, 2)",
+			"wrong number of arguments to `quote`. got = 2, want = 1",
+		},
+		{
+			`[1, 2, 3]["1"]`,
+			"array index must be INTEGER. got = STRING",
+		},
+		{
+			`"abc"[[0]]`,
+			"string index must be INTEGER. got = ARRAY",
+		},
 	}
 
 	for _, tt := range tests {
@@ -451,6 +1165,315 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestErrorPosition(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedPosition string
+		expectedInspect  string
+	}{
+		{
+			"5 + true;",
+			"1:3",
+			"ERROR: 1:3: Type Mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			`let f = fn(x) {
+				x + y;
+			};
+			f(1);`,
+			"2:9",
+			"ERROR: 2:9: Identifier Not Found: y",
+		},
+		{
+			`let a = 1;
+			len(a);`,
+			"2:7",
+			"ERROR: 2:7: argument to `len` is not supported. got = INTEGER",
+		},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got = %T(%+v)", evaluated, evaluated)
+			continue
+		}
+
+		if errObj.Pos.String() != tt.expectedPosition {
+			t.Errorf("Wrong error position. expected = %q, got = %q.", tt.expectedPosition, errObj.Pos.String())
+		}
+
+		if errObj.Inspect() != tt.expectedInspect {
+			t.Errorf("Wrong error inspect. expected = %q, got = %q.", tt.expectedInspect, errObj.Inspect())
+		}
+	}
+}
+
+func TestErrorStackTrace(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedKind object.ErrorKind
+		expected     string
+	}{
+		{
+			"5 + true;",
+			object.TYPE_ERROR,
+			"ERROR: TypeError: Type Mismatch: INTEGER + BOOLEAN\n" +
+				"    at <main> (1:3)",
+		},
+		{
+			`let inner = fn(x) { x + y };
+			let outer = fn(x) { inner(x) };
+			outer(1);`,
+			object.NAME_ERROR,
+			"ERROR: NameError: Identifier Not Found: y\n" +
+				"    at inner (1:25)\n" +
+				"    at outer (2:29)\n" +
+				"    at <main> (3:9)",
+		},
+		{
+			`fn(x) { len(x) }(1);`,
+			object.TYPE_ERROR,
+			"ERROR: TypeError: argument to `len` is not supported. got = INTEGER\n" +
+				"    at <anonymous> (1:12)\n" +
+				"    at <main> (1:17)",
+		},
+		{
+			`len(1, 2);`,
+			object.ARGUMENT_ERROR,
+			"ERROR: ArgumentError: wrong number of arguments. got = 2, want = 1\n" +
+				"    at <main> (1:4)",
+		},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got = %T(%+v)", evaluated, evaluated)
+			continue
+		}
+
+		if errObj.Kind != tt.expectedKind {
+			t.Errorf("Wrong error kind. expected = %q, got = %q.", tt.expectedKind, errObj.Kind)
+		}
+
+		if errObj.StackTrace() != tt.expected {
+			t.Errorf("Wrong stack trace.\nexpected = %q\ngot      = %q", tt.expected, errObj.StackTrace())
+		}
+	}
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let i = 0; let sum = 0; while (i < 5) { let sum = sum + i; let i = i + 1; }; sum`, 10},
+		{`let i = 0; while (true) { let i = i + 1; if (i == 3) { break; } }; i`, 3},
+		{`let sum = 0; for (x in [1, 2, 3, 4]) { if (x == 2) { continue; } let sum = sum + x; }; sum`, 8},
+		{`let sum = 0; for (i, x in [10, 20, 30]) { let sum = sum + i * x; }; sum`, 80},
+		{`let s = ""; for (c in "abc") { let s = c + s; }; s`, "cba"},
+		{`let s = ""; for (c in "日本") { let s = s + c + "."; }; s`, "日.本."},
+		{`let s = ""; for (k in {"b": 2, "a": 1}) { let s = s + k; }; s`, "ba"},
+		{`let sum = 0; for (k, v in {"a": 1, "b": 2}) { let sum = sum + v; }; sum`, 3},
+		{`let s = ""; for (k, v in {"a": 1, "b": 2}) { let s = s + k; }; s`, "ab"},
+		{`for (x in []) { x }; 1`, 1},
+		// return はループと関数を抜ける
+		{`let find = fn(xs, y) { for (i, x in xs) { if (x == y) { return i; } } -1 }; find([5, 6, 7], 7)`, 2},
+		{`let find = fn(xs, y) { for (i, x in xs) { if (x == y) { return i; } } -1 }; find([5, 6, 7], 8)`, -1},
+		// break は一番内側のループだけを抜ける
+		{`let n = 0; for (x in [1, 2, 3]) { for (y in [1, 2, 3]) { if (y == 2) { break; } let n = n + 1; } }; n`, 3},
+		{`let n = 0; for (x in [1, 2]) { try { if (x == 1) { break; } } catch (e) { 0 } let n = n + 1; }; n`, 0},
+		// 式の途中の break・continue・return も、残りを評価せずに抜ける
+		{`let r = 0; while (true) { let x = if (true) { break; }; r = r + 1; if (r > 3) { break; } }; r`, 0},
+		{`let r = 0; for (x in [1, 2, 3]) { r = r + if (x == 2) { continue; } else { x }; }; r`, 4},
+		{`let r = []; for (x in [1, 2, 3]) { let r = push(r, if (x == 2) { break; } else { x }); }; len(r)`, 1},
+		{`fn() { let x = if (true) { return 5; }; 10 }()`, 5},
+		{`fn() { [1, if (true) { return 7; }, 3]; 10 }()`, 7},
+		{`for (x in 5) { x }`, "cannot iterate over INTEGER"},
+		{`while (1 + true) { 1 }`, "Type Mismatch: INTEGER + BOOLEAN"},
+		{`for (x in [1]) { x + true }`, "Type Mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errObj, ok := evaluated.(*object.Error); ok {
+				if errObj.Message != expected {
+					t.Errorf("wrong error message for %q. expected = %q, got = %q", tt.input, expected, errObj.Message)
+				}
+				continue
+			}
+
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. got = %T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong value for %q. expected = %q, got = %q", tt.input, expected, str.Value)
+			}
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let x = 1; x = 2; x`, 2},
+		{`let x = 1; x = x + 41`, 42},
+		{`let x = 10; x += 5; x`, 15},
+		{`let x = 10; x -= 5; x`, 5},
+		{`let x = 10; x *= 5; x`, 50},
+		{`let x = 10; x /= 5; x`, 2},
+		{`let s = "a"; s += "b"; s`, "ab"},
+		{`let a = 1; let b = 2; a = b = 3; a + b`, 6},
+		// 最も近い外側の束縛を書き換える
+		{`let x = 1; let f = fn() { x = 2; }; f(); x`, 2},
+		{`let x = 1; let f = fn() { let x = 5; x = 2; }; f(); x`, 1},
+		{`let counter = fn() { let c = 0; fn() { c += 1; c } }; let next = counter(); next(); next(); next()`, 3},
+		{`let i = 0; let sum = 0; while (i < 5) { sum += i; i += 1; }; sum`, 10},
+		// 添字への代入
+		{`let a = [1, 2, 3]; a[1] = 20; a[1]`, 20},
+		{`let a = [1, 2, 3]; a[2] *= 10; a[2]`, 30},
+		{`let a = [1, 2, 3]; let b = a; b[0] = 9; a[0]`, 9},
+		{`let h = {"a": 1}; h["a"] += 1; h["a"]`, 2},
+		{`let h = {}; h["b"] = 3; h["b"]`, 3},
+		{`let a = [[1], [2]]; a[1][0] = 5; a[1][0]`, 5},
+		// エラー
+		{`y = 1`, "cannot assign to undefined variable: y"},
+		{`fn() { let y = 1; }(); y = 1`, "cannot assign to undefined variable: y"},
+		{`y += 1`, "Identifier Not Found: y"},
+		{`len = 1`, "cannot assign to builtin function len"},
+		{`let a = [1]; a[1] = 2`, "index out of range: 1 (length 1)"},
+		{`let a = [1]; a["x"] = 2`, "array index must be INTEGER. got = STRING"},
+		{`let h = {}; h[[1, [len]]] = 2`, "unusable as hash key: ARRAY"},
+		{`let s = "abc"; s[0] = "x"`, "index assignment is not supported: STRING"},
+		{`let x = 1; x += true`, "Type Mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errObj, ok := evaluated.(*object.Error); ok {
+				if errObj.Message != expected {
+					t.Errorf("wrong error message for %q. expected = %q, got = %q", tt.input, expected, errObj.Message)
+				}
+				continue
+			}
+
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. got = %T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong value for %q. expected = %q, got = %q", tt.input, expected, str.Value)
+			}
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`try { 1 } catch (e) { 2 }`, 1},
+		{`try { 1 + true; 1 } catch (e) { 2 }`, 2},
+		{`try { throw "oops"; 1 } catch (e) { e["message"] }`, "oops"},
+		{`try { throw "oops" } catch (e) { e["kind"] }`, "Error"},
+		{`try { 1 + true } catch (e) { e["kind"] }`, "TypeError"},
+		{`try { 1 + true } catch (e) { e["message"] }`, "Type Mismatch: INTEGER + BOOLEAN"},
+		{`try { foo } catch (e) { e["position"] }`, "1:7"},
+		{`try { error("bad input") } catch (e) { e["message"] }`, "bad input"},
+		{`try { error("bad input", "ValueError") } catch (e) { e["kind"] }`, "ValueError"},
+		{`try { error("x", "LimitError") } catch (e) { e["kind"] }`, "ArgumentError"},
+		{`try { throw {"message": "x", "kind": "LimitError"} } catch (e) { e["message"] }`, "cannot raise LimitError from a program"},
+		{`try { throw 42 } catch (e) { e["message"] }`, "42"},
+		// 関数の中で投げられたエラーも呼び出し側で捕まえられる
+		{`let f = fn(x) { if (x < 0) { throw "negative" } x }; try { f(-1) } catch (e) { e["message"] }`, "negative"},
+		{`let f = fn() { try { 1 + true } catch (e) { 10 } }; f() + 1`, 11},
+		// return は catch されない
+		{`let f = fn() { try { return 1; } catch (e) { 2 }; 3 }; f()`, 1},
+		// catch の中で投げ直すと外側で捕まる
+		{`try { try { throw "inner" } catch (e) { throw e } } catch (e) { e["message"] }`, "inner"},
+		{`try { try { 1 + true } catch (e) { throw e } } catch (e) { e["kind"] }`, "TypeError"},
+		{`let e = 1; try { throw "x" } catch (e) { 0 }; e["message"]`, "x"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. got = %T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong value for %q. expected = %q, got = %q", tt.input, expected, str.Value)
+			}
+		}
+	}
+}
+
+func TestUncaughtThrow(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`throw "oops";`,
+			"ERROR: Error: oops\n    at <main> (1:1)",
+		},
+		{
+			`let check = fn(x) { error("bad: " + x, "ValueError") };
+			check("a");`,
+			"ERROR: ValueError: bad: a\n    at check (1:26)\n    at <main> (2:9)",
+		},
+		{
+			`try { throw "inner" } catch (e) { throw "outer: " + e["message"] }`,
+			"ERROR: Error: outer: inner\n    at <main> (1:35)",
+		},
+		{
+			`error(1, 2)`,
+			"ERROR: TypeError: kind passed to `error` must be STRING. got = INTEGER\n    at <main> (1:6)",
+		},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned for %q. got = %T(%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+
+		if errObj.StackTrace() != tt.expected {
+			t.Errorf("Wrong stack trace.\nexpected = %q\ngot      = %q", tt.expected, errObj.StackTrace())
+		}
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -529,6 +1552,15 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` is not supported. got = INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got = 2, want = 1"},
+		{`int(3)`, 3},
+		{`int(3.9)`, 3},
+		{`int(-3.9)`, -3},
+		{`int("42")`, 42},
+		{`int("4.2")`, "could not parse \"4.2\" as INTEGER"},
+		{`int(1.0 / 0)`, "cannot convert +Inf to INTEGER"},
+		{`int(true)`, "argument to `int` is not supported. got = BOOLEAN"},
+		{`float("abc")`, "could not parse \"abc\" as FLOAT"},
+		{`float([])`, "argument to `float` is not supported. got = ARRAY"},
 	}
 
 	for _, tt := range tests {
@@ -550,3 +1582,153 @@ func TestBuiltinFunctions(t *testing.T) {
 		}
 	}
 }
+
+func TestRecursionDepthLimit(t *testing.T) {
+	// 制限を設定しなくても、Go のスタックを使い果たす前にエラーになる
+	evaluated := testEval("let loop = fn(n) { loop(n + 1) }; loop(0)")
+
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("expected error. got = %T (%+v)", evaluated, evaluated)
+	}
+
+	expected := "stack overflow. call depth exceeds 65536"
+	if errObj.Message != expected {
+		t.Errorf("wrong error message. expected = %q, got = %q", expected, errObj.Message)
+	}
+
+	// 深さはエラーで抜けた後も正しく数え直される
+	evaluated = testEval(`
+	let loop = fn(n) { loop(n + 1) };
+	let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } };
+	try { loop(0) } catch (e) { sum(5000) }
+	`)
+	testIntegerObject(t, evaluated, 12502500)
+}
+
+// テスト用の Host (メモリ上のファイルと固定の時計を使う)
+type testHost struct {
+	out   bytes.Buffer
+	files map[string]string
+}
+
+func (h *testHost) Stdout() io.Writer { return &h.out }
+
+func (h *testHost) ReadFile(name string) ([]byte, error) {
+	data, ok := h.files[name]
+	if !ok {
+		return nil, fmt.Errorf("open %s: file does not exist", name)
+	}
+	return []byte(data), nil
+}
+
+func (h *testHost) WriteFile(name string, data []byte) error {
+	if name == "readonly.txt" {
+		return fmt.Errorf("open %s: permission denied", name)
+	}
+	h.files[name] = string(data)
+	return nil
+}
+
+func (h *testHost) Now() time.Time { return time.UnixMilli(1700000000000) }
+
+func testEvalWithBuiltins(input string, builtins map[string]*object.Builtin) object.Object {
+	p := parser.New(lexer.New(input))
+	env := object.NewEnvironment()
+	env.Execution().Builtins = builtins
+	return Eval(p.ParseProgram(), env)
+}
+
+func TestHostBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+		output   string
+	}{
+		{`puts("a", 1, [2])`, nil, "a\n1\n[2]\n"},
+		{`read_file("config.txt")`, "limit=3", ""},
+		{`write_file("out.txt", "hello"); read_file("out.txt")`, "hello", ""},
+		{`now()`, 1700000000000, ""},
+		{`read_file("missing.txt")`, errorMessage("open missing.txt: file does not exist"), ""},
+		{`write_file("readonly.txt", "x")`, errorMessage("open readonly.txt: permission denied"), ""},
+		{`try { read_file("missing.txt") } catch (e) { e.kind }`, "IOError", ""},
+		{`read_file(1)`, errorMessage("argument to `read_file` must be STRING. got = INTEGER"), ""},
+		{`now(1)`, errorMessage("wrong number of arguments. got = 1, want = 0"), ""},
+	}
+
+	for _, tt := range tests {
+		host := &testHost{files: map[string]string{"config.txt": "limit=3"}}
+		evaluated := testEvalWithBuiltins(tt.input, NewBuiltins(host, nil))
+
+		switch expected := tt.expected.(type) {
+		case nil:
+			testNullObject(t, evaluated)
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("%s: object is not String. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong value for %s. expected = %q, got = %q", tt.input, expected, str.Value)
+			}
+		case errorMessage:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%s: object is not Error. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != string(expected) {
+				t.Errorf("wrong error message for %s. expected = %q, got = %q", tt.input, expected, errObj.Message)
+			}
+		}
+
+		if host.out.String() != tt.output {
+			t.Errorf("wrong output for %s. expected = %q, got = %q", tt.input, tt.output, host.out.String())
+		}
+	}
+}
+
+func TestBuiltinPolicy(t *testing.T) {
+	host := &testHost{files: map[string]string{}}
+
+	tests := []struct {
+		input    string
+		policy   BuiltinPolicy
+		expected interface{}
+	}{
+		{`len("abc")`, PureBuiltins, 3},
+		{`puts(1)`, PureBuiltins, errorMessage("Identifier Not Found: puts")},
+		{`read_file("a")`, PureBuiltins, errorMessage("Identifier Not Found: read_file")},
+		{`map([1], fn(x) { x })[0]`, AllowBuiltins("map"), 1},
+		{`len([1])`, AllowBuiltins("map"), errorMessage("Identifier Not Found: len")},
+		{`now()`, DenyBuiltins("read_file", "write_file"), 1700000000000},
+		{`write_file("a", "b")`, DenyBuiltins("read_file", "write_file"), errorMessage("Identifier Not Found: write_file")},
+		// 公開されていない組み込み関数の名前は、普通の変数として使える
+		{`let puts = 5; puts = puts + 1; puts`, PureBuiltins, 6},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEvalWithBuiltins(tt.input, NewBuiltins(host, tt.policy))
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case errorMessage:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%s: object is not Error. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != string(expected) {
+				t.Errorf("wrong error message for %s. expected = %q, got = %q", tt.input, expected, errObj.Message)
+			}
+		}
+	}
+
+	if host.out.Len() != 0 || len(host.files) != 0 {
+		t.Errorf("denied builtins touched the host. output = %q, files = %v", host.out.String(), host.files)
+	}
+}
@@ -0,0 +1,109 @@
+package evaluator
+
+import (
+	"errors"
+	"io"
+	"monkey/object"
+	"os"
+	"time"
+)
+
+// 組み込み関数が出力やファイル・時計を使うときに通すインターフェース
+// 埋め込む側が実装を差し替えることで、スクリプトから見える外部の世界を制限できる
+type Host interface {
+	Stdout() io.Writer                        // puts の出力先
+	ReadFile(name string) ([]byte, error)     // read_file で読むファイル
+	WriteFile(name string, data []byte) error // write_file で書くファイル
+	Now() time.Time                           // now が返す時刻
+}
+
+// OS の標準出力・ファイルシステム・時計をそのまま使う Host
+type OSHost struct {
+	Out io.Writer // nil なら os.Stdout
+}
+
+func (h OSHost) Stdout() io.Writer {
+	if h.Out == nil {
+		return os.Stdout
+	}
+	return h.Out
+}
+
+func (h OSHost) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (h OSHost) WriteFile(name string, data []byte) error {
+	return os.WriteFile(name, data, 0644)
+}
+
+func (h OSHost) Now() time.Time {
+	return time.Now()
+}
+
+// 組み込み関数を公開するかどうかを名前で決める (nil ならすべて公開する)
+// IMPORT_POLICY_NAME に対する結果で import 文を使えるかどうかも決める
+type BuiltinPolicy func(name string) bool
+
+// BuiltinPolicy に渡して import 文を使えるかどうかを決める名前
+// (import はキーワードなので、同じ名前の組み込み関数と紛れることはない)
+const IMPORT_POLICY_NAME = "import"
+
+// policy が import を許さないときに、モジュールを読む関数が返すエラー
+var ErrImportNotAllowed = errors.New("import is not allowed")
+
+// names の組み込み関数だけを公開する
+func AllowBuiltins(names ...string) BuiltinPolicy {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(name string) bool { return allowed[name] }
+}
+
+// names 以外の組み込み関数を公開する
+func DenyBuiltins(names ...string) BuiltinPolicy {
+	denied := make(map[string]bool, len(names))
+	for _, name := range names {
+		denied[name] = true
+	}
+	return func(name string) bool { return !denied[name] }
+}
+
+// Host を使わない (外部に影響せず、外部から影響も受けない) 組み込み関数だけを公開する
+// モジュールはファイルから読むので import も使えない
+func PureBuiltins(name string) bool {
+	if name == IMPORT_POLICY_NAME {
+		return false
+	}
+	_, ok := hostBuiltins[name]
+	return !ok
+}
+
+// I/O を host を通して行い、policy が許す組み込み関数だけを持つ組み込み関数の表を作る
+// 作った表は Execution.Builtins に設定して使う
+func NewBuiltins(host Host, policy BuiltinPolicy) map[string]*object.Builtin {
+	table := make(map[string]*object.Builtin, len(builtinNames))
+
+	for name, builtin := range pureBuiltins {
+		if policy == nil || policy(name) {
+			table[name] = builtin
+		}
+	}
+	for name, newBuiltin := range hostBuiltins {
+		if policy == nil || policy(name) {
+			table[name] = &object.Builtin{Fn: newBuiltin(host)}
+		}
+	}
+
+	return table
+}
+
+// import するモジュールのソースを host から読む関数を作る (policy が import を許さなければエラーを返す)
+// 作った関数は Execution.ReadModule や Compiler.SetModuleReader に設定して使う
+func NewModuleReader(host Host, policy BuiltinPolicy) func(file string) ([]byte, error) {
+	if policy != nil && !policy(IMPORT_POLICY_NAME) {
+		return func(file string) ([]byte, error) { return nil, ErrImportNotAllowed }
+	}
+	return host.ReadFile
+}
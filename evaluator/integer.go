@@ -0,0 +1,254 @@
+package evaluator
+
+import (
+	"math"
+	"math/big"
+	"monkey/object"
+)
+
+// 整数の演算
+// int64 で計算できる間は Integer のまま計算し、オーバーフローしたら多倍長整数で計算し直す
+// 多倍長整数の結果は object.NewInteger で作るので、int64 に収まれば Integer に戻る
+
+// 多倍長整数のビット数の上限 (2 ** 100000000 のような式でメモリを使い果たさないように)
+const maxIntegerBits = 1 << 20
+
+func evalIntegerInfixExpression(operator string, left object.Object, right object.Object) object.Object {
+	l, leftOk := left.(*object.Integer)
+	r, rightOk := right.(*object.Integer)
+	if !leftOk || !rightOk {
+		return evalBigIntegerInfixExpression(operator, toBigInt(left), toBigInt(right))
+	}
+
+	leftVal := l.Value
+	rightVal := r.Value
+
+	switch operator {
+	case "+":
+		if sum := leftVal + rightVal; (sum > leftVal) == (rightVal > 0) {
+			return &object.Integer{Value: sum}
+		}
+	case "-":
+		if diff := leftVal - rightVal; (diff < leftVal) == (rightVal > 0) {
+			return &object.Integer{Value: diff}
+		}
+	case "*":
+		if product, ok := mulInt64(leftVal, rightVal); ok {
+			return &object.Integer{Value: product}
+		}
+	case "/":
+		if rightVal == 0 {
+			return newError(object.RUNTIME_ERROR, "division by zero")
+		}
+		// math.MinInt64 / -1 だけは int64 に収まらない
+		if leftVal != math.MinInt64 || rightVal != -1 {
+			return &object.Integer{Value: leftVal / rightVal}
+		}
+	case "%":
+		// 余りの符号は / と同じく 0 方向への切り捨てに合わせて左辺の符号になる (-7 % 3 は -1)
+		if rightVal == 0 {
+			return newError(object.RUNTIME_ERROR, "modulo by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
+	case "**":
+		// 指数が負のときは整数にならないので、浮動小数点数で返す (2 ** -1 は 0.5)
+		if rightVal < 0 {
+			return &object.Float{Value: math.Pow(float64(leftVal), float64(rightVal))}
+		}
+		if power, ok := powInt64(leftVal, rightVal); ok {
+			return &object.Integer{Value: power}
+		}
+	case "&":
+		return &object.Integer{Value: leftVal & rightVal}
+	case "|":
+		return &object.Integer{Value: leftVal | rightVal}
+	case "^":
+		return &object.Integer{Value: leftVal ^ rightVal}
+	case "<<":
+		if rightVal < 0 {
+			return newError(object.RUNTIME_ERROR, "negative shift count: %d", rightVal)
+		}
+		// 戻したときに元の値になれば、はみ出したビットはない
+		if rightVal < 64 {
+			if shifted := leftVal << uint64(rightVal); shifted>>uint64(rightVal) == leftVal {
+				return &object.Integer{Value: shifted}
+			}
+		}
+	case ">>":
+		if rightVal < 0 {
+			return newError(object.RUNTIME_ERROR, "negative shift count: %d", rightVal)
+		}
+		return &object.Integer{Value: leftVal >> uint64(rightVal)}
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError(object.TYPE_ERROR, "Unknown Operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+
+	// int64 に収まらなかったので、多倍長整数で計算し直す
+	return evalBigIntegerInfixExpression(operator, big.NewInt(leftVal), big.NewInt(rightVal))
+}
+
+// x と y は他のオブジェクトと共有しているので書き換えない
+func evalBigIntegerInfixExpression(operator string, x, y *big.Int) object.Object {
+	switch operator {
+	case "+":
+		return newBigInteger(new(big.Int).Add(x, y))
+	case "-":
+		return newBigInteger(new(big.Int).Sub(x, y))
+	case "*":
+		return newBigInteger(new(big.Int).Mul(x, y))
+	case "/":
+		if y.Sign() == 0 {
+			return newError(object.RUNTIME_ERROR, "division by zero")
+		}
+		return newBigInteger(new(big.Int).Quo(x, y))
+	case "%":
+		if y.Sign() == 0 {
+			return newError(object.RUNTIME_ERROR, "modulo by zero")
+		}
+		return newBigInteger(new(big.Int).Rem(x, y))
+	case "**":
+		if y.Sign() < 0 {
+			return &object.Float{Value: math.Pow(bigToFloat(x), bigToFloat(y))}
+		}
+		// 0, 1, -1 以外の累乗は、計算する前に結果が大きくなりすぎないか確かめる
+		if x.CmpAbs(big.NewInt(1)) > 0 &&
+			(!y.IsInt64() || y.Int64() > maxIntegerBits || int64(x.BitLen()-1)*y.Int64() > maxIntegerBits) {
+			return integerOverflowError()
+		}
+		return newBigInteger(new(big.Int).Exp(x, y, nil))
+	case "&":
+		return newBigInteger(new(big.Int).And(x, y))
+	case "|":
+		return newBigInteger(new(big.Int).Or(x, y))
+	case "^":
+		return newBigInteger(new(big.Int).Xor(x, y))
+	case "<<":
+		if y.Sign() < 0 {
+			return newError(object.RUNTIME_ERROR, "negative shift count: %s", y)
+		}
+		if x.Sign() == 0 {
+			return &object.Integer{Value: 0}
+		}
+		if !y.IsInt64() || y.Int64() > maxIntegerBits {
+			return integerOverflowError()
+		}
+		return newBigInteger(new(big.Int).Lsh(x, uint(y.Int64())))
+	case ">>":
+		if y.Sign() < 0 {
+			return newError(object.RUNTIME_ERROR, "negative shift count: %s", y)
+		}
+		// ビット数以上シフトすると 0 (負の数なら -1) になる
+		shift := uint(x.BitLen())
+		if y.IsInt64() && y.Int64() < int64(shift) {
+			shift = uint(y.Int64())
+		}
+		return newBigInteger(new(big.Int).Rsh(x, shift))
+	case ">":
+		return nativeBoolToBooleanObject(x.Cmp(y) > 0)
+	case "<":
+		return nativeBoolToBooleanObject(x.Cmp(y) < 0)
+	case ">=":
+		return nativeBoolToBooleanObject(x.Cmp(y) >= 0)
+	case "<=":
+		return nativeBoolToBooleanObject(x.Cmp(y) <= 0)
+	case "==":
+		return nativeBoolToBooleanObject(x.Cmp(y) == 0)
+	case "!=":
+		return nativeBoolToBooleanObject(x.Cmp(y) != 0)
+	default:
+		return newError(object.TYPE_ERROR, "Unknown Operator: %s %s %s", object.INTEGER_OBJ, operator, object.INTEGER_OBJ)
+	}
+}
+
+// 桁あふれしない場合だけ a * b を返す
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+
+	product := a * b
+	if product/b != a || (a == math.MinInt64 && b == -1) {
+		return 0, false
+	}
+	return product, true
+}
+
+// 桁あふれしない場合だけ base ** exp を返す (exp は 0 以上)
+func powInt64(base, exp int64) (int64, bool) {
+	result := int64(1)
+	ok := true
+
+	for exp > 0 {
+		if exp&1 == 1 {
+			if result, ok = mulInt64(result, base); !ok {
+				return 0, false
+			}
+		}
+		exp >>= 1
+		if exp > 0 {
+			if base, ok = mulInt64(base, base); !ok {
+				return 0, false
+			}
+		}
+	}
+	return result, true
+}
+
+// 演算結果の多倍長整数を、大きすぎないか確かめてからオブジェクトにする
+func newBigInteger(x *big.Int) object.Object {
+	if x.BitLen() > maxIntegerBits {
+		return integerOverflowError()
+	}
+	return object.NewInteger(x)
+}
+
+func integerOverflowError() *object.Error {
+	return newError(object.RUNTIME_ERROR, "integer overflow. result exceeds %d bits", maxIntegerBits)
+}
+
+// Integer と BigInteger を *big.Int にする (返した値は書き換えない)
+func toBigInt(obj object.Object) *big.Int {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return big.NewInt(obj.Value)
+	case *object.BigInteger:
+		return obj.Value
+	default:
+		return new(big.Int)
+	}
+}
+
+// float64 の範囲を超える値は ±Inf になる
+func bigToFloat(x *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(x).Float64()
+	return f
+}
+
+// 整数同士を比べて -1, 0, 1 のいずれかを返す
+func compareIntegers(a, b object.Object) int {
+	if x, ok := a.(*object.Integer); ok {
+		if y, ok := b.(*object.Integer); ok {
+			switch {
+			case x.Value < y.Value:
+				return -1
+			case x.Value > y.Value:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+	return toBigInt(a).Cmp(toBigInt(b))
+}
@@ -117,3 +117,126 @@ func convertObjectToASTNode(obj object.Object) ast.Node {
 		return nil
 	}
 }
+
+// マクロ展開の再帰深さの上限 (自分自身を展開し続けるマクロで無限ループしないように)
+const maxMacroExpansionDepth = 1000
+
+// プログラム中のマクロ呼び出しを探し、マクロ本体の評価結果 (Quote) で置き換える
+// 展開結果にさらにマクロ呼び出しが含まれていれば、再帰的に展開する
+func ExpandMacros(program ast.Node, env *object.Environment) (ast.Node, *object.Error) {
+	return expandMacros(program, env, 0)
+}
+
+func expandMacros(program ast.Node, env *object.Environment, depth int) (ast.Node, *object.Error) {
+	if depth > maxMacroExpansionDepth {
+		return program, newError(object.MACRO_ERROR, "macro expansion too deep. limit = %d", maxMacroExpansionDepth)
+	}
+
+	var expandErr *object.Error
+
+	expanded := ast.Modify(program, func(node ast.Node) ast.Node {
+		// 一度エラーが発生したら、以降の展開は行わない
+		if expandErr != nil {
+			return node
+		}
+
+		callExpression, ok := node.(*ast.CallExpression)
+		if !ok {
+			return node
+		}
+
+		macro, ok := isMacroCall(callExpression, env)
+		if !ok {
+			return node
+		}
+
+		if len(callExpression.Arguments) != len(macro.Parameters) {
+			expandErr = newError(object.MACRO_ERROR, "wrong number of arguments to macro `%s`. got = %d, want = %d",
+				callExpression.Function.String(), len(callExpression.Arguments), len(macro.Parameters))
+			expandErr.Pos = callExpression.Pos()
+			return node
+		}
+
+		args := quoteArgs(callExpression)
+		evalEnv := extendMacroEnv(macro, args)
+
+		evaluated := Eval(macro.Body, evalEnv)
+		evaluated = unwrapReturnValue(evaluated)
+		if isError(evaluated) {
+			expandErr = evaluated.(*object.Error)
+			return node
+		}
+
+		quote, ok := evaluated.(*object.Quote)
+		if !ok {
+			expandErr = newError(object.MACRO_ERROR, "macro `%s` must return QUOTE. got = %s",
+				callExpression.Function.String(), typeOf(evaluated))
+			expandErr.Pos = callExpression.Pos()
+			return node
+		}
+
+		// 展開結果に含まれるマクロ呼び出しも展開する
+		result, err := expandMacros(quote.Node, env, depth+1)
+		if err != nil {
+			expandErr = err
+			return node
+		}
+
+		return result
+	})
+
+	if expandErr != nil {
+		return program, expandErr
+	}
+
+	return expanded, nil
+}
+
+func isMacroCall(exp *ast.CallExpression, env *object.Environment) (*object.Macro, bool) {
+	identifier, ok := exp.Function.(*ast.Identifier)
+	if !ok {
+		return nil, false
+	}
+
+	obj, ok := env.Get(identifier.Value)
+	if !ok {
+		return nil, false
+	}
+
+	macro, ok := obj.(*object.Macro)
+	if !ok {
+		return nil, false
+	}
+
+	return macro, true
+}
+
+// マクロの引数は評価せず、Quote に包んでそのまま渡す
+func quoteArgs(exp *ast.CallExpression) []*object.Quote {
+	args := []*object.Quote{}
+
+	for _, a := range exp.Arguments {
+		args = append(args, &object.Quote{Node: a})
+	}
+
+	return args
+}
+
+func extendMacroEnv(macro *object.Macro, args []*object.Quote) *object.Environment {
+	extended := object.NewEnclosedEnvironment(macro.Env)
+
+	for paramIdx, param := range macro.Parameters {
+		extended.Set(param.Value, args[paramIdx])
+	}
+
+	return extended
+}
+
+// nil を返すマクロ本体 (空のブロックなど) でも型名を表示できるようにする
+func typeOf(obj object.Object) object.ObjectType {
+	if obj == nil {
+		return "nil"
+	}
+
+	return obj.Type()
+}
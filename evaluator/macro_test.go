@@ -175,3 +175,120 @@ func testParseProgram(input string) *ast.Program {
 	p := parser.New(l)
 	return p.ParseProgram()
 }
+
+func TestExpandMacros(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`
+			let infixExpression = macro() { quote(1 + 2); };
+
+			infixExpression();
+			`,
+			`(1 + 2)`,
+		},
+		{
+			`
+			let reverse = macro(a, b) { quote(unquote(b) - unquote(a)); };
+
+			reverse(2 + 2, 10 - 5);
+			`,
+			`(10 - 5) - (2 + 2)`,
+		},
+		{
+			`
+			let unless = macro(condition, consequence, alternative) {
+				quote(if (!(unquote(condition))) {
+					unquote(consequence);
+				} else {
+					unquote(alternative);
+				});
+			};
+
+			unless(10 > 5, puts("not greater"), puts("greater"));
+			`,
+			`if (!(10 > 5)) { puts("not greater") } else { puts("greater") }`,
+		},
+		{
+			`
+			let double = macro(x) { quote(unquote(x) * 2); };
+			let quadruple = macro(x) { quote(double(double(unquote(x)))); };
+
+			quadruple(3);
+			`,
+			`(3 * 2) * 2`,
+		},
+		{
+			`
+			let reverse = macro(a, b) { quote(unquote(b) - unquote(a)); };
+
+			reverse(1, 2);
+			reverse(3, 4);
+			`,
+			`(2 - 1); (4 - 3)`,
+		},
+	}
+
+	for _, tt := range tests {
+		expected := testParseProgram(tt.expected)
+		program := testParseProgram(tt.input)
+
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("ExpandMacros returned error: %s", err.Message)
+		}
+
+		if expanded.String() != expected.String() {
+			t.Errorf("not equal. expected = %q, got = %q", expected.String(), expanded.String())
+		}
+	}
+}
+
+func TestExpandMacrosErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{
+			`
+			let two = macro(a, b) { quote(unquote(a) + unquote(b)); };
+			two(1);
+			`,
+			"wrong number of arguments to macro `two`. got = 1, want = 2",
+		},
+		{
+			`
+			let notQuote = macro() { 1 + 2; };
+			notQuote();
+			`,
+			"macro `notQuote` must return QUOTE. got = INTEGER",
+		},
+		{
+			`
+			let loop = macro() { quote(loop()); };
+			loop();
+			`,
+			"macro expansion too deep. limit = 1000",
+		},
+	}
+
+	for _, tt := range tests {
+		program := testParseProgram(tt.input)
+
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		_, err := ExpandMacros(program, env)
+		if err == nil {
+			t.Errorf("expected error %q. got none", tt.expectedMessage)
+			continue
+		}
+
+		if err.Message != tt.expectedMessage {
+			t.Errorf("Wrong error message. expected = %q, got = %q.", tt.expectedMessage, err.Message)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// モジュールのファイルの拡張子 (import のパスで省略できる)
+const MODULE_EXT = ".mk"
+
+// 読み込んで構文解析したモジュール
+// 評価器はこれをそのまま評価し、コンパイラは関数としてコンパイルする
+type ModuleSource struct {
+	Name    string       // ファイル名から拡張子を除いたもの (表示用)
+	Path    string       // 絶対パス (キャッシュのキー)
+	Program *ast.Program // マクロ展開済みのプログラム
+	Exports []string     // export された変数名 (書かれた順)
+}
+
+// import するファイルのパスを求める
+// 相対パスは import 文のあるファイルのディレクトリから探し、拡張子がなければ .mk を補う
+// file は読み込みとエラー表示に使うパス、key はキャッシュと循環の検出に使う絶対パス
+func ResolveModule(importer token.Position, importPath string) (file, key string) {
+	file = importPath
+	if filepath.Ext(file) == "" {
+		file += MODULE_EXT
+	}
+	if !filepath.IsAbs(file) {
+		// -e や標準入力のようにファイル名を持たない場合はカレントディレクトリから探す
+		file = filepath.Join(filepath.Dir(importer.Filename), file)
+	}
+
+	key, err := filepath.Abs(file)
+	if err != nil {
+		key = file
+	}
+	return file, key
+}
+
+// モジュールのファイルを read で読み込み、構文解析とマクロ展開をする (read が nil なら OS のファイルを読む)
+func LoadModule(file, key string, read func(file string) ([]byte, error)) (*ModuleSource, *object.Error) {
+	if read == nil {
+		read = os.ReadFile
+	}
+
+	src, err := read(file)
+	if err != nil {
+		if errors.Is(err, ErrImportNotAllowed) {
+			return nil, newError(object.IMPORT_ERROR, "%s", err)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, newError(object.IMPORT_ERROR, "module not found: %s", file)
+		}
+		return nil, newError(object.IMPORT_ERROR, "cannot read module %s: %s", file, err)
+	}
+
+	p := parser.New(lexer.NewWithFilename(file, string(src)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, newError(object.IMPORT_ERROR, "syntax error in module %s: %s", file, strings.Join(p.Errors(), "; "))
+	}
+
+	macroEnv := object.NewEnvironment()
+	DefineMacros(program, macroEnv)
+	expanded, expandErr := ExpandMacros(program, macroEnv)
+	if expandErr != nil {
+		return nil, expandErr
+	}
+	program = expanded.(*ast.Program)
+
+	// トップレベルの return はモジュールの途中で export を打ち切ってしまうので認めない
+	var returnErr *object.Error
+	ast.Inspect(program, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FunctionLiteral, *ast.MacroLiteral:
+			return false
+		case *ast.ReturnStatement:
+			if returnErr == nil {
+				returnErr = newError(object.IMPORT_ERROR, "return outside function in module %s", file)
+				returnErr.Pos = node.Pos()
+			}
+		}
+		return true
+	})
+	if returnErr != nil {
+		return nil, returnErr
+	}
+
+	module := &ModuleSource{
+		Name:    moduleName(file),
+		Path:    key,
+		Program: program,
+	}
+	for _, stmt := range program.Statements {
+		if export, ok := stmt.(*ast.ExportStatement); ok {
+			module.Exports = append(module.Exports, export.Statement.Name.Value)
+		}
+	}
+
+	return module, nil
+}
+
+// loading (読み込み中のモジュール) に key があれば、循環を示すエラーを返す
+func ImportCycleError(loading []string, key string) *object.Error {
+	for i, path := range loading {
+		if path != key {
+			continue
+		}
+
+		cycle := []string{}
+		for _, p := range loading[i:] {
+			cycle = append(cycle, filepath.Base(p))
+		}
+		cycle = append(cycle, filepath.Base(key))
+		return newError(object.IMPORT_ERROR, "import cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	return nil
+}
+
+// ファイル名から拡張子を除いたもの
+func moduleName(file string) string {
+	base := filepath.Base(file)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// スタックトレースに表示するモジュールのトップレベルの名前
+func ModuleFrameName(name string) string {
+	return fmt.Sprintf("<module %s>", name)
+}
+
+func evalImportStatement(node *ast.ImportStatement, env *object.Environment) object.Object {
+	module := importModule(node, env)
+	if isError(module) {
+		return module
+	}
+
+	env.Set(node.Name.Value, module)
+	return nil
+}
+
+// モジュールを読み込んで評価する (一度読み込んだモジュールはキャッシュを返す)
+// モジュールは importer とは別の環境で評価し、export された変数だけを公開する
+func importModule(node *ast.ImportStatement, env *object.Environment) object.Object {
+	file, key := ResolveModule(node.Pos(), node.Path)
+
+	cache := env.Modules()
+	if module, ok := cache.Modules[key]; ok {
+		return module
+	}
+
+	if err := ImportCycleError(cache.Loading, key); err != nil {
+		return err
+	}
+
+	src, err := LoadModule(file, key, env.Execution().ReadModule)
+	if err != nil {
+		// モジュールの中の位置を持つエラーは、モジュールの中で起きたものとして表示する
+		if err.Pos.IsValid() {
+			err.AddTrace(ModuleFrameName(moduleName(file)), node.Pos())
+		}
+		return err
+	}
+
+	cache.Loading = append(cache.Loading, key)
+	moduleEnv := object.NewModuleEnvironment(env)
+	result := Eval(src.Program, moduleEnv)
+	cache.Loading = cache.Loading[:len(cache.Loading)-1]
+
+	if err, ok := result.(*object.Error); ok {
+		err.AddTrace(ModuleFrameName(src.Name), node.Pos())
+		return err
+	}
+
+	exports := object.NewHash()
+	for _, name := range src.Exports {
+		value, _ := moduleEnv.Get(name)
+		key := &object.String{Value: name}
+		exports.Set(key.HashKey(), object.HashPair{Key: key, Value: value})
+	}
+
+	module := &object.Module{Name: src.Name, Exports: exports}
+	cache.Modules[key] = module
+	return module
+}
+
+// mod.name (mod["name"]) で export された値を参照する
+func evalModuleIndexExpression(module, index object.Object) object.Object {
+	moduleObject := module.(*object.Module)
+
+	name, ok := index.(*object.String)
+	if !ok {
+		return newError(object.TYPE_ERROR, "module member must be STRING. got = %s", index.Type())
+	}
+
+	pair, ok := moduleObject.Exports.Get(name.HashKey())
+	if !ok {
+		return newError(object.NAME_ERROR, "module %s has no export %s", moduleObject.Name, name.Value)
+	}
+
+	return pair.Value
+}
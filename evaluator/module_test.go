@@ -0,0 +1,154 @@
+package evaluator
+
+import (
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// テストで使うモジュール (パスは main.mk のあるディレクトリからの相対パス)
+var testModules = map[string]string{
+	"lib/math.mk": `
+		let square = fn(x) { x * x };
+		export let pi = 3;
+		export let area = fn(r) { pi * square(r) };
+		// 後で定義される変数も参照できる
+		export let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } };
+		let isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } };
+	`,
+	"lib/util.mk": `
+		import "math";
+		export let circle = fn(r) { math.area(r) };
+	`,
+	"counter.mk": `
+		export let state = {"loads": 0};
+		state["loads"] += 1;
+	`,
+	"cycle_a.mk": `import "cycle_b"; export let a = 1;`,
+	"cycle_b.mk": `import "cycle_a"; export let b = 2;`,
+	"broken.mk":  `let x = ;`,
+	"toplevel.mk": `
+		let f = fn() { return 1 };
+		if (true) { return 2 };
+	`,
+	"failing.mk": `
+		let f = fn() { 1 + true };
+		f();
+	`,
+	"isolated.mk": `export let read = fn() { secret };`,
+}
+
+// testModules を一時ディレクトリに書き出し、そこにある main.mk として input を評価する
+func testEvalWithModules(t *testing.T, input string) object.Object {
+	dir := t.TempDir()
+	for name, src := range testModules {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := lexer.NewWithFilename(filepath.Join(dir, "main.mk"), input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	return Eval(program, object.NewEnvironment())
+}
+
+func TestModules(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`import "lib/math"; math.pi`, 3},
+		{`import "lib/math"; math.area(2)`, 12},
+		{`import "lib/math"; math["area"](1)`, 3},
+		{`import "lib/math"; math.isEven(10)`, true},
+		{`import "lib/math" as m; m.pi`, 3},
+		{`import "lib/math.mk"; math.pi`, 3},
+		{`import "lib/math"; math`, "<module math>"},
+		// import の中の相対パスは、import 文のあるファイルから探す
+		{`import "lib/util"; util.circle(1)`, 3},
+		// 同じモジュールは一度しか評価しない
+		{`import "counter"; import "counter" as again; again.state["loads"]`, 1},
+		{`import "lib/math" as a; import "lib/util"; import "lib/math" as b; a == b`, true},
+		{`let f = fn() { import "lib/math"; math.pi }; f() + f()`, 6},
+		// エラー
+		{`import "lib/math"; math.square`, errorMessage("module math has no export square")},
+		{`import "lib/math"; math[0]`, errorMessage("module member must be STRING. got = INTEGER")},
+		{`import "lib/math"; math.pi = 4`, errorMessage("index assignment is not supported: MODULE")},
+		{`import "isolated"; let secret = 1; isolated.read()`, errorMessage("Identifier Not Found: secret")},
+		{`import "missing"`, errorMessage("module not found: ")},
+		{`import "cycle_a"`, errorMessage("import cycle: cycle_a.mk -> cycle_b.mk -> cycle_a.mk")},
+		{`import "broken"`, errorMessage("syntax error in module ")},
+		{`import "toplevel"`, errorMessage("return outside function in module ")},
+		{`import "failing"`, errorMessage("Type Mismatch: INTEGER + BOOLEAN")},
+		{`try { import "failing"; 1 } catch (e) { e.kind }`, "TypeError"},
+		{`try { import "missing"; 1 } catch (e) { e.kind }`, "ImportError"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEvalWithModules(t, tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			if evaluated.Inspect() != expected {
+				t.Errorf("wrong value for %s. expected = %q, got = %q", tt.input, expected, evaluated.Inspect())
+			}
+		case errorMessage:
+			// パスは一時ディレクトリによって変わるので、前方一致で比べる
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%s: object is not Error. got = %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if !strings.HasPrefix(errObj.Message, string(expected)) {
+				t.Errorf("wrong error message for %s. expected = %q, got = %q", tt.input, expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestModuleStackTrace(t *testing.T) {
+	evaluated := testEvalWithModules(t, "\nimport \"failing\";")
+
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("object is not Error. got = %T (%+v)", evaluated, evaluated)
+	}
+
+	if len(errObj.Trace) != 2 {
+		t.Fatalf("wrong trace length. expected = 2, got = %d", len(errObj.Trace))
+	}
+
+	expected := []struct {
+		function string
+		file     string
+		line     int
+	}{
+		{"f", "failing.mk", 3},
+		{"<module failing>", "main.mk", 2},
+	}
+	for i, frame := range errObj.Trace {
+		if frame.Function != expected[i].function {
+			t.Errorf("trace[%d]: wrong function. expected = %q, got = %q", i, expected[i].function, frame.Function)
+		}
+		if filepath.Base(frame.CallPos.Filename) != expected[i].file || frame.CallPos.Line != expected[i].line {
+			t.Errorf("trace[%d]: wrong position. expected = %s:%d, got = %s", i, expected[i].file, expected[i].line, frame.CallPos)
+		}
+	}
+}
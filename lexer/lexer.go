@@ -1,34 +1,72 @@
 package lexer
 
-import "monkey/token"
+import (
+	"fmt"
+	"monkey/token"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 type Lexer struct {
 	input        string
 	position     int  // 現在位置
 	readPosition int  // これから読み込む位置
-	ch           byte // 現在検査中の文字
+	ch           rune // 現在検査中の文字
+
+	filename string
+	line     int // 現在検査中の文字の行 (1 始まり)
+	column   int // 現在検査中の文字の列 (1 始まり)
+
+	errors []string // 閉じていないコメントなど、字句解析で見つかったエラー
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithFilename("", input)
+}
+
+// エラー位置の表示に使うファイル名を指定して Lexer を生成する
+func NewWithFilename(filename, input string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
 
 func (l *Lexer) readChar() {
+	// 改行を読み終えたら次の行の先頭に移る
+	if l.ch == '\n' {
+		l.line += 1
+		l.column = 0
+	}
+	l.column += 1
+
+	// UTF-8 の 1 文字分 (1〜4 バイト) を読み進める
+	width := 1
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
-		l.ch = l.input[l.readPosition]
+		l.ch, width = utf8.DecodeRuneInString(l.input[l.readPosition:])
 	}
 	l.position = l.readPosition
-	l.readPosition += 1
+	l.readPosition += width
+}
+
+// 字句解析で見つかったエラーを "line:col: message" 形式で返す
+func (l *Lexer) Errors() []string {
+	return l.errors
+}
+
+func (l *Lexer) addError(pos token.Position, msg string) {
+	l.errors = append(l.errors, pos.String()+": "+msg)
 }
 
 func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
-	l.skipWhitespace()
+	comments := l.skipWhitespaceAndComments()
+
+	pos := l.currentPosition()
 
 	switch l.ch {
 	case '=':
@@ -45,6 +83,8 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '.':
+		tok = newToken(token.DOT, l.ch)
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
@@ -52,9 +92,9 @@ func (l *Lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.newCompoundToken(token.PLUS, token.PLUS_ASSIGN)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		tok = l.newCompoundToken(token.MINUS, token.MINUS_ASSIGN)
 	case '!':
 		switch l.peekChar() {
 		// case "!="
@@ -65,14 +105,72 @@ func (l *Lexer) NextToken() token.Token {
 		default:
 			tok = newToken(token.BANG, l.ch)
 		}
+	case '&':
+		switch l.peekChar() {
+		// case "&&"
+		case '&':
+			ch := l.ch
+			l.readChar() // 二文字目を消費しておく
+			tok = token.Token{Type: token.AND, Literal: string(ch) + string(l.ch)}
+		default:
+			tok = newToken(token.BIT_AND, l.ch)
+		}
+	case '|':
+		switch l.peekChar() {
+		// case "||"
+		case '|':
+			ch := l.ch
+			l.readChar() // 二文字目を消費しておく
+			tok = token.Token{Type: token.OR, Literal: string(ch) + string(l.ch)}
+		default:
+			tok = newToken(token.BIT_OR, l.ch)
+		}
+	case '^':
+		tok = newToken(token.BIT_XOR, l.ch)
+	case '~':
+		tok = newToken(token.TILDE, l.ch)
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		tok = l.newCompoundToken(token.SLASH, token.SLASH_ASSIGN)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			ch := l.ch
+			l.readChar() // 二文字目を消費しておく
+			tok = token.Token{Type: token.POWER, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = l.newCompoundToken(token.ASTERISK, token.ASTERISK_ASSIGN)
+		}
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		switch l.peekChar() {
+		// case "<="
+		case '=':
+			ch := l.ch
+			l.readChar() // 二文字目を消費しておく
+			tok = token.Token{Type: token.LT_EQ, Literal: string(ch) + string(l.ch)}
+		// case "<<"
+		case '<':
+			ch := l.ch
+			l.readChar() // 二文字目を消費しておく
+			tok = token.Token{Type: token.SHIFT_LEFT, Literal: string(ch) + string(l.ch)}
+		default:
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		switch l.peekChar() {
+		// case ">="
+		case '=':
+			ch := l.ch
+			l.readChar() // 二文字目を消費しておく
+			tok = token.Token{Type: token.GT_EQ, Literal: string(ch) + string(l.ch)}
+		// case ">>"
+		case '>':
+			ch := l.ch
+			l.readChar() // 二文字目を消費しておく
+			tok = token.Token{Type: token.SHIFT_RIGHT, Literal: string(ch) + string(l.ch)}
+		default:
+			tok = newToken(token.GT, l.ch)
+		}
 	case '{':
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
@@ -83,7 +181,7 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.RBRACKET, l.ch)
 	case '"':
 		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok.Literal = l.readString(pos)
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -93,22 +191,46 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.LookupIdent(tok.Literal)
 
 			// 余分な readChar() が発生しないように早期 return する
-			return tok
+			return l.finishToken(tok, pos, comments)
 		} else if isDigit(l.ch) {
-			tok.Literal = l.readNumber()
-			tok.Type = token.INT
-			return tok
+			tok.Literal, tok.Type = l.readNumber()
+			return l.finishToken(tok, pos, comments)
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
 
 	l.readChar()
+	return l.finishToken(tok, pos, comments)
+}
+
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{Filename: l.filename, Line: l.line, Column: l.column}
+}
+
+// トークンに開始位置と、読み終えた直後の位置 (= 終了位置) を設定し、前後のコメントを付ける
+func (l *Lexer) finishToken(tok token.Token, pos token.Position, leading []token.Comment) token.Token {
+	tok.Pos = pos
+	tok.End = l.currentPosition()
+	tok.LeadingComments = leading
+	if tok.Type != token.EOF {
+		tok.TrailingComments = l.readTrailingComments()
+	}
 	return tok
 }
 
+// 次の文字が = なら複合代入 (+= など)、そうでなければ一文字の演算子にする
+func (l *Lexer) newCompoundToken(single, compound token.TokenType) token.Token {
+	if l.peekChar() == '=' {
+		ch := l.ch
+		l.readChar() // 二文字目を消費しておく
+		return token.Token{Type: compound, Literal: string(ch) + string(l.ch)}
+	}
+	return newToken(single, l.ch)
+}
+
 // string な ch を token.Token 型に変換する
-func newToken(tokenType token.TokenType, ch byte) token.Token {
+func newToken(tokenType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
 
@@ -122,33 +244,137 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readString() string {
-	position := l.position + 1
+// 閉じる " までを読み、エスケープシーケンスを展開した文字列を返す
+// pos は開き " の位置 (閉じていない場合のエラー表示に使う)
+func (l *Lexer) readString(pos token.Position) string {
+	var out strings.Builder
+
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+
+		switch l.ch {
+		case '"':
+			return out.String()
+		case 0:
+			l.addError(pos, "unterminated string")
+			return out.String()
+		case '\\':
+			l.readEscape(&out)
+		default:
+			out.WriteRune(l.ch)
 		}
 	}
-	return l.input[position:l.position]
 }
 
-func isLetter(ch byte) bool {
+// \ の次の文字から始まるエスケープシーケンスを読み、展開した文字を out に書き込む
+func (l *Lexer) readEscape(out *strings.Builder) {
+	pos := l.currentPosition()
+	l.readChar()
+
+	switch l.ch {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case '\\':
+		out.WriteByte('\\')
+	case '"':
+		out.WriteByte('"')
+	case 'u':
+		l.readUnicodeEscape(pos, out)
+	case 0:
+		// 入力の終わりに達したので、閉じていない文字列として readString がエラーにする
+	default:
+		l.addError(pos, fmt.Sprintf("unknown escape sequence \\%c", l.ch))
+		out.WriteRune(l.ch)
+	}
+}
+
+// \u{1F600} のように、波括弧の中に 16 進数でコードポイントを書く
+func (l *Lexer) readUnicodeEscape(pos token.Position, out *strings.Builder) {
+	if l.peekChar() != '{' {
+		l.addError(pos, "invalid unicode escape: expected { after \\u")
+		return
+	}
+	l.readChar()
+
+	var digits strings.Builder
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+		digits.WriteRune(l.ch)
+	}
+
+	if l.peekChar() != '}' || digits.Len() == 0 || digits.Len() > 6 {
+		l.addError(pos, "invalid unicode escape: expected 1 to 6 hex digits followed by }")
+		return
+	}
+	l.readChar()
+
+	code, _ := strconv.ParseUint(digits.String(), 16, 32)
+	if !utf8.ValidRune(rune(code)) {
+		l.addError(pos, fmt.Sprintf("invalid unicode code point U+%X", code))
+		return
+	}
+	out.WriteRune(rune(code))
+}
+
+func isLetter(ch rune) bool {
 	// snake_case is ok
-	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ch == '_'
+	if ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ch == '_' {
+		return true
+	}
+
+	// 日本語などの Unicode の文字も識別子に使える
+	return ch >= utf8.RuneSelf && unicode.IsLetter(ch)
 }
 
-func (l *Lexer) readNumber() string {
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F')
+}
+
+// 整数 (123) または浮動小数点数 (1.5, 2e10, 1.5e-3) を読む
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
-	for isDigit(l.ch) {
+	tokenType := token.TokenType(token.INT)
+
+	l.readDigits()
+
+	// "1." や "1.foo" は小数として扱わない
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
 		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		// 指数部に数字が続かなければ、e 以降は識別子として読ませる
+		offset := 1
+		if sign := l.peekCharAt(1); sign == '+' || sign == '-' {
+			offset = 2
+		}
+
+		if isDigit(l.peekCharAt(offset)) {
+			tokenType = token.FLOAT
+			for i := 0; i < offset; i++ {
+				l.readChar()
+			}
+			l.readDigits()
+		}
 	}
 
 	// 非数字の手前まで position を進めて、そこまでの文字列スライスを返す
-	return l.input[position:l.position]
+	return l.input[position:l.position], tokenType
 }
 
-func isDigit(ch byte) bool {
+func (l *Lexer) readDigits() {
+	for isDigit(l.ch) {
+		l.readChar()
+	}
+}
+
+func isDigit(ch rune) bool {
 	return ('0' <= ch && ch <= '9')
 }
 
@@ -158,11 +384,94 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
-// 先読み文字を返す (peek: 覗き見)
-func (l *Lexer) peekChar() byte {
-	if l.readPosition >= len(l.input) {
-		return 0
+// 空白とコメントを読み飛ばし、読み飛ばしたコメントを返す
+func (l *Lexer) skipWhitespaceAndComments() []token.Comment {
+	var comments []token.Comment
+
+	for {
+		l.skipWhitespace()
+
+		if !l.atComment() {
+			return comments
+		}
+		comments = append(comments, l.readComment())
+	}
+}
+
+// トークンの後ろから行末までにあるコメントを読む
+// 改行は読まずに残すので、次の行のコメントは次のトークンの前のコメントになる
+func (l *Lexer) readTrailingComments() []token.Comment {
+	var comments []token.Comment
+
+	for {
+		for l.ch == ' ' || l.ch == '\t' || l.ch == '\r' {
+			l.readChar()
+		}
+
+		if !l.atComment() {
+			return comments
+		}
+
+		comment := l.readComment()
+		comments = append(comments, comment)
+
+		// 行コメントと複数行にわたるブロックコメントは行末まで続く
+		if !strings.HasPrefix(comment.Text, "/*") || comment.End.Line != comment.Pos.Line {
+			return comments
+		}
+	}
+}
+
+// 行コメント (// か #) またはブロックコメント (/* */) の先頭にいるか
+func (l *Lexer) atComment() bool {
+	return l.ch == '#' || (l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*'))
+}
+
+// atComment で確認してから呼ぶ
+func (l *Lexer) readComment() token.Comment {
+	pos := l.currentPosition()
+	position := l.position
+
+	if l.ch == '/' && l.peekChar() == '*' {
+		l.readChar()
+		l.readChar()
+
+		for !(l.ch == '*' && l.peekChar() == '/') {
+			if l.ch == 0 {
+				l.addError(pos, "unterminated block comment")
+				return token.Comment{Text: l.input[position:l.position], Pos: pos, End: l.currentPosition()}
+			}
+			l.readChar()
+		}
+
+		l.readChar()
+		l.readChar()
 	} else {
-		return l.input[l.readPosition]
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+	}
+
+	return token.Comment{Text: l.input[position:l.position], Pos: pos, End: l.currentPosition()}
+}
+
+// 先読み文字を返す (peek: 覗き見)
+func (l *Lexer) peekChar() rune {
+	return l.peekCharAt(1)
+}
+
+// n 文字先の文字を返す (peekCharAt(1) が次の文字)
+func (l *Lexer) peekCharAt(n int) rune {
+	idx := l.readPosition
+	for i := 1; ; i++ {
+		if idx >= len(l.input) {
+			return 0
+		}
+
+		ch, width := utf8.DecodeRuneInString(l.input[idx:])
+		if i == n {
+			return ch
+		}
+		idx += width
 	}
 }
@@ -15,7 +15,7 @@ let add = fn(x, y) {
 };
 
 let result = add(five, ten);
-!-/*5;
+!-/ *5;
 5 < 10 > 5;
 
 if (5 < 10) {
@@ -166,3 +166,463 @@ macro(x, y) { x + y; };
 		}
 	}
 }
+
+func TestTokenPosition(t *testing.T) {
+	input := `let x = 5;
+  "ab" == x;`
+
+	tests := []struct {
+		expectedType token.TokenType
+		expectedPos  string
+		expectedEnd  string
+	}{
+		{token.LET, "test.mk:1:1", "test.mk:1:4"},
+		{token.IDENT, "test.mk:1:5", "test.mk:1:6"},
+		{token.ASSIGN, "test.mk:1:7", "test.mk:1:8"},
+		{token.INT, "test.mk:1:9", "test.mk:1:10"},
+		{token.SEMICOLON, "test.mk:1:10", "test.mk:1:11"},
+		{token.STRING, "test.mk:2:3", "test.mk:2:7"},
+		{token.EQ, "test.mk:2:8", "test.mk:2:10"},
+		{token.IDENT, "test.mk:2:11", "test.mk:2:12"},
+		{token.SEMICOLON, "test.mk:2:12", "test.mk:2:13"},
+		{token.EOF, "test.mk:2:13", "test.mk:2:14"},
+	}
+
+	l := NewWithFilename("test.mk", input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Pos.String() != tt.expectedPos {
+			t.Errorf("tests[%d] - position wrong. expected = %q, got = %q", i, tt.expectedPos, tok.Pos.String())
+		}
+
+		if tok.End.String() != tt.expectedEnd {
+			t.Errorf("tests[%d] - end position wrong. expected = %q, got = %q", i, tt.expectedEnd, tok.End.String())
+		}
+	}
+}
+
+func TestNumberTokens(t *testing.T) {
+	input := `5 3.14 0.5 1e10 2.5E-3 7e+2 1.foo 3e x.5`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "5"},
+		{token.FLOAT, "3.14"},
+		{token.FLOAT, "0.5"},
+		{token.FLOAT, "1e10"},
+		{token.FLOAT, "2.5E-3"},
+		{token.FLOAT, "7e+2"},
+		{token.INT, "1"},
+		{token.DOT, "."},
+		{token.IDENT, "foo"},
+		{token.INT, "3"},
+		{token.IDENT, "e"},
+		{token.IDENT, "x"},
+		{token.DOT, "."},
+		{token.INT, "5"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected = %q, got = %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestAssignTokens(t *testing.T) {
+	input := `x = 1; x += 2; x -= 3; x *= 4; x /= 5; x == 6;`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "x"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.MINUS_ASSIGN, "-="},
+		{token.INT, "3"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.INT, "4"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.SLASH_ASSIGN, "/="},
+		{token.INT, "5"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.EQ, "=="},
+		{token.INT, "6"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected = %q, got = %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestLogicalTokens(t *testing.T) {
+	input := `a && b || !c; a & b`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.AND, "&&"},
+		{token.IDENT, "b"},
+		{token.OR, "||"},
+		{token.BANG, "!"},
+		{token.IDENT, "c"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.BIT_AND, "&"},
+		{token.IDENT, "b"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected = %q, got = %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestArithmeticTokens(t *testing.T) {
+	input := `a <= b >= c % d ** e & f | g ^ h << i >> ~j < k > l * m`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "b"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "c"},
+		{token.PERCENT, "%"},
+		{token.IDENT, "d"},
+		{token.POWER, "**"},
+		{token.IDENT, "e"},
+		{token.BIT_AND, "&"},
+		{token.IDENT, "f"},
+		{token.BIT_OR, "|"},
+		{token.IDENT, "g"},
+		{token.BIT_XOR, "^"},
+		{token.IDENT, "h"},
+		{token.SHIFT_LEFT, "<<"},
+		{token.IDENT, "i"},
+		{token.SHIFT_RIGHT, ">>"},
+		{token.TILDE, "~"},
+		{token.IDENT, "j"},
+		{token.LT, "<"},
+		{token.IDENT, "k"},
+		{token.GT, ">"},
+		{token.IDENT, "l"},
+		{token.ASTERISK, "*"},
+		{token.IDENT, "m"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected = %q, got = %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestModuleTokens(t *testing.T) {
+	input := `import "lib/math" as m; export let pi = m.pi; 1.5.x`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IMPORT, "import"},
+		{token.STRING, "lib/math"},
+		{token.IDENT, "as"},
+		{token.IDENT, "m"},
+		{token.SEMICOLON, ";"},
+		{token.EXPORT, "export"},
+		{token.LET, "let"},
+		{token.IDENT, "pi"},
+		{token.ASSIGN, "="},
+		{token.IDENT, "m"},
+		{token.DOT, "."},
+		{token.IDENT, "pi"},
+		{token.SEMICOLON, ";"},
+		{token.FLOAT, "1.5"},
+		{token.DOT, "."},
+		{token.IDENT, "x"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected = %q, got = %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `#!/usr/bin/env monkey
+// 加算
+let x = 1 + /* inline */ 2; // 末尾
+/* 複数行の
+   コメント */ x /= 2 # done
+`
+
+	tests := []struct {
+		expectedType     token.TokenType
+		expectedLiteral  string
+		expectedLeading  []string
+		expectedTrailing []string
+	}{
+		{token.LET, "let", []string{"#!/usr/bin/env monkey", "// 加算"}, nil},
+		{token.IDENT, "x", nil, nil},
+		{token.ASSIGN, "=", nil, nil},
+		{token.INT, "1", nil, nil},
+		{token.PLUS, "+", nil, []string{"/* inline */"}},
+		{token.INT, "2", nil, nil},
+		{token.SEMICOLON, ";", nil, []string{"// 末尾"}},
+		{token.IDENT, "x", []string{"/* 複数行の\n   コメント */"}, nil},
+		{token.SLASH_ASSIGN, "/=", nil, nil},
+		{token.INT, "2", nil, []string{"# done"}},
+		{token.EOF, "", nil, nil},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected = %q, got = %q", i, tt.expectedLiteral, tok.Literal)
+		}
+
+		testComments(t, i, "leading", tok.LeadingComments, tt.expectedLeading)
+		testComments(t, i, "trailing", tok.TrailingComments, tt.expectedTrailing)
+	}
+
+	if len(l.Errors()) != 0 {
+		t.Errorf("unexpected lexer errors: %v", l.Errors())
+	}
+}
+
+func testComments(t *testing.T, i int, kind string, comments []token.Comment, expected []string) {
+	t.Helper()
+
+	if len(comments) != len(expected) {
+		t.Errorf("tests[%d] - wrong number of %s comments. expected = %d, got = %d (%+v)", i, kind, len(expected), len(comments), comments)
+		return
+	}
+
+	for j, text := range expected {
+		if comments[j].Text != text {
+			t.Errorf("tests[%d] - %s comment %d wrong. expected = %q, got = %q", i, kind, j, text, comments[j].Text)
+		}
+	}
+}
+
+func TestCommentPosition(t *testing.T) {
+	l := New("1\n  /* a\nb */ 2")
+
+	l.NextToken()
+	tok := l.NextToken()
+
+	if len(tok.LeadingComments) != 1 {
+		t.Fatalf("wrong number of leading comments. got = %d", len(tok.LeadingComments))
+	}
+
+	comment := tok.LeadingComments[0]
+	if comment.Pos.String() != "2:3" {
+		t.Errorf("comment position wrong. expected = %q, got = %q", "2:3", comment.Pos.String())
+	}
+	if comment.End.String() != "3:5" {
+		t.Errorf("comment end position wrong. expected = %q, got = %q", "3:5", comment.End.String())
+	}
+	if tok.Pos.String() != "3:6" {
+		t.Errorf("token position wrong. expected = %q, got = %q", "3:6", tok.Pos.String())
+	}
+}
+
+func TestUnterminatedBlockComment(t *testing.T) {
+	l := New("1 + /* never closed\n2")
+
+	var tok token.Token
+	for tok = l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+	}
+
+	errors := l.Errors()
+	if len(errors) != 1 {
+		t.Fatalf("wrong number of errors. expected = 1, got = %d (%v)", len(errors), errors)
+	}
+
+	if errors[0] != "1:5: unterminated block comment" {
+		t.Errorf("wrong error. expected = %q, got = %q", "1:5: unterminated block comment", errors[0])
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"hello"`, "hello"},
+		{`"a\nb\tc\rd"`, "a\nb\tc\rd"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"C:\\path"`, `C:\path`},
+		{`"\u{65E5}\u{672c}"`, "日本"},
+		{`"\u{1F600}!"`, "😀!"},
+		{`"日本語"`, "日本語"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != token.STRING {
+			t.Fatalf("tokentype wrong for %s. expected = %q, got = %q", tt.input, token.STRING, tok.Type)
+		}
+
+		if tok.Literal != tt.expected {
+			t.Errorf("literal wrong for %s. expected = %q, got = %q", tt.input, tt.expected, tok.Literal)
+		}
+
+		if len(l.Errors()) != 0 {
+			t.Errorf("unexpected lexer errors for %s: %v", tt.input, l.Errors())
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"abc`, "1:1: unterminated string"},
+		{`x = "abc\"`, "1:5: unterminated string"},
+		{`"a\qb"`, "1:3: unknown escape sequence \\q"},
+		{`"\u0041"`, "1:2: invalid unicode escape: expected { after \\u"},
+		{`"\u{}"`, "1:2: invalid unicode escape: expected 1 to 6 hex digits followed by }"},
+		{`"\u{41"`, "1:2: invalid unicode escape: expected 1 to 6 hex digits followed by }"},
+		{`"\u{D800}"`, "1:2: invalid unicode code point U+D800"},
+		{`"\u{110000}"`, "1:2: invalid unicode code point U+110000"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		}
+
+		errors := l.Errors()
+		if len(errors) == 0 {
+			t.Errorf("no lexer errors for %s", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %s. expected = %q, got = %q", tt.input, tt.expected, errors[0])
+		}
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	input := `let 名前 = "値"; 名前 → café`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedPos     string
+	}{
+		{token.LET, "let", "1:1"},
+		{token.IDENT, "名前", "1:5"},
+		{token.ASSIGN, "=", "1:8"},
+		{token.STRING, "値", "1:10"},
+		{token.SEMICOLON, ";", "1:13"},
+		{token.IDENT, "名前", "1:15"},
+		{token.ILLEGAL, "→", "1:18"},
+		{token.IDENT, "café", "1:20"},
+		{token.EOF, "", "1:24"},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected = %q, got = %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected = %q, got = %q", i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Pos.String() != tt.expectedPos {
+			t.Errorf("tests[%d] - position wrong. expected = %q, got = %q", i, tt.expectedPos, tok.Pos.String())
+		}
+	}
+}
@@ -2,17 +2,225 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
 	"monkey/repl"
+	"monkey/vm"
 	"os"
 	"os/user"
+	"strings"
 )
 
+// プロセスの終了コード
+const (
+	exitOK           = 0
+	exitRuntimeError = 1  // 評価中のエラー
+	exitParseError   = 2  // 構文エラー・マクロ展開エラー・コンパイルエラー
+	exitUsage        = 64 // コマンドライン引数の誤り
+	exitNoInput      = 66 // スクリプトファイルが読めない
+)
+
+const usage = `Usage:
+  monkey [options]                       start the REPL (or run stdin when it is not a terminal)
+  monkey [options] run <file> [args...]  run a script file
+  monkey [options] -e <expr> [args...]   evaluate an expression and print the result
+
+Options:
+  --engine=eval|vm  execute with the tree-walking evaluator (default) or the bytecode VM
+`
+
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+type runner struct {
+	engine string // repl.EngineEval or repl.EngineVM
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	r := &runner{engine: repl.EngineEval, stdout: stdout, stderr: stderr}
+
+	// サブコマンドより前にあるオプションを読む
+	for len(args) > 0 && strings.HasPrefix(args[0], "--engine") {
+		var engine string
+		if strings.HasPrefix(args[0], "--engine=") {
+			engine = strings.TrimPrefix(args[0], "--engine=")
+			args = args[1:]
+		} else if args[0] == "--engine" && len(args) >= 2 {
+			engine = args[1]
+			args = args[2:]
+		}
+
+		if engine != repl.EngineEval && engine != repl.EngineVM {
+			fmt.Fprintf(stderr, "monkey: unknown engine %q\n", engine)
+			io.WriteString(stderr, usage)
+			return exitUsage
+		}
+		r.engine = engine
+	}
+
+	if len(args) == 0 {
+		if !isTerminal(stdin) {
+			// パイプから読む場合はプロンプトを出さずにスクリプトとして実行する
+			src, err := io.ReadAll(stdin)
+			if err != nil {
+				fmt.Fprintf(stderr, "monkey: %s\n", err)
+				return exitNoInput
+			}
+			return r.runSource("<stdin>", string(src), nil, false)
+		}
+
+		r.startREPL(stdin)
+		return exitOK
+	}
+
+	switch args[0] {
+	case "run":
+		if len(args) < 2 {
+			io.WriteString(stderr, usage)
+			return exitUsage
+		}
+
+		src, err := os.ReadFile(args[1])
+		if err != nil {
+			fmt.Fprintf(stderr, "monkey: %s\n", err)
+			return exitNoInput
+		}
+		return r.runSource(args[1], string(src), args[2:], false)
+	case "-e":
+		if len(args) < 2 {
+			io.WriteString(stderr, usage)
+			return exitUsage
+		}
+		return r.runSource("-e", args[1], args[2:], true)
+	case "-h", "--help", "help":
+		io.WriteString(stdout, usage)
+		return exitOK
+	default:
+		io.WriteString(stderr, usage)
+		return exitUsage
+	}
+}
+
+func (r *runner) startREPL(in io.Reader) {
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Printf("Hello %s! This is the Monkey programming language!\n", user.Username)
-	repl.Start(os.Stdin, os.Stdout)
+	fmt.Fprintf(r.stdout, "Hello %s! This is the Monkey programming language!\n", user.Username)
+	repl.StartWithOptions(in, r.stdout, repl.Options{
+		HistoryFile: repl.DefaultHistoryFile(),
+		Engine:      r.engine,
+	})
+}
+
+// ソースを構文解析 -> マクロ展開 -> 評価し、結果に応じた終了コードを返す
+// printResult が true なら評価結果を stdout に出力する (-e 用)
+func (r *runner) runSource(filename, src string, scriptArgs []string, printResult bool) int {
+	l := lexer.NewWithFilename(filename, src)
+	p := parser.New(l)
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		io.WriteString(r.stderr, "parser errors:\n")
+		for _, msg := range p.Errors() {
+			io.WriteString(r.stderr, "\t"+msg+"\n")
+		}
+		return exitParseError
+	}
+
+	macroEnv := object.NewEnvironment()
+	evaluator.DefineMacros(program, macroEnv)
+	expanded, expandErr := evaluator.ExpandMacros(program, macroEnv)
+	if expandErr != nil {
+		io.WriteString(r.stderr, expandErr.StackTrace()+"\n")
+		return exitParseError
+	}
+
+	// puts は stdout に出力する
+	builtins := evaluator.NewBuiltins(evaluator.OSHost{Out: r.stdout}, nil)
+
+	var evaluated object.Object
+	if r.engine == repl.EngineVM {
+		result, err := runVM(expanded.(*ast.Program), newArgsArray(scriptArgs), builtins)
+		if err != nil {
+			fmt.Fprintf(r.stderr, "compile error: %s\n", err)
+			return exitParseError
+		}
+		evaluated = result
+	} else {
+		env := object.NewEnvironment()
+		env.Execution().Builtins = builtins
+		env.Set("args", newArgsArray(scriptArgs))
+		evaluated = evaluator.Eval(expanded, env)
+	}
+
+	if errObj, ok := evaluated.(*object.Error); ok {
+		io.WriteString(r.stderr, errObj.StackTrace()+"\n")
+		return exitRuntimeError
+	}
+
+	if printResult && evaluated != nil && evaluated != evaluator.NULL {
+		io.WriteString(r.stdout, evaluated.Inspect()+"\n")
+	}
+
+	return exitOK
+}
+
+// プログラムをコンパイルして VM で実行する
+// 評価器と同じく、最後の文が式でなければ結果は nil になる
+func runVM(program *ast.Program, argsArray *object.Array, builtins map[string]*object.Builtin) (object.Object, error) {
+	symbolTable := compiler.NewGlobalSymbolTable()
+	argsSymbol := symbolTable.Define("args")
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	if err := comp.Compile(program); err != nil {
+		return nil, err
+	}
+
+	globals := make([]object.Object, vm.GlobalsSize)
+	globals[argsSymbol.Index] = argsArray
+
+	machine := vm.NewWithGlobalsStore(comp.Bytecode(), globals)
+	machine.SetBuiltins(builtins)
+	if err := machine.Run(); err != nil {
+		return &object.Error{Kind: object.RUNTIME_ERROR, Message: err.Error()}, nil
+	}
+
+	result := machine.Result()
+	if _, ok := result.(*object.Error); !ok && !repl.EndsWithExpression(program) {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// スクリプト引数を Monkey の文字列配列に変換する
+func newArgsArray(scriptArgs []string) *object.Array {
+	elements := make([]object.Object, len(scriptArgs))
+	for i, arg := range scriptArgs {
+		elements[i] = &object.String{Value: arg}
+	}
+	return &object.Array{Elements: elements}
+}
+
+func isTerminal(in io.Reader) bool {
+	f, ok := in.(*os.File)
+	if !ok {
+		return false
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunExitCode(t *testing.T) {
+	tests := []struct {
+		args           []string
+		expectedCode   int
+		expectedStdout string
+		expectedStderr string
+	}{
+		{[]string{"-e", "1 + 2"}, exitOK, "3\n", ""},
+		{[]string{"--engine=vm", "-e", "1 + 2"}, exitOK, "3\n", ""},
+		{[]string{"--engine", "vm", "-e", "let x = 1"}, exitOK, "", ""},
+		{[]string{"--engine=vm", "-e", "args[1]", "a", "b"}, exitOK, "b\n", ""},
+		{[]string{"--engine=vm", "-e", "1 + true"}, exitRuntimeError, "", "ERROR: TypeError: Type Mismatch: INTEGER + BOOLEAN\n    at <main> (-e:1:3)"},
+		{[]string{"--engine=vm", "-e", "quote(1)"}, exitParseError, "", "compile error: -e:1:6: quote is not supported by the compiler"},
+		{[]string{"--engine=fast", "-e", "1"}, exitUsage, "", "unknown engine"},
+		{[]string{"-e", "len(args)", "a", "b"}, exitOK, "2\n", ""},
+		{[]string{"-e", "puts(1, \"a\")"}, exitOK, "1\na\n", ""},
+		{[]string{"--engine=vm", "-e", "puts(1, \"a\")"}, exitOK, "1\na\n", ""},
+		{[]string{"-e", "args[1]", "a", "b"}, exitOK, "b\n", ""},
+		{[]string{"-e", "let x = ;"}, exitParseError, "", "-e:1:9: no prefix parse function for ; found."},
+		{[]string{"-e", "1 + true"}, exitRuntimeError, "", "ERROR: TypeError: Type Mismatch: INTEGER + BOOLEAN\n    at <main> (-e:1:3)"},
+		{[]string{"-e"}, exitUsage, "", "Usage:"},
+		{[]string{"unknown"}, exitUsage, "", "Usage:"},
+		{[]string{"run", "no-such-file.mk"}, exitNoInput, "", "no-such-file.mk"},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := run(tt.args, strings.NewReader(""), &stdout, &stderr)
+
+		if code != tt.expectedCode {
+			t.Errorf("%v: wrong exit code. expected = %d, got = %d", tt.args, tt.expectedCode, code)
+		}
+
+		if stdout.String() != tt.expectedStdout {
+			t.Errorf("%v: wrong stdout. expected = %q, got = %q", tt.args, tt.expectedStdout, stdout.String())
+		}
+
+		if !strings.Contains(stderr.String(), tt.expectedStderr) {
+			t.Errorf("%v: stderr does not contain %q. got = %q", tt.args, tt.expectedStderr, stderr.String())
+		}
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.mk")
+	src := "let add = fn(a, b) { a + b };\nlet x = first(args);\nadd(x, 1);\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "ERROR: TypeError: Type Mismatch: STRING + INTEGER\n" +
+		"    at add (" + path + ":1:24)\n" +
+		"    at <main> (" + path + ":3:4)\n"
+
+	for _, engine := range []string{"--engine=eval", "--engine=vm"} {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{engine, "run", path, "1"}, strings.NewReader(""), &stdout, &stderr)
+
+		if code != exitRuntimeError {
+			t.Fatalf("[%s]: wrong exit code. expected = %d, got = %d", engine, exitRuntimeError, code)
+		}
+
+		if stderr.String() != expected {
+			t.Errorf("[%s]: wrong stderr. expected = %q, got = %q", engine, expected, stderr.String())
+		}
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run(nil, strings.NewReader("let a = 1;\na + 1;\n"), &stdout, &stderr)
+
+	if code != exitOK {
+		t.Fatalf("wrong exit code. expected = %d, got = %d (%s)", exitOK, code, stderr.String())
+	}
+
+	if stdout.String() != "" {
+		t.Errorf("stdin script should not print prompt or result. got = %q", stdout.String())
+	}
+}
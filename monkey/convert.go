@@ -0,0 +1,207 @@
+package monkey
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"monkey/evaluator"
+	"monkey/object"
+	"reflect"
+	"sort"
+)
+
+// Go の値を Monkey のオブジェクトに変換する
+//
+//	nil                       -> NULL
+//	bool                      -> BOOLEAN
+//	整数型 (int, uint8 など)  -> INTEGER
+//	*big.Int                  -> INTEGER
+//	float32, float64          -> FLOAT
+//	string                    -> STRING
+//	スライス・配列            -> ARRAY
+//	マップ                    -> HASH (キーの昇順に並べる)
+//	object.Object             -> そのまま
+func ToObject(value interface{}) (object.Object, error) {
+	switch v := value.(type) {
+	case nil:
+		return evaluator.NULL, nil
+	case object.Object:
+		return v, nil
+	case bool:
+		return boolObject(v), nil
+	case string:
+		return &object.String{Value: v}, nil
+	case int64:
+		return &object.Integer{Value: v}, nil
+	case float64:
+		return &object.Float{Value: v}, nil
+	case *big.Int:
+		if v == nil {
+			return evaluator.NULL, nil
+		}
+		return object.NewInteger(new(big.Int).Set(v)), nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: rv.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return object.NewInteger(new(big.Int).SetUint64(rv.Uint())), nil
+		}
+		return &object.Integer{Value: int64(rv.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: rv.Float()}, nil
+	case reflect.Bool:
+		return boolObject(rv.Bool()), nil
+	case reflect.String:
+		return &object.String{Value: rv.String()}, nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return evaluator.NULL, nil
+		}
+		elements := make([]object.Object, rv.Len())
+		for i := range elements {
+			el, err := ToObject(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = el
+		}
+		return &object.Array{Elements: elements}, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return evaluator.NULL, nil
+		}
+		return mapToHash(rv)
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return evaluator.NULL, nil
+		}
+		return ToObject(rv.Elem().Interface())
+	default:
+		return nil, fmt.Errorf("cannot convert %T to a Monkey object", value)
+	}
+}
+
+// Go のマップは順序を持たないので、結果が毎回同じになるようにキーを並べ替えてから追加する
+func mapToHash(rv reflect.Value) (object.Object, error) {
+	type entry struct {
+		key   object.Object
+		value reflect.Value
+	}
+
+	entries := []entry{}
+	iter := rv.MapRange()
+	for iter.Next() {
+		key, err := ToObject(iter.Key().Interface())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key: key, value: iter.Value()})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].key, entries[j].key
+		if a.Type() != b.Type() {
+			return a.Type() < b.Type()
+		}
+		if less, ok := evaluator.EvalInfix("<", a, b).(*object.Boolean); ok {
+			return less.Value
+		}
+		return a.Inspect() < b.Inspect()
+	})
+
+	hash := object.NewHash()
+	for _, e := range entries {
+		hashKey, ok := object.HashKeyOf(e.key)
+		if !ok {
+			return nil, fmt.Errorf("unusable as hash key: %s", e.key.Type())
+		}
+
+		value, err := ToObject(e.value.Interface())
+		if err != nil {
+			return nil, err
+		}
+		hash.Set(hashKey, object.HashPair{Key: e.key, Value: value})
+	}
+
+	return hash, nil
+}
+
+// Monkey のオブジェクトを Go の値に変換する
+//
+//	NULL     -> nil
+//	BOOLEAN  -> bool
+//	INTEGER  -> int64 (int64 に収まらなければ *big.Int)
+//	FLOAT    -> float64
+//	STRING   -> string
+//	ARRAY    -> []interface{}
+//	HASH     -> map[string]interface{} (キーは STRING に限る)
+//
+// 関数などそれ以外のオブジェクトと、自分自身を含む配列やハッシュはエラーになる
+func FromObject(obj object.Object) (interface{}, error) {
+	return fromObject(obj, map[object.Object]bool{})
+}
+
+// visiting は変換している途中の配列とハッシュ
+func fromObject(obj object.Object, visiting map[object.Object]bool) (interface{}, error) {
+	switch obj.(type) {
+	case *object.Array, *object.Hash:
+		if visiting[obj] {
+			return nil, fmt.Errorf("cannot convert %s that contains itself to a Go value", obj.Type())
+		}
+		visiting[obj] = true
+		defer delete(visiting, obj)
+	}
+
+	switch obj := obj.(type) {
+	case nil, *object.Null:
+		return nil, nil
+	case *object.Boolean:
+		return obj.Value, nil
+	case *object.Integer:
+		return obj.Value, nil
+	case *object.BigInteger:
+		return new(big.Int).Set(obj.Value), nil
+	case *object.Float:
+		return obj.Value, nil
+	case *object.String:
+		return obj.Value, nil
+	case *object.Array:
+		values := make([]interface{}, len(obj.Elements))
+		for i, el := range obj.Elements {
+			value, err := fromObject(el, visiting)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	case *object.Hash:
+		values := make(map[string]interface{}, len(obj.Keys))
+		for _, pair := range obj.OrderedPairs() {
+			key, ok := pair.Key.(*object.String)
+			if !ok {
+				return nil, fmt.Errorf("cannot convert HASH with %s keys to a Go map", pair.Key.Type())
+			}
+
+			value, err := fromObject(pair.Value, visiting)
+			if err != nil {
+				return nil, err
+			}
+			values[key.Value] = value
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %s to a Go value", obj.Type())
+	}
+}
+
+func boolObject(value bool) *object.Boolean {
+	if value {
+		return evaluator.TRUE
+	}
+	return evaluator.FALSE
+}
@@ -0,0 +1,189 @@
+// Package monkey は Go のプログラムに Monkey を組み込むための API
+//
+//	interp := monkey.New()
+//	interp.SetGlobal("limit", 10)
+//	interp.Eval(`let check = fn(x) { x < limit };`)
+//	result, err := interp.Call("check", 3)
+//
+// Eval を繰り返し呼ぶと、変数やマクロは REPL と同じように前の入力から引き継がれる。
+// 信頼できないスクリプトを実行する場合は、MaxSteps や MaxDepth を設定し、
+// EvalContext / CallContext でタイムアウトを指定する。制限を超えると LimitError を返す。
+// Host と Builtins で、スクリプトから使える I/O と組み込み関数を決められる
+package monkey
+
+import (
+	"context"
+	"fmt"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"strings"
+)
+
+// ひとつの実行環境 (グローバル変数とマクロ) を持つインタプリタ
+// 並行に使うことはできない
+type Interpreter struct {
+	env      *object.Environment
+	macroEnv *object.Environment
+
+	// エラーの位置やモジュールの相対パスの基準に使うファイル名
+	Filename string
+
+	// Eval や Call の 1 回ごとの実行の制限 (0 なら制限しない)
+	MaxSteps int64 // 評価するノードの数の上限
+	MaxDepth int   // 関数呼び出しの深さの上限
+
+	// puts や read_file などが I/O に使う Host (nil なら OS をそのまま使う)
+	Host evaluator.Host
+	// スクリプトに公開する組み込み関数 (nil ならすべて。RegisterBuiltin で登録したものは常に公開する)
+	Builtins evaluator.BuiltinPolicy
+}
+
+func New() *Interpreter {
+	return &Interpreter{
+		env:      object.NewEnvironment(),
+		macroEnv: object.NewEnvironment(),
+	}
+}
+
+// 構文エラー (マクロ展開のエラーは RuntimeError として返す)
+type ParseError struct {
+	Messages []string
+}
+
+func (e *ParseError) Error() string {
+	return "parser errors: " + strings.Join(e.Messages, "; ")
+}
+
+// Monkey のプログラムの実行中に起きたエラー
+type RuntimeError struct {
+	Err *object.Error
+}
+
+func (e *RuntimeError) Error() string {
+	msg := e.Err.Message
+	if e.Err.Kind != "" {
+		msg = string(e.Err.Kind) + ": " + msg
+	}
+	if e.Err.Pos.IsValid() {
+		msg = e.Err.Pos.String() + ": " + msg
+	}
+	return msg
+}
+
+// src を構文解析 -> マクロ展開 -> 評価し、最後の式の値を返す
+// 値を持たない文で終わる場合は NULL を返す
+func (i *Interpreter) Eval(src string) (object.Object, error) {
+	return i.EvalContext(context.Background(), src)
+}
+
+// Eval と同じだが、ctx がキャンセルされたら評価を中断する
+func (i *Interpreter) EvalContext(ctx context.Context, src string) (_ object.Object, err error) {
+	defer i.recoverPanic(&err)
+
+	p := parser.New(lexer.NewWithFilename(i.Filename, src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &ParseError{Messages: p.Errors()}
+	}
+
+	evaluator.DefineMacros(program, i.macroEnv)
+	expanded, expandErr := evaluator.ExpandMacros(program, i.macroEnv)
+	if expandErr != nil {
+		return nil, &RuntimeError{Err: expandErr}
+	}
+
+	i.prepare(ctx)
+	return result(evaluator.Eval(expanded, i.env))
+}
+
+// グローバル変数 (または組み込み関数) の fnName を args を引数にして呼び出す
+// args は ToObject で変換する
+func (i *Interpreter) Call(fnName string, args ...interface{}) (object.Object, error) {
+	return i.CallContext(context.Background(), fnName, args...)
+}
+
+// Call と同じだが、ctx がキャンセルされたら実行を中断する
+func (i *Interpreter) CallContext(ctx context.Context, fnName string, args ...interface{}) (_ object.Object, err error) {
+	defer i.recoverPanic(&err)
+
+	i.prepare(ctx)
+
+	fn, ok := i.Global(fnName)
+	if !ok {
+		fn, ok = evaluator.LookupBuiltin(i.env.Execution(), fnName)
+	}
+	if !ok {
+		return nil, fmt.Errorf("monkey: function %s is not defined", fnName)
+	}
+
+	objects := make([]object.Object, len(args))
+	for n, arg := range args {
+		obj, err := ToObject(arg)
+		if err != nil {
+			return nil, fmt.Errorf("monkey: argument %d to %s: %w", n+1, fnName, err)
+		}
+		objects[n] = obj
+	}
+
+	return result(evaluator.ApplyFunctionIn(i.env.Execution(), fn, objects...))
+}
+
+// グローバル変数に Go の値を ToObject で変換して束縛する
+func (i *Interpreter) SetGlobal(name string, value interface{}) error {
+	obj, err := ToObject(value)
+	if err != nil {
+		return fmt.Errorf("monkey: global %s: %w", name, err)
+	}
+
+	i.env.Set(name, obj)
+	return nil
+}
+
+// グローバル変数の値を返す
+func (i *Interpreter) Global(name string) (object.Object, bool) {
+	return i.env.Get(name)
+}
+
+// Go の関数を組み込み関数として登録する
+// 同じ名前の標準の組み込み関数より優先される
+func (i *Interpreter) RegisterBuiltin(name string, fn object.BuiltinFunction) {
+	i.env.Set(name, &object.Builtin{Fn: fn})
+}
+
+// 実行の制限と組み込み関数を設定し、ステップ数を数え直す
+func (i *Interpreter) prepare(ctx context.Context) {
+	exec := i.env.Execution()
+	exec.Reset(object.Limits{
+		Context:  ctx,
+		MaxSteps: i.MaxSteps,
+		MaxDepth: i.MaxDepth,
+	})
+
+	host := i.Host
+	if host == nil {
+		host = evaluator.OSHost{}
+	}
+	exec.Builtins = evaluator.NewBuiltins(host, i.Builtins)
+	exec.ReadModule = evaluator.NewModuleReader(host, i.Builtins)
+}
+
+// インタプリタの不具合による panic を、呼び出し元のプロセスを落とさずに RuntimeError として返す
+func (i *Interpreter) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		i.env.Execution().Depth = 0
+		*err = &RuntimeError{Err: &object.Error{Kind: object.RUNTIME_ERROR, Message: fmt.Sprintf("internal error: %v", r)}}
+	}
+}
+
+// 評価結果を Go の戻り値の形にする
+func result(evaluated object.Object) (object.Object, error) {
+	if err, ok := evaluated.(*object.Error); ok {
+		return nil, &RuntimeError{Err: err}
+	}
+	if evaluated == nil {
+		return evaluator.NULL, nil
+	}
+	return evaluated, nil
+}
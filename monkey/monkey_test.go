@@ -0,0 +1,398 @@
+package monkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"monkey/evaluator"
+	"monkey/object"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	interp := New()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2", "3"},
+		// 変数とマクロは次の Eval に引き継がれる
+		{"let double = fn(x) { x * 2 };", "null"},
+		{"double(21)", "42"},
+		{"let unless = macro(c, a, b) { quote(if (!(unquote(c))) { unquote(a) } else { unquote(b) }) };", "null"},
+		{"unless(false, 1, 2)", "1"},
+	}
+
+	for _, tt := range tests {
+		result, err := interp.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("Eval(%q) returned error: %s", tt.input, err)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("Eval(%q): expected = %s, got = %s", tt.input, tt.expected, result.Inspect())
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	interp := New()
+	interp.Filename = "rules.mk"
+
+	_, err := interp.Eval("let = 1;")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected ParseError. got = %T (%v)", err, err)
+	}
+	if len(parseErr.Messages) == 0 {
+		t.Errorf("ParseError has no messages")
+	}
+
+	_, err = interp.Eval("1 + true")
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected RuntimeError. got = %T (%v)", err, err)
+	}
+	if runtimeErr.Err.Kind != object.TYPE_ERROR {
+		t.Errorf("wrong error kind. got = %s", runtimeErr.Err.Kind)
+	}
+	expected := "rules.mk:1:3: TypeError: Type Mismatch: INTEGER + BOOLEAN"
+	if err.Error() != expected {
+		t.Errorf("wrong error message. expected = %q, got = %q", expected, err.Error())
+	}
+}
+
+func TestCall(t *testing.T) {
+	interp := New()
+	if _, err := interp.Eval(`
+		let add = fn(a, b) { a + b };
+		let describe = fn(user) { user["name"] + " is " + format("{}", user["age"]) };
+		let fail = fn() { error("boom") };
+	`); err != nil {
+		t.Fatalf("Eval returned error: %s", err)
+	}
+
+	tests := []struct {
+		fnName   string
+		args     []interface{}
+		expected string
+	}{
+		{"add", []interface{}{1, 2}, "3"},
+		{"add", []interface{}{"a", "b"}, "ab"},
+		{"describe", []interface{}{map[string]interface{}{"name": "monkey", "age": 3}}, "monkey is 3"},
+		{"len", []interface{}{[]string{"a", "b"}}, "2"},
+	}
+
+	for _, tt := range tests {
+		result, err := interp.Call(tt.fnName, tt.args...)
+		if err != nil {
+			t.Errorf("Call(%s, %v) returned error: %s", tt.fnName, tt.args, err)
+			continue
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("Call(%s, %v): expected = %s, got = %s", tt.fnName, tt.args, tt.expected, result.Inspect())
+		}
+	}
+
+	if _, err := interp.Call("add", []int{1}, 2); err == nil {
+		t.Errorf("expected error for ARRAY + INTEGER")
+	}
+	if _, err := interp.Call("fail"); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected error from fail. got = %v", err)
+	}
+	if _, err := interp.Call("missing"); err == nil {
+		t.Errorf("expected error for undefined function")
+	}
+	if _, err := interp.Call("add", struct{}{}, 1); err == nil {
+		t.Errorf("expected error for unconvertible argument")
+	}
+}
+
+func TestSetGlobalAndRegisterBuiltin(t *testing.T) {
+	interp := New()
+
+	if err := interp.SetGlobal("config", map[string]interface{}{
+		"limit": int64(10),
+		"names": []string{"a", "b"},
+		"debug": false,
+	}); err != nil {
+		t.Fatalf("SetGlobal returned error: %s", err)
+	}
+	if err := interp.SetGlobal("bad", make(chan int)); err == nil {
+		t.Errorf("expected error for unconvertible value")
+	}
+
+	calls := 0
+	interp.RegisterBuiltin("notify", func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		calls += 1
+		return &object.Integer{Value: int64(len(args))}
+	})
+	// 標準の組み込み関数と同じ名前なら上書きする
+	interp.RegisterBuiltin("len", func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		return &object.String{Value: "overridden"}
+	})
+
+	result, err := interp.Eval(`[config["limit"], config["names"][1], config["debug"], notify(1, 2), len([])]`)
+	if err != nil {
+		t.Fatalf("Eval returned error: %s", err)
+	}
+
+	expected := `[10, b, false, 2, overridden]`
+	if result.Inspect() != expected {
+		t.Errorf("expected = %s, got = %s", expected, result.Inspect())
+	}
+	if calls != 1 {
+		t.Errorf("notify called %d times", calls)
+	}
+
+	global, ok := interp.Global("config")
+	if !ok || global.Type() != object.HASH_OBJ {
+		t.Errorf("Global(config) returned %v, %t", global, ok)
+	}
+}
+
+func TestToObject(t *testing.T) {
+	type score int
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int64(-5), "-5"},
+		{uint8(7), "7"},
+		{score(3), "3"},
+		// int64 に収まらない整数は多倍長整数になる
+		{uint64(1 << 63), "9223372036854775808"},
+		{new(big.Int).Lsh(big.NewInt(1), 70), "1180591620717411303424"},
+		{big.NewInt(5), "5"},
+		{1.5, "1.5"},
+		{float32(0.5), "0.5"},
+		{"text", "text"},
+		{[]interface{}{1, "a", nil}, "[1, a, null]"},
+		{[2]bool{true, false}, "[true, false]"},
+		// マップはキーの昇順に並ぶ
+		{map[string]int{"b": 2, "a": 1, "c": 3}, "{a: 1, b: 2, c: 3}"},
+		{map[int]string{10: "x", 2: "y"}, "{2: y, 10: x}"},
+		{&object.Integer{Value: 1}, "1"},
+	}
+
+	for _, tt := range tests {
+		obj, err := ToObject(tt.input)
+		if err != nil {
+			t.Errorf("ToObject(%#v) returned error: %s", tt.input, err)
+			continue
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("ToObject(%#v): expected = %s, got = %s", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+
+	for _, input := range []interface{}{func() {}, []interface{}{struct{}{}}} {
+		if _, err := ToObject(input); err == nil {
+			t.Errorf("ToObject(%#v): expected error", input)
+		}
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	interp := New()
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"if (false) { 1 }", nil},
+		{"true", true},
+		{"42", int64(42)},
+		{"2 ** 64", new(big.Int).Lsh(big.NewInt(1), 64)},
+		{"2.5", 2.5},
+		{`"s"`, "s"},
+		{`[1, "a", [false]]`, []interface{}{int64(1), "a", []interface{}{false}}},
+		{`{"a": 1, "b": [2]}`, map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2)}}},
+	}
+
+	for _, tt := range tests {
+		obj, err := interp.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("Eval(%q) returned error: %s", tt.input, err)
+		}
+
+		value, err := FromObject(obj)
+		if err != nil {
+			t.Errorf("FromObject(%s) returned error: %s", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, tt.expected) {
+			t.Errorf("FromObject(%s): expected = %#v, got = %#v", tt.input, tt.expected, value)
+		}
+	}
+
+	for _, input := range []string{`fn(x) { x }`, `{1: "a"}`, `[len]`, `let a = [1]; a[0] = a; a`, `let h = {}; h["s"] = [h]; h`} {
+		obj, err := interp.Eval(input)
+		if err != nil {
+			t.Fatalf("Eval(%q) returned error: %s", input, err)
+		}
+		if _, err := FromObject(obj); err == nil {
+			t.Errorf("FromObject(%s): expected error", input)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	interp := New()
+	interp.MaxSteps = 10000
+	interp.MaxDepth = 50
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"while (true) { }", "LimitError: step limit exceeded (10000 steps)"},
+		{"let f = fn(n) { f(n + 1) }; f(0)", "RuntimeError: stack overflow. call depth exceeds 50"},
+		// 組み込み関数の中の処理も数える
+		{`len(repeat(repeat("x", 1000000), 2000))`, "LimitError: step limit exceeded (10000 steps)"},
+	}
+
+	for _, tt := range tests {
+		_, err := interp.Eval(tt.input)
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) {
+			t.Fatalf("Eval(%q): expected RuntimeError. got = %v", tt.input, err)
+		}
+
+		got := string(runtimeErr.Err.Kind) + ": " + runtimeErr.Err.Message
+		if got != tt.expected {
+			t.Errorf("Eval(%q): expected = %q, got = %q", tt.input, tt.expected, got)
+		}
+	}
+
+	// ステップ数は Eval や Call ごとに数え直す
+	if _, err := interp.Eval("let count = fn(n) { let i = 0; while (i < n) { i += 1 }; i };"); err != nil {
+		t.Fatalf("Eval returned error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := interp.Call("count", 100); err != nil {
+			t.Fatalf("Call returned error: %s", err)
+		}
+	}
+
+	// 組み込み関数を直接呼び出しても数える
+	if _, err := interp.Call("range", 100000); err == nil || !strings.Contains(err.Error(), "step limit exceeded") {
+		t.Errorf("expected step limit error. got = %v", err)
+	}
+
+	interp.MaxSteps = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := interp.CallContext(ctx, "count", int64(1)<<62)
+	if err == nil || !strings.Contains(err.Error(), "execution cancelled: context deadline exceeded") {
+		t.Errorf("expected timeout. got = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancellation took too long: %s", elapsed)
+	}
+}
+
+// 出力だけをバッファに送り、ファイルと時計は使わせない Host
+type bufferHost struct {
+	evaluator.OSHost
+}
+
+func (h bufferHost) ReadFile(name string) ([]byte, error) {
+	return nil, fmt.Errorf("file access is disabled")
+}
+
+func (h bufferHost) WriteFile(name string, data []byte) error {
+	return fmt.Errorf("file access is disabled")
+}
+
+func TestSandbox(t *testing.T) {
+	var out bytes.Buffer
+	interp := New()
+	interp.Host = bufferHost{evaluator.OSHost{Out: &out}}
+	interp.Builtins = evaluator.DenyBuiltins("now")
+	interp.RegisterBuiltin("now", func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		return &object.Integer{Value: 0}
+	})
+
+	if _, err := interp.Eval(`puts("hello")`); err != nil {
+		t.Fatalf("Eval returned error: %s", err)
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("wrong output. got = %q", out.String())
+	}
+
+	_, err := interp.Eval(`read_file("/etc/passwd")`)
+	if err == nil || !strings.Contains(err.Error(), "IOError: file access is disabled") {
+		t.Errorf("expected IOError. got = %v", err)
+	}
+
+	// RegisterBuiltin で登録した関数は Builtins に関係なく使える
+	result, err := interp.Eval(`now()`)
+	if err != nil || result.Inspect() != "0" {
+		t.Errorf("expected registered now. got = %v, %v", result, err)
+	}
+
+	interp.Builtins = evaluator.PureBuiltins
+	if _, err := interp.Call("puts", "x"); err == nil {
+		t.Errorf("expected puts to be unavailable")
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("unexpected output. got = %q", out.String())
+	}
+	// モジュールも Host から読むので、ディスクにあるファイルでも読めない
+	path := filepath.Join(t.TempDir(), "secret.mk")
+	if err := os.WriteFile(path, []byte(`export let s = "secret";`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := fmt.Sprintf("import %q; secret.s", path)
+
+	interp.Builtins = nil
+	_, err = interp.Eval(input)
+	if err == nil || !strings.Contains(err.Error(), "ImportError: cannot read module") {
+		t.Errorf("expected ImportError from host. got = %v", err)
+	}
+
+	// PureBuiltins では import も使えない
+	osInterp := New()
+	osInterp.Builtins = evaluator.PureBuiltins
+	_, err = osInterp.Eval(input)
+	if err == nil || !strings.Contains(err.Error(), "ImportError: import is not allowed") {
+		t.Errorf("expected import to be disallowed. got = %v", err)
+	}
+
+	osInterp.Builtins = evaluator.DenyBuiltins("read_file")
+	result, err = osInterp.Eval(input)
+	if err != nil || result.Inspect() != "secret" {
+		t.Errorf("expected import to be allowed. got = %v, %v", result, err)
+	}
+}
+
+func TestPanicInBuiltin(t *testing.T) {
+	interp := New()
+	interp.RegisterBuiltin("crash", func(_ object.ApplyFunction, args ...object.Object) object.Object {
+		panic("broken builtin")
+	})
+
+	_, err := interp.Eval("let f = fn() { crash() }; f()")
+	if err == nil || err.Error() != "RuntimeError: internal error: broken builtin" {
+		t.Errorf("expected internal error. got = %v", err)
+	}
+
+	// panic の後もインタプリタは使い続けられる
+	result, err := interp.Call("len", "ab")
+	if err != nil || result.Inspect() != "2" {
+		t.Errorf("interpreter is unusable after panic. got = %v, %v", result, err)
+	}
+}
@@ -3,6 +3,16 @@ package object
 type Environment struct {
 	store map[string]Object
 	outer *Environment
+
+	modules *ModuleCache // import したモジュール (最も外側の環境だけが持つ)
+	exec    *Execution   // 実行の制限と状態 (同じ実行の環境すべてで共有する)
+}
+
+// import したモジュールのキャッシュ
+// 同じ実行の中では、モジュールの環境も含めてひとつを共有する
+type ModuleCache struct {
+	Modules map[string]*Module // 読み込み済みのモジュール (絶対パスごと)
+	Loading []string           // 読み込み中のモジュールの絶対パス (循環 import の検出用)
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
@@ -18,13 +28,50 @@ func (e *Environment) Set(name string, val Object) Object {
 	return val
 }
 
+// 既存の束縛を outer に向かって探し、最も近いものを書き換える
+// どこにも束縛がなければ false を返す
+func (e *Environment) Assign(name string, val Object) bool {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = val
+		return true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, val)
+	}
+	return false
+}
+
+// この環境で import したモジュールのキャッシュ
+func (e *Environment) Modules() *ModuleCache {
+	if e.outer != nil {
+		return e.outer.Modules()
+	}
+	if e.modules == nil {
+		e.modules = &ModuleCache{Modules: make(map[string]*Module)}
+	}
+	return e.modules
+}
+
+// この環境での実行の制限と状態
+func (e *Environment) Execution() *Execution {
+	return e.exec
+}
+
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
-	return &Environment{store: s}
+	return &Environment{store: s, exec: &Execution{}}
 }
 
 func NewEnclosedEnvironment(outer *Environment) *Environment {
+	s := make(map[string]Object)
+	return &Environment{store: s, outer: outer, exec: outer.exec}
+}
+
+// モジュールを評価するための環境
+// importer の変数は見えないが、モジュールのキャッシュと実行の制限は importer と共有する
+func NewModuleEnvironment(importer *Environment) *Environment {
 	env := NewEnvironment()
-	env.outer = outer
+	env.modules = importer.Modules()
+	env.exec = importer.exec
 	return env
 }
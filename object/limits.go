@@ -0,0 +1,101 @@
+package object
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// 実行の制限 (0 や nil の項目は制限しない)
+// 信頼できないスクリプトを組み込んで実行する場合に使う
+type Limits struct {
+	Context  context.Context // キャンセルされたら実行を中断する
+	MaxSteps int64           // 評価するノード (VM では実行する命令) の数の上限 (組み込み関数は処理した量を数える)
+	MaxDepth int             // 関数呼び出しの深さの上限 (評価器・VM それぞれの既定の上限より大きくはできない)
+}
+
+// キャンセルを確かめる間隔 (ステップ数)
+const contextCheckInterval = 1024
+
+// ひとつの実行の設定と、実行中に数える値
+// 評価器では同じ実行の環境すべてで、VM では VM ごとにひとつを共有する
+type Execution struct {
+	Limits   Limits
+	Builtins map[string]*Builtin // 使える組み込み関数 (nil なら既定の組み込み関数すべて)
+	Steps    int64               // これまでに実行したステップ数
+	Depth    int                 // 実行中の関数呼び出しの深さ
+
+	// import するモジュールのソースを読む関数 (nil なら OS のファイルをそのまま読む)
+	ReadModule func(file string) ([]byte, error)
+}
+
+// 制限を設定し、ステップ数を数え直す
+func (x *Execution) Reset(limits Limits) {
+	x.Limits = limits
+	x.Steps = 0
+}
+
+// ステップ数を数え、上限を超えたかキャンセルされていたら LIMIT_ERROR を返す
+func (x *Execution) Step() *Error {
+	x.Steps++
+
+	if x.Limits.MaxSteps > 0 && x.Steps > x.Limits.MaxSteps {
+		return x.stepLimitError()
+	}
+
+	if x.Limits.Context != nil && x.Steps%contextCheckInterval == 0 {
+		return x.cancelledError()
+	}
+
+	return nil
+}
+
+// 組み込み関数がまとめて行った処理の量を、n ステップとして数える
+func (x *Execution) StepN(n int64) *Error {
+	if n <= 0 {
+		return nil
+	}
+
+	before := x.Steps
+	if n > math.MaxInt64-x.Steps {
+		x.Steps = math.MaxInt64
+	} else {
+		x.Steps += n
+	}
+
+	if x.Limits.MaxSteps > 0 && x.Steps > x.Limits.MaxSteps {
+		return x.stepLimitError()
+	}
+
+	// Step と同じく、contextCheckInterval ステップごとにキャンセルを確かめる
+	if x.Limits.Context != nil && x.Steps/contextCheckInterval != before/contextCheckInterval {
+		return x.cancelledError()
+	}
+
+	return nil
+}
+
+func (x *Execution) stepLimitError() *Error {
+	return &Error{Kind: LIMIT_ERROR, Message: fmt.Sprintf("step limit exceeded (%d steps)", x.Limits.MaxSteps)}
+}
+
+// キャンセルされていなければ nil を返す
+func (x *Execution) cancelledError() *Error {
+	if err := x.Limits.Context.Err(); err != nil {
+		return &Error{Kind: LIMIT_ERROR, Message: fmt.Sprintf("execution cancelled: %s", err)}
+	}
+	return nil
+}
+
+// 関数呼び出しの深さの上限 (defaultMax は実装ごとの既定の上限)
+func (x *Execution) MaxDepth(defaultMax int) int {
+	if x.Limits.MaxDepth > 0 && x.Limits.MaxDepth < defaultMax {
+		return x.Limits.MaxDepth
+	}
+	return defaultMax
+}
+
+// 関数呼び出しの深さが上限を超えたときのエラー
+func StackOverflowError(maxDepth int) *Error {
+	return &Error{Kind: RUNTIME_ERROR, Message: fmt.Sprintf("stack overflow. call depth exceeds %d", maxDepth)}
+}
@@ -2,29 +2,45 @@ package object
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"math/big"
 	"monkey/ast"
+	"monkey/code"
+	"monkey/token"
+	"strconv"
 	"strings"
 )
 
 type ObjectType string
-type BuiltinFunction func(args ...Object) Object
+type BuiltinFunction func(apply ApplyFunction, args ...Object) Object
+
+// 組み込み関数から Monkey の関数 (クロージャや他の組み込み関数) を呼び出すためのコールバック
+// 評価器と VM がそれぞれ自分の呼び出し方で実装して組み込み関数に渡す
+type ApplyFunction func(fn Object, args ...Object) Object
 
 // ObjectType を表現する定数
 const (
 	INTEGER_OBJ      = "INTEGER"
+	FLOAT_OBJ        = "FLOAT"
 	STRING_OBJ       = "STRING"
 	BOOLEAN_OBJ      = "BOOLEAN"
 	ARRAY_OBJ        = "ARRAY"
 	HASH_OBJ         = "HASH"
 	NULL_OBJ         = "NULL"
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
+	BREAK_OBJ        = "BREAK"
+	CONTINUE_OBJ     = "CONTINUE"
 	FUNCTION_OBJ     = "FUNCTION"
 	BUILTIN_OBJ      = "BUILTIN"
 	QUOTE_OBJ        = "QUOTE"
 	MACRO_OBJ        = "MACRO"
 	ERROR_OBJ        = "ERROR"
+	MODULE_OBJ       = "MODULE"
+
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
 )
 
 // Type() と Inspect() を持てば Object インターフェースである
@@ -40,6 +56,38 @@ type Integer struct {
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 
+// int64 に収まらない整数 (言語からは INTEGER として見える)
+// NewInteger で作れば、int64 に収まる値は必ず Integer になるので、同じ値が両方の表現を持つことはない
+type BigInteger struct {
+	Value *big.Int
+}
+
+func (b *BigInteger) Type() ObjectType { return INTEGER_OBJ }
+func (b *BigInteger) Inspect() string  { return b.Value.String() }
+
+// x が int64 に収まれば Integer を、収まらなければ BigInteger を返す
+func NewInteger(x *big.Int) Object {
+	if x.IsInt64() {
+		return &Integer{Value: x.Int64()}
+	}
+	return &BigInteger{Value: x}
+}
+
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+
+	// 整数と区別できるように、小数点も指数もなければ ".0" を付ける
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
 type String struct {
 	Value string
 }
@@ -59,12 +107,21 @@ type Array struct {
 }
 
 func (a *Array) Type() ObjectType { return ARRAY_OBJ }
-func (a *Array) Inspect() string {
+func (a *Array) Inspect() string  { return a.inspect(map[Object]bool{}) }
+
+// visiting は表示している途中の配列とハッシュ (自分自身を含むものは [...] や {...} と表示する)
+func (a *Array) inspect(visiting map[Object]bool) string {
+	if visiting[a] {
+		return "[...]"
+	}
+	visiting[a] = true
+	defer delete(visiting, a)
+
 	var out bytes.Buffer
 
 	elements := []string{}
 	for _, e := range a.Elements {
-		elements = append(elements, e.Inspect())
+		elements = append(elements, inspectElement(e, visiting))
 	}
 
 	out.WriteString("[")
@@ -83,6 +140,56 @@ type Hashable interface {
 	HashKey() HashKey
 }
 
+// obj をハッシュのキーにするときのキーを返す (キーにできなければ false)
+// 配列は要素がすべてキーにできるときだけキーにできるので、Hashable を満たすかどうかではなくこの関数で確かめる
+func HashKeyOf(obj Object) (HashKey, bool) {
+	if array, ok := obj.(*Array); ok {
+		return array.hashKey(map[*Array]bool{})
+	}
+	if hashable, ok := obj.(Hashable); ok {
+		return hashable.HashKey(), true
+	}
+	return HashKey{}, false
+}
+
+// 要素のキーを順に混ぜたキー ([1, 2] と [2, 1] は別のキーになる)
+// 要素がキーにできない配列では使えないので、HashKeyOf を通して使う
+func (a *Array) HashKey() HashKey {
+	key, _ := a.hashKey(map[*Array]bool{})
+	return key
+}
+
+// visiting は辿っている途中の配列 (自分自身を含む配列はキーにできない)
+func (a *Array) hashKey(visiting map[*Array]bool) (HashKey, bool) {
+	if visiting[a] {
+		return HashKey{}, false
+	}
+	visiting[a] = true
+	defer delete(visiting, a)
+
+	h := fnv.New64a()
+	var value [8]byte
+
+	for _, el := range a.Elements {
+		var key HashKey
+		var ok bool
+		if array, isArray := el.(*Array); isArray {
+			key, ok = array.hashKey(visiting)
+		} else {
+			key, ok = HashKeyOf(el)
+		}
+		if !ok {
+			return HashKey{}, false
+		}
+
+		h.Write([]byte(key.Type))
+		binary.LittleEndian.PutUint64(value[:], key.Value)
+		h.Write(value[:])
+	}
+
+	return HashKey{Type: a.Type(), Value: h.Sum64()}, true
+}
+
 func (b *Boolean) HashKey() HashKey {
 	var value uint64
 
@@ -99,6 +206,32 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+// float64 で正確に表せる値は、等しい浮動小数点数と同じキーになる (2 ** 64 == 2.0 ** 64 なので)
+func (b *BigInteger) HashKey() HashKey {
+	if f, accuracy := new(big.Float).SetInt(b.Value).Float64(); accuracy == big.Exact {
+		return (&Float{Value: f}).HashKey()
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(b.Value.Text(16)))
+
+	return HashKey{Type: b.Type(), Value: h.Sum64()}
+}
+
+// 整数値を表す浮動小数点数は、等しい整数と同じキーになる (1.0 == 1 なので)
+// NaN は NaN 同士で同じキーになる
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && f.Value >= math.MinInt64 && f.Value < math.MaxInt64 {
+		return HashKey{Type: INTEGER_OBJ, Value: uint64(int64(f.Value))}
+	}
+
+	bits := math.Float64bits(f.Value)
+	if math.IsNaN(f.Value) {
+		bits = math.Float64bits(math.NaN())
+	}
+	return HashKey{Type: f.Type(), Value: bits}
+}
+
 func (s *String) HashKey() HashKey {
 	h := fnv.New64a()
 	h.Write([]byte(s.Value))
@@ -111,17 +244,73 @@ type HashPair struct {
 	Value Object
 }
 
+// 要素は追加した順に並ぶ (Inspect や for での反復もこの順)
+// Pairs を直接書き換えると順序が崩れるので、変更は Set と Delete で行う
 type Hash struct {
 	Pairs map[HashKey]HashPair
+	Keys  []HashKey // 追加した順のキー
+}
+
+func NewHash() *Hash {
+	return &Hash{Pairs: make(map[HashKey]HashPair)}
+}
+
+// 新しいキーは末尾に追加し、既にあるキーは位置を変えずに値だけ置き換える
+func (h *Hash) Set(key HashKey, pair HashPair) {
+	if h.Pairs == nil {
+		h.Pairs = make(map[HashKey]HashPair)
+	}
+	if _, ok := h.Pairs[key]; !ok {
+		h.Keys = append(h.Keys, key)
+	}
+	h.Pairs[key] = pair
+}
+
+func (h *Hash) Get(key HashKey) (HashPair, bool) {
+	pair, ok := h.Pairs[key]
+	return pair, ok
+}
+
+// キーがあれば取り除いて true を返す
+func (h *Hash) Delete(key HashKey) bool {
+	if _, ok := h.Pairs[key]; !ok {
+		return false
+	}
+
+	delete(h.Pairs, key)
+	for i, k := range h.Keys {
+		if k == key {
+			h.Keys = append(h.Keys[:i:i], h.Keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// 追加した順に並べた要素を返す
+func (h *Hash) OrderedPairs() []HashPair {
+	pairs := make([]HashPair, len(h.Keys))
+	for i, key := range h.Keys {
+		pairs[i] = h.Pairs[key]
+	}
+	return pairs
 }
 
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
-func (h *Hash) Inspect() string {
+func (h *Hash) Inspect() string  { return h.inspect(map[Object]bool{}) }
+
+func (h *Hash) inspect(visiting map[Object]bool) string {
+	if visiting[h] {
+		return "{...}"
+	}
+	visiting[h] = true
+	defer delete(visiting, h)
+
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
+	for _, pair := range h.OrderedPairs() {
+		pairs = append(pairs, fmt.Sprintf("%s: %s", inspectElement(pair.Key, visiting), inspectElement(pair.Value, visiting)))
 	}
 
 	out.WriteString("{")
@@ -131,6 +320,18 @@ func (h *Hash) Inspect() string {
 	return out.String()
 }
 
+// 配列とハッシュの要素を表示する (辿っている途中のものを渡して循環を見つける)
+func inspectElement(obj Object, visiting map[Object]bool) string {
+	switch obj := obj.(type) {
+	case *Array:
+		return obj.inspect(visiting)
+	case *Hash:
+		return obj.inspect(visiting)
+	default:
+		return obj.Inspect()
+	}
+}
+
 type Null struct{}
 
 func (n *Null) Type() ObjectType { return NULL_OBJ }
@@ -143,18 +344,32 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// break と continue を評価したことをループまで伝えるためのオブジェクト
+type Break struct{}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Name       string // let で束縛された名前 (スタックトレース用)
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
-func (f *Function) Inspect() string {
+func (f *Function) Inspect() string  { return inspectFunction(f.Parameters, f.Body) }
+
+func inspectFunction(parameters []*ast.Identifier, body *ast.BlockStatement) string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range f.Parameters {
+	for _, p := range parameters {
 		params = append(params, p.String())
 	}
 
@@ -162,19 +377,67 @@ func (f *Function) Inspect() string {
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") {\n")
-	out.WriteString(f.Body.String())
+	out.WriteString(body.String())
 	out.WriteString("\n}")
 
 	return out.String()
 }
 
+// コンパイラが生成する関数本体 (定数プールに置かれる)
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+	LocalNames    []string       // ローカル変数名 (未定義エラーの表示用)
+	Name          string         // let で束縛された名前 (スタックトレース用)
+	SourceMap     code.SourceMap // 命令とソース位置の対応
+
+	// Inspect で評価器の関数と同じ表示をするために元の AST を持つ
+	Parameters []*ast.Identifier
+	Body       *ast.BlockStatement
+}
+
+func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+// VM 上の関数値 (コンパイル済み関数と、捕捉した自由変数の組)
+// 評価器の Function と区別なく扱えるように、型は FUNCTION として振る舞う
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return FUNCTION_OBJ }
+func (c *Closure) Inspect() string {
+	if c.Fn.Body == nil {
+		return fmt.Sprintf("Closure[%p]", c)
+	}
+	return inspectFunction(c.Fn.Parameters, c.Fn.Body)
+}
+
 type Builtin struct {
 	Fn BuiltinFunction
+
+	// 呼び出す前に数えるステップ数を引数から見積もる (nil なら結果の大きさを呼び出した後に数える)
+	// 引数から結果の大きさが分かる組み込み関数は、上限を超える処理を始める前に止められる
+	Cost func(args []Object) int64
 }
 
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
 func (b *Builtin) Inspect() string  { return "builtin function" }
 
+// import で読み込んだモジュール
+// export したトップレベルの変数を、名前をキーにしたハッシュとして持つ
+type Module struct {
+	Name    string
+	Exports *Hash
+}
+
+func (m *Module) Type() ObjectType { return MODULE_OBJ }
+func (m *Module) Inspect() string  { return "<module " + m.Name + ">" }
+
 type Quote struct {
 	Node ast.Node
 }
@@ -209,9 +472,81 @@ func (m *Macro) Inspect() string {
 	return out.String()
 }
 
+// エラーの種類
+type ErrorKind string
+
+const (
+	TYPE_ERROR     ErrorKind = "TypeError"     // 型が合わない演算・呼び出し
+	NAME_ERROR     ErrorKind = "NameError"     // 未定義の識別子
+	ARGUMENT_ERROR ErrorKind = "ArgumentError" // 引数の数や値が不正
+	MACRO_ERROR    ErrorKind = "MacroError"    // マクロ展開の失敗
+	INDEX_ERROR    ErrorKind = "IndexError"    // 範囲外の添字への代入
+	IMPORT_ERROR   ErrorKind = "ImportError"   // モジュールが見つからない・読み込めない・循環している
+	IO_ERROR       ErrorKind = "IOError"       // read_file や write_file の失敗
+	LIMIT_ERROR    ErrorKind = "LimitError"    // ステップ数の上限・キャンセル (try では捕まえられない)
+	RUNTIME_ERROR  ErrorKind = "RuntimeError"  // その他 (スタックオーバーフローなど)
+	USER_ERROR     ErrorKind = "Error"         // throw や error() でプログラムが投げたもの
+)
+
+// StackTrace で表示する呼び出し履歴の上限
+const maxTraceFrames = 20
+
+// エラーが関数呼び出しをさかのぼった記録のひとつ
+type TraceFrame struct {
+	Function string         // 呼び出された関数の名前
+	CallPos  token.Position // その関数を呼び出した位置
+}
+
 type Error struct {
+	Kind    ErrorKind
 	Message string
+	Pos     token.Position // エラーが発生したノードの位置
+	Trace   []TraceFrame   // エラーが抜けてきた関数呼び出し (内側から順に並ぶ)
+}
+
+// エラーが関数から呼び出し元へ抜けたことを記録する
+func (e *Error) AddTrace(function string, callPos token.Position) {
+	if function == "" {
+		function = "<anonymous>"
+	}
+	e.Trace = append(e.Trace, TraceFrame{Function: function, CallPos: callPos})
+}
+
+// 種類とメッセージ、呼び出し履歴を複数行で返す (REPL やスクリプト実行時の表示用)
+//
+//	ERROR: TypeError: Type Mismatch: INTEGER + BOOLEAN
+//	    at inner (main.mk:2:5)
+//	    at <main> (main.mk:4:2)
+func (e *Error) StackTrace() string {
+	var out bytes.Buffer
+
+	out.WriteString("ERROR: ")
+	if e.Kind != "" {
+		out.WriteString(string(e.Kind) + ": ")
+	}
+	out.WriteString(e.Message)
+
+	// 各関数の中でエラーが通過した位置は、ひとつ内側の関数を呼び出した位置になる
+	pos := e.Pos
+	for i, frame := range e.Trace {
+		if i == maxTraceFrames {
+			// 深い再帰で溢れた場合などは省略する
+			out.WriteString(fmt.Sprintf("\n    ... %d more", len(e.Trace)-i))
+			pos = e.Trace[len(e.Trace)-1].CallPos
+			break
+		}
+		out.WriteString("\n    at " + frame.Function + " (" + pos.String() + ")")
+		pos = frame.CallPos
+	}
+	out.WriteString("\n    at <main> (" + pos.String() + ")")
+
+	return out.String()
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
+func (e *Error) Inspect() string {
+	if e.Pos.IsValid() {
+		return "ERROR: " + e.Pos.String() + ": " + e.Message
+	}
+	return "ERROR: " + e.Message
+}
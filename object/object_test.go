@@ -1,6 +1,12 @@
 package object
 
-import "testing"
+import (
+	"context"
+	"math/big"
+	"monkey/token"
+	"strings"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -20,3 +26,207 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestFloatHashKey(t *testing.T) {
+	one := &Integer{Value: 1}
+	oneFloat := &Float{Value: 1.0}
+	half1 := &Float{Value: 0.5}
+	half2 := &Float{Value: 0.5}
+	quarter := &Float{Value: 0.25}
+
+	if one.HashKey() != oneFloat.HashKey() {
+		t.Errorf("1 and 1.0 have different hash keys")
+	}
+
+	if half1.HashKey() != half2.HashKey() {
+		t.Errorf("floats with same value have different hash keys")
+	}
+
+	if half1.HashKey() == quarter.HashKey() {
+		t.Errorf("floats with different values have same hash keys")
+	}
+}
+
+func TestBigInteger(t *testing.T) {
+	if _, ok := NewInteger(big.NewInt(42)).(*Integer); !ok {
+		t.Errorf("NewInteger did not return Integer for a value that fits in int64")
+	}
+
+	twoTo64 := new(big.Int).Lsh(big.NewInt(1), 64)
+	big1 := NewInteger(twoTo64).(*BigInteger)
+	big2 := NewInteger(new(big.Int).Lsh(big.NewInt(1), 64)).(*BigInteger)
+	odd1 := NewInteger(new(big.Int).Add(twoTo64, big.NewInt(1))).(*BigInteger)
+	odd2 := NewInteger(new(big.Int).Add(twoTo64, big.NewInt(1))).(*BigInteger)
+
+	if big1.Type() != INTEGER_OBJ || big1.Inspect() != "18446744073709551616" {
+		t.Errorf("wrong type or inspect. got = %s, %s", big1.Type(), big1.Inspect())
+	}
+
+	if big1.HashKey() != big2.HashKey() || odd1.HashKey() != odd2.HashKey() {
+		t.Errorf("big integers with same value have different hash keys")
+	}
+
+	if big1.HashKey() == odd1.HashKey() {
+		t.Errorf("big integers with different values have same hash keys")
+	}
+
+	// float64 で正確に表せる値は浮動小数点数と同じキーになる
+	if big1.HashKey() != (&Float{Value: 18446744073709551616}).HashKey() {
+		t.Errorf("2 ** 64 and 2.0 ** 64 have different hash keys")
+	}
+}
+
+func TestArrayHashKey(t *testing.T) {
+	array := func(elements ...Object) *Array { return &Array{Elements: elements} }
+	one := &Integer{Value: 1}
+	two := &Integer{Value: 2}
+
+	key := func(obj Object) HashKey {
+		key, ok := HashKeyOf(obj)
+		if !ok {
+			t.Fatalf("%s is unusable as hash key", obj.Inspect())
+		}
+		return key
+	}
+
+	if key(array(one, two)) != key(array(one, two)) {
+		t.Errorf("arrays with same elements have different hash keys")
+	}
+
+	if key(array(one, two)) == key(array(two, one)) {
+		t.Errorf("arrays with elements in different order have same hash keys")
+	}
+
+	if key(array(one, array(two))) == key(array(one, two)) {
+		t.Errorf("nested array and flat array have same hash keys")
+	}
+
+	if key(array(&Float{Value: 1.0})) != key(array(one)) {
+		t.Errorf("[1.0] and [1] have different hash keys")
+	}
+
+	if _, ok := HashKeyOf(array(one, array(&Builtin{}))); ok {
+		t.Errorf("array with unhashable element is usable as hash key")
+	}
+
+	cyclic := array(one)
+	cyclic.Elements = append(cyclic.Elements, cyclic)
+	if _, ok := HashKeyOf(cyclic); ok {
+		t.Errorf("array containing itself is usable as hash key")
+	}
+}
+
+func TestErrorStackTrace(t *testing.T) {
+	err := &Error{
+		Kind:    TYPE_ERROR,
+		Message: "Type Mismatch: INTEGER + BOOLEAN",
+		Pos:     token.Position{Line: 2, Column: 5},
+	}
+	err.AddTrace("inner", token.Position{Line: 4, Column: 8})
+	err.AddTrace("", token.Position{Line: 6, Column: 1})
+
+	expected := "ERROR: TypeError: Type Mismatch: INTEGER + BOOLEAN\n" +
+		"    at inner (2:5)\n" +
+		"    at <anonymous> (4:8)\n" +
+		"    at <main> (6:1)"
+	if err.StackTrace() != expected {
+		t.Errorf("wrong stack trace.\nexpected = %q\ngot      = %q", expected, err.StackTrace())
+	}
+
+	if err.Inspect() != "ERROR: 2:5: Type Mismatch: INTEGER + BOOLEAN" {
+		t.Errorf("wrong inspect. got = %q", err.Inspect())
+	}
+}
+
+func TestErrorStackTraceIsTruncated(t *testing.T) {
+	err := &Error{Kind: RUNTIME_ERROR, Message: "stack overflow", Pos: token.Position{Line: 1, Column: 1}}
+	for i := 0; i < 100; i++ {
+		err.AddTrace("f", token.Position{Line: 1, Column: 1})
+	}
+
+	trace := err.StackTrace()
+	if n := strings.Count(trace, "at f "); n != maxTraceFrames {
+		t.Errorf("wrong number of frames. expected = %d, got = %d", maxTraceFrames, n)
+	}
+	if !strings.Contains(trace, "... 80 more") {
+		t.Errorf("omitted frames are not reported. got = %q", trace)
+	}
+}
+
+func TestHashOrder(t *testing.T) {
+	hash := NewHash()
+	for _, k := range []string{"c", "a", "b"} {
+		key := &String{Value: k}
+		hash.Set(key.HashKey(), HashPair{Key: key, Value: &Integer{Value: 1}})
+	}
+
+	a := &String{Value: "a"}
+	hash.Set(a.HashKey(), HashPair{Key: a, Value: &Integer{Value: 2}})
+	if hash.Inspect() != "{c: 1, a: 2, b: 1}" {
+		t.Errorf("wrong order after overwrite. got = %q", hash.Inspect())
+	}
+
+	if !hash.Delete(a.HashKey()) {
+		t.Errorf("Delete returned false for existing key")
+	}
+	if hash.Delete(a.HashKey()) {
+		t.Errorf("Delete returned true for missing key")
+	}
+	hash.Set(a.HashKey(), HashPair{Key: a, Value: &Integer{Value: 3}})
+	if hash.Inspect() != "{c: 1, b: 1, a: 3}" {
+		t.Errorf("wrong order after delete. got = %q", hash.Inspect())
+	}
+}
+
+func TestExecutionStep(t *testing.T) {
+	exec := &Execution{}
+	exec.Reset(Limits{MaxSteps: 3})
+
+	for i := 0; i < 3; i++ {
+		if err := exec.Step(); err != nil {
+			t.Fatalf("step %d: unexpected error %s", i+1, err.Message)
+		}
+	}
+	if err := exec.Step(); err == nil || err.Kind != LIMIT_ERROR {
+		t.Fatalf("expected LimitError after 3 steps. got = %+v", err)
+	}
+
+	// Reset でステップ数を数え直す
+	ctx, cancel := context.WithCancel(context.Background())
+	exec.Reset(Limits{Context: ctx})
+	for i := 0; i < contextCheckInterval; i++ {
+		if err := exec.Step(); err != nil {
+			t.Fatalf("step %d: unexpected error %s", i+1, err.Message)
+		}
+	}
+
+	cancel()
+	var err *Error
+	for i := 0; i < contextCheckInterval && err == nil; i++ {
+		err = exec.Step()
+	}
+	if err == nil || err.Message != "execution cancelled: context canceled" {
+		t.Errorf("expected cancellation error. got = %+v", err)
+	}
+
+	// まとめて数えたステップも上限とキャンセルを確かめる
+	exec.Reset(Limits{MaxSteps: 100})
+	if err := exec.StepN(100); err != nil {
+		t.Fatalf("unexpected error %s", err.Message)
+	}
+	if err := exec.StepN(1); err == nil || err.Kind != LIMIT_ERROR {
+		t.Errorf("expected LimitError after 100 steps. got = %+v", err)
+	}
+	exec.Reset(Limits{Context: ctx})
+	if err := exec.StepN(contextCheckInterval); err == nil || err.Message != "execution cancelled: context canceled" {
+		t.Errorf("expected cancellation error. got = %+v", err)
+	}
+
+	if exec.MaxDepth(100) != 100 {
+		t.Errorf("MaxDepth without limit should be the default. got = %d", exec.MaxDepth(100))
+	}
+	exec.Reset(Limits{MaxDepth: 10})
+	if exec.MaxDepth(100) != 10 || exec.MaxDepth(5) != 5 {
+		t.Errorf("wrong MaxDepth. got = %d, %d", exec.MaxDepth(100), exec.MaxDepth(5))
+	}
+}
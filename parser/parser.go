@@ -5,21 +5,40 @@ import (
 	"monkey/ast"
 	"monkey/lexer"
 	"monkey/token"
+	"path"
 	"strconv"
+	"strings"
 )
 
 // 優先順位テーブル: TokenType それぞれがどの優先順位に位置するかを map するテーブル
 var precedences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NEQ:      EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL, // 中置構文内で ( が出てきた場合、関数呼び出しを意味するので最優先する
-	token.LBRACKET: INDEX,
+	token.ASSIGN:          ASSIGN,
+	token.PLUS_ASSIGN:     ASSIGN,
+	token.MINUS_ASSIGN:    ASSIGN,
+	token.ASTERISK_ASSIGN: ASSIGN,
+	token.SLASH_ASSIGN:    ASSIGN,
+	token.OR:              LOGICAL_OR,
+	token.AND:             LOGICAL_AND,
+	token.EQ:              EQUALS,
+	token.NEQ:             EQUALS,
+	token.LT:              LESSGREATER,
+	token.GT:              LESSGREATER,
+	token.LT_EQ:           LESSGREATER,
+	token.GT_EQ:           LESSGREATER,
+	token.BIT_OR:          BIT_OR,
+	token.BIT_XOR:         BIT_XOR,
+	token.BIT_AND:         BIT_AND,
+	token.SHIFT_LEFT:      SHIFT,
+	token.SHIFT_RIGHT:     SHIFT,
+	token.PLUS:            SUM,
+	token.MINUS:           SUM,
+	token.SLASH:           PRODUCT,
+	token.ASTERISK:        PRODUCT,
+	token.PERCENT:         PRODUCT,
+	token.POWER:           POWER,
+	token.LPAREN:          CALL, // 中置構文内で ( が出てきた場合、関数呼び出しを意味するので最優先する
+	token.LBRACKET:        INDEX,
+	token.DOT:             INDEX,
 }
 
 type Parser struct {
@@ -29,6 +48,10 @@ type Parser struct {
 	curToken  token.Token
 	peekToken token.Token
 
+	loopDepth  int // break と continue が書けるかどうか (関数に入るとリセットする)
+	blockDepth int // export が書けるかどうか (トップレベルでだけ書ける)
+	lexErrors  int // p.errors に取り込んだ字句解析エラーの数
+
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 }
@@ -43,15 +66,18 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.TILDE, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefix(token.IF, p.parseIfExpression)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.MACRO, p.parseMacroLiteral)
 
@@ -64,9 +90,26 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.EQ, p.parseInfixExpression)
 	p.registerInfix(token.NEQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseLogicalExpression)
+	p.registerInfix(token.OR, p.parseLogicalExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.POWER, p.parseInfixExpression)
+	p.registerInfix(token.BIT_AND, p.parseInfixExpression)
+	p.registerInfix(token.BIT_OR, p.parseInfixExpression)
+	p.registerInfix(token.BIT_XOR, p.parseInfixExpression)
+	p.registerInfix(token.SHIFT_LEFT, p.parseInfixExpression)
+	p.registerInfix(token.SHIFT_RIGHT, p.parseInfixExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parseAssignExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.DOT, p.parseMemberExpression)
 
 	// 2 つトークンを読み込む
 	// => curToken と peekToken 両方がセットされる
@@ -82,12 +125,23 @@ func (p *Parser) Errors() []string {
 
 func (p *Parser) peekError(t token.TokenType) {
 	msg := fmt.Sprintf("expected next token to be %s. got = %s", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.addError(p.peekToken.Pos, msg)
+}
+
+// エラーメッセージの先頭に file:line:col を付けて記録する
+func (p *Parser) addError(pos token.Position, msg string) {
+	p.errors = append(p.errors, pos.String()+": "+msg)
 }
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+
+	// 字句解析のエラー (閉じていないコメントなど) も、見つかった順に構文エラーとして報告する
+	if lexErrors := p.l.Errors(); len(lexErrors) > p.lexErrors {
+		p.errors = append(p.errors, lexErrors[p.lexErrors:]...)
+		p.lexErrors = len(lexErrors)
+	}
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -114,6 +168,18 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
+	case token.WHILE:
+		return p.parseWhileStatement()
+	case token.FOR:
+		return p.parseForStatement()
+	case token.BREAK, token.CONTINUE:
+		return p.parseLoopControlStatement()
+	case token.IMPORT:
+		return p.parseImportStatement()
+	case token.EXPORT:
+		return p.parseExportStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -137,6 +203,11 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
 
+	// let f = fn() {...} の形なら、関数自身に束縛名を覚えさせる (再帰呼び出しやエラー表示に使う)
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -158,6 +229,179 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+func (p *Parser) parseImportStatement() ast.Statement {
+	stmt := &ast.ImportStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	stmt.Path = p.curToken.Literal
+	pathToken := p.curToken
+
+	// as は予約語にせず、import 文の中でだけ特別扱いする
+	if p.peekTokenIs(token.IDENT) && p.peekToken.Literal == "as" {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	} else {
+		name := moduleName(stmt.Path)
+		if name == "" {
+			p.addError(pathToken.Pos, fmt.Sprintf("cannot use %q as a module name. use import %q as <name>", path.Base(stmt.Path), stmt.Path))
+			return nil
+		}
+		stmt.Name = &ast.Identifier{Token: pathToken, Value: name}
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// パスの末尾から拡張子を除いた名前 (識別子として使えなければ "")
+func moduleName(importPath string) string {
+	base := path.Base(importPath)
+	name := strings.TrimSuffix(base, path.Ext(base))
+
+	l := lexer.New(name)
+	tok := l.NextToken()
+	if tok.Type != token.IDENT || tok.Literal != name {
+		return ""
+	}
+	return name
+}
+
+func (p *Parser) parseExportStatement() ast.Statement {
+	stmt := &ast.ExportStatement{Token: p.curToken}
+
+	if p.blockDepth > 0 {
+		p.addError(p.curToken.Pos, "export is only allowed at the top level")
+		return nil
+	}
+
+	if !p.expectPeek(token.LET) {
+		return nil
+	}
+
+	stmt.Statement = p.parseLetStatement()
+	if stmt.Statement == nil {
+		return nil
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseWhileStatement() ast.Statement {
+	stmt := &ast.WhileStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseLoopBody()
+	return stmt
+}
+
+func (p *Parser) parseForStatement() ast.Statement {
+	stmt := &ast.ForStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	// for (x in ...) または for (k, v in ...)
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	stmt.Variables = append(stmt.Variables, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+
+	if p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Variables = append(stmt.Variables, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+	}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseLoopBody()
+	return stmt
+}
+
+func (p *Parser) parseLoopBody() *ast.BlockStatement {
+	p.loopDepth += 1
+	body := p.parseBlockStatement()
+	p.loopDepth -= 1
+
+	// 他の文と同じく、末尾のセミコロンは省略できる
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return body
+}
+
+func (p *Parser) parseLoopControlStatement() ast.Statement {
+	var stmt ast.Statement
+	if p.curTokenIs(token.BREAK) {
+		stmt = &ast.BreakStatement{Token: p.curToken}
+	} else {
+		stmt = &ast.ContinueStatement{Token: p.curToken}
+	}
+
+	if p.loopDepth == 0 {
+		p.addError(p.curToken.Pos, fmt.Sprintf("%s outside loop", p.curToken.Literal))
+		stmt = nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) curTokenIs(t token.TokenType) bool {
 	return p.curToken.Type == t
 }
@@ -205,11 +449,19 @@ func (p *Parser) curPrecedence() int {
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN      // x = y
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
 	EQUALS      // ==
 	LESSGREATER // > or <
+	BIT_OR      // |
+	BIT_XOR     // ^
+	BIT_AND     // &
+	SHIFT       // << or >>
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
+	POWER       // ** (-2 ** 2 は -(2 ** 2))
 	CALL        // myFunction(X)
 	INDEX       // array[index]
 )
@@ -242,7 +494,7 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
 	msg := fmt.Sprintf("no prefix parse function for %s found.", t)
-	p.errors = append(p.errors, msg)
+	p.addError(p.curToken.Pos, msg)
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
@@ -290,7 +542,21 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
 		msg := fmt.Sprintf("Could not parse %q as integer.", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken.Pos, msg)
+		return nil
+	}
+
+	lit.Value = value
+	return lit
+}
+
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		msg := fmt.Sprintf("Could not parse %q as float.", p.curToken.Literal)
+		p.addError(p.curToken.Pos, msg)
 		return nil
 	}
 
@@ -323,7 +589,11 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
+	// 関数の本体から外側のループを break することはできない
+	loopDepth := p.loopDepth
+	p.loopDepth = 0
 	lit.Body = p.parseBlockStatement()
+	p.loopDepth = loopDepth
 
 	return lit
 }
@@ -369,6 +639,21 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 	return expression
 }
 
+// && と || は左結合で、== などの比較より弱く結びつく (a == b && c は (a == b) && c)
+func (p *Parser) parseLogicalExpression(left ast.Expression) ast.Expression {
+	expression := &ast.LogicalExpression{
+		Token:    p.curToken,
+		Operator: p.curToken.Literal,
+		Left:     left,
+	}
+
+	precedence := p.curPrecedence()
+	p.nextToken()
+	expression.Right = p.parseExpression(precedence)
+
+	return expression
+}
+
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	expression := &ast.InfixExpression{
 		Token:    p.curToken,
@@ -377,6 +662,10 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	}
 
 	precedence := p.curPrecedence()
+	if expression.Token.Type == token.POWER {
+		// ** だけは右結合にする (2 ** 3 ** 2 は 2 ** (3 ** 2))
+		precedence -= 1
+	}
 	p.nextToken()
 
 	// 中置演算子の右側の式をパースし、その結果を中置演算子 AST の右側ノードに格納する
@@ -387,11 +676,65 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
-func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
-	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
+	expression := &ast.AssignExpression{
+		Token:    p.curToken,
+		Operator: p.curToken.Literal,
+		Target:   left,
+	}
+
+	switch left.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	default:
+		p.addError(p.curToken.Pos, fmt.Sprintf("cannot assign to %s", left.String()))
+		return nil
+	}
 
 	p.nextToken()
-	exp.Index = p.parseExpression(LOWEST)
+
+	// a = b = c は a = (b = c) になるように、右結合にする
+	expression.Value = p.parseExpression(ASSIGN - 1)
+
+	return expression
+}
+
+// a[i] の添字か、: があれば a[start:end:step] のスライスをパースする
+func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
+	tok := p.curToken
+	p.nextToken()
+
+	var start ast.Expression
+	if !p.curTokenIs(token.COLON) {
+		start = p.parseExpression(LOWEST)
+
+		if !p.peekTokenIs(token.COLON) {
+			if !p.expectPeek(token.RBRACKET) {
+				return nil
+			}
+			return &ast.IndexExpression{Token: tok, Left: left, Index: start}
+		}
+		p.nextToken()
+	}
+
+	return p.parseSliceExpression(tok, left, start)
+}
+
+// 最初の : から ] までをパースする (a[:], a[i:], a[::2] のように位置は省略できる)
+func (p *Parser) parseSliceExpression(tok token.Token, left, start ast.Expression) ast.Expression {
+	exp := &ast.SliceExpression{Token: tok, Left: left, Start: start}
+
+	if !p.peekTokenIs(token.COLON) && !p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+		exp.End = p.parseExpression(LOWEST)
+	}
+
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		if !p.peekTokenIs(token.RBRACKET) {
+			p.nextToken()
+			exp.Step = p.parseExpression(LOWEST)
+		}
+	}
 
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
@@ -400,6 +743,18 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	return exp
 }
 
+// x.name は x["name"] と同じ意味になる (モジュールのメンバーやハッシュの値の参照に使う)
+func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
+	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	exp.Index = &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
+
+	return exp
+}
+
 func (p *Parser) parseGroupedExpression() ast.Expression {
 	// 左括弧を読み飛ばす
 	p.nextToken()
@@ -425,7 +780,7 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 
 func (p *Parser) parseHashLiteral() ast.Expression {
 	hash := &ast.HashLiteral{Token: p.curToken}
-	hash.Pairs = make(map[ast.Expression]ast.Expression)
+	hash.Pairs = []ast.HashPair{}
 
 	for !p.peekTokenIs(token.RBRACE) {
 		p.nextToken()
@@ -438,7 +793,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 		p.nextToken()
 		value := p.parseExpression(LOWEST)
 
-		hash.Pairs[key] = value
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
 
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
@@ -487,10 +842,50 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expression
 }
 
+func (p *Parser) parseTryExpression() ast.Expression {
+	expression := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expression.Block = p.parseBlockStatement()
+
+	// catch (e) { ... }
+	if !p.expectPeek(token.CATCH) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	expression.Parameter = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expression.Handler = p.parseBlockStatement()
+
+	return expression
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
 
+	p.blockDepth += 1
+	defer func() { p.blockDepth -= 1 }()
+
 	// { の次にトークンを進める
 	p.nextToken()
 
@@ -551,7 +946,11 @@ func (p *Parser) parseMacroLiteral() ast.Expression {
 		return nil
 	}
 
+	// 関数の本体から外側のループを break することはできない
+	loopDepth := p.loopDepth
+	p.loopDepth = 0
 	lit.Body = p.parseBlockStatement()
+	p.loopDepth = loopDepth
 
 	return lit
 }
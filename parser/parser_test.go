@@ -299,6 +299,37 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14;", 3.14},
+		{"0.5;", 0.5},
+		{"1e3;", 1000},
+		{"2.5e-1;", 0.25},
+	}
+
+	for _, tt := range tests {
+		program := InitializeTest(t, tt.input, 1)
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got = %T",
+				program.Statements[0])
+		}
+
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("expression is not *ast.FloatLiteral. got = %T.", stmt.Expression)
+		}
+
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value is not %g. got = %g.", tt.expected, literal.Value)
+		}
+	}
+}
+
 func TestStringLiteralExpression(t *testing.T) {
 	input := `"hello world";`
 
@@ -382,6 +413,50 @@ func TestParsingIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestParsingSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a[1:3]", "(a[1:3])"},
+		{"a[:n]", "(a[:n])"},
+		{"a[i:]", "(a[i:])"},
+		{"a[:]", "(a[:])"},
+		{"a[::2]", "(a[::2])"},
+		{"a[1:-1:2]", "(a[1:(-1):2])"},
+		{"a[::-1]", "(a[::(-1)])"},
+		{"a[i + 1:len(a)][0]", "((a[(i + 1):len(a)])[0])"},
+		{"a[1:2:]", "(a[1:2])"},
+	}
+
+	for _, tt := range tests {
+		program := InitializeTest(t, tt.input, 1)
+
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected = %q, got = %q.", tt.expected, actual)
+		}
+	}
+
+	program := InitializeTest(t, "a[:n]", 1)
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	slice, ok := stmt.Expression.(*ast.SliceExpression)
+	if !ok {
+		t.Fatalf("exp is not *ast.SliceExpression. got = %T", stmt.Expression)
+	}
+	if slice.Start != nil || slice.Step != nil {
+		t.Errorf("omitted positions are not nil. got start = %v, step = %v", slice.Start, slice.Step)
+	}
+	testIdentifier(t, slice.End, "n")
+
+	for _, input := range []string{"a[1:2:3:4]", "a[1:2"} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("no parser errors for %q", input)
+		}
+	}
+}
+
 func TestParsingHashLiteralsStringKeys(t *testing.T) {
 	input := `{"one": 1, "two": 2, "three": 3}`
 
@@ -403,7 +478,8 @@ func TestParsingHashLiteralsStringKeys(t *testing.T) {
 		"three": 3,
 	}
 
-	for key, value := range hash.Pairs {
+	for _, pair := range hash.Pairs {
+		key, value := pair.Key, pair.Value
 		literal, ok := key.(*ast.StringLiteral)
 		if !ok {
 			t.Errorf("key is not ast.StringLiteral. got = %T", key)
@@ -412,6 +488,11 @@ func TestParsingHashLiteralsStringKeys(t *testing.T) {
 		expectedValue := expected[literal.String()]
 		testIntegerLiteral(t, value, expectedValue)
 	}
+
+	// ペアは書かれた順に並ぶ
+	if hash.String() != "(one:1, two:2, three:3)" {
+		t.Errorf("hash.String() wrong. got = %q", hash.String())
+	}
 }
 
 func TestParsingEmptyHashLiteral(t *testing.T) {
@@ -457,7 +538,8 @@ func TestParsingHashLiteralsWithExpressions(t *testing.T) {
 		},
 	}
 
-	for key, value := range hash.Pairs {
+	for _, pair := range hash.Pairs {
+		key, value := pair.Key, pair.Value
 		literal, ok := key.(*ast.StringLiteral)
 		if !ok {
 			t.Errorf("key is not ast.StringLiteral. got = %T", key)
@@ -560,6 +642,54 @@ func TestParseOperatorPrecedenceParsing(t *testing.T) {
 			"a * b * c",
 			"((a * b) * c)",
 		},
+		{
+			"a == b && c",
+			"((a == b) && c)",
+		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a && b || !c",
+			"((a && b) || (!c))",
+		},
+		{
+			"x = a || b",
+			"(x = (a || b))",
+		},
+		{
+			"a <= b == b >= a",
+			"((a <= b) == (b >= a))",
+		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"-a ** b",
+			"(-(a ** b))",
+		},
+		{
+			"a ** b ** c * d",
+			"((a ** (b ** c)) * d)",
+		},
+		{
+			"a ** -b",
+			"(a ** (-b))",
+		},
+		{
+			"a | b ^ c & d << e + f",
+			"(a | (b ^ (c & (d << (e + f)))))",
+		},
+		{
+			"a & b == c",
+			"((a & b) == c)",
+		},
+		{
+			"~a >> b < c",
+			"(((~a) >> b) < c)",
+		},
 		{
 			"a * b / c",
 			"((a * b) / c)",
@@ -746,6 +876,386 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestTryExpression(t *testing.T) {
+	input := `try { x } catch (e) { y }`
+	program := InitializeTest(t, input, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got = %T",
+			program.Statements[0])
+	}
+
+	exp, ok := stmt.Expression.(*ast.TryExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.TryExpression. got = %T",
+			stmt.Expression)
+	}
+
+	if len(exp.Block.Statements) != 1 {
+		t.Fatalf("block is not 1 statements. got = %d\n", len(exp.Block.Statements))
+	}
+
+	block, ok := exp.Block.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Block.Statements[0] is not ast.ExpressionStatement. got = %T", exp.Block.Statements[0])
+	}
+
+	if !testIdentifier(t, block.Expression, "x") {
+		return
+	}
+
+	if exp.Parameter.Value != "e" {
+		t.Errorf("parameter is not %q. got = %q", "e", exp.Parameter.Value)
+	}
+
+	if len(exp.Handler.Statements) != 1 {
+		t.Fatalf("handler is not 1 statements. got = %d\n", len(exp.Handler.Statements))
+	}
+
+	handler, ok := exp.Handler.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Handler.Statements[0] is not ast.ExpressionStatement. got = %T", exp.Handler.Statements[0])
+	}
+
+	testIdentifier(t, handler.Expression, "y")
+
+	if exp.String() != "try x catch (e) y" {
+		t.Errorf("exp.String() wrong. got = %q", exp.String())
+	}
+}
+
+func TestThrowStatement(t *testing.T) {
+	program := InitializeTest(t, `throw e;`, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ThrowStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ThrowStatement. got = %T",
+			program.Statements[0])
+	}
+
+	testIdentifier(t, stmt.Value, "e")
+}
+
+func TestTryExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`try { x }`, "1:10: expected next token to be CATCH. got = EOF"},
+		{`try { x } catch { y }`, "1:17: expected next token to be (. got = {"},
+		{`try { x } catch (1) { y }`, "1:18: expected next token to be IDENT. got = INT"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("no parser errors for %q", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %q. expected = %q, got = %q", tt.input, tt.expected, errors[0])
+		}
+	}
+}
+
+func TestAssignExpression(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedOperator string
+		expectedString   string
+	}{
+		{"x = 5;", "=", "(x = 5)"},
+		{"x += y * 2;", "+=", "(x += (y * 2))"},
+		{"x -= 1;", "-=", "(x -= 1)"},
+		{"x *= 2;", "*=", "(x *= 2)"},
+		{"x /= 2;", "/=", "(x /= 2)"},
+		{"arr[i + 1] = 3;", "=", "((arr[(i + 1)]) = 3)"},
+		{`h["a"] += 1;`, "+=", "((h[a]) += 1)"},
+		// 代入は右結合
+		{"a = b = 1;", "=", "(a = (b = 1))"},
+		{"a = b == c;", "=", "(a = (b == c))"},
+	}
+
+	for _, tt := range tests {
+		program := InitializeTest(t, tt.input, 1)
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got = %T",
+				program.Statements[0])
+		}
+
+		exp, ok := stmt.Expression.(*ast.AssignExpression)
+		if !ok {
+			t.Fatalf("stmt.Expression is not ast.AssignExpression. got = %T", stmt.Expression)
+		}
+
+		if exp.Operator != tt.expectedOperator {
+			t.Errorf("exp.Operator is not %q. got = %q", tt.expectedOperator, exp.Operator)
+		}
+
+		if exp.String() != tt.expectedString {
+			t.Errorf("exp.String() wrong. expected = %q, got = %q", tt.expectedString, exp.String())
+		}
+	}
+}
+
+func TestAssignExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 = 2;", "1:3: cannot assign to 1"},
+		{"f() += 1;", "1:5: cannot assign to f()"},
+		{"a + b = c;", "1:7: cannot assign to (a + b)"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("no parser errors for %q", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %q. expected = %q, got = %q", tt.input, tt.expected, errors[0])
+		}
+	}
+}
+
+func TestImportStatement(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedPath string
+		expectedName string
+	}{
+		{`import "lib/math";`, "lib/math", "math"},
+		{`import "./util.mk"`, "./util.mk", "util"},
+		{`import "lib/my-util" as util;`, "lib/my-util", "util"},
+	}
+
+	for _, tt := range tests {
+		program := InitializeTest(t, tt.input, 1)
+
+		stmt, ok := program.Statements[0].(*ast.ImportStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ImportStatement. got = %T", program.Statements[0])
+		}
+		if stmt.Path != tt.expectedPath {
+			t.Errorf("stmt.Path wrong. expected = %q, got = %q", tt.expectedPath, stmt.Path)
+		}
+		if stmt.Name.Value != tt.expectedName {
+			t.Errorf("stmt.Name wrong. expected = %q, got = %q", tt.expectedName, stmt.Name.Value)
+		}
+	}
+}
+
+func TestExportStatement(t *testing.T) {
+	program := InitializeTest(t, "export let answer = 42;", 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExportStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExportStatement. got = %T", program.Statements[0])
+	}
+	if !testLetStatement(t, stmt.Statement, "answer") {
+		return
+	}
+	if stmt.String() != "export let answer = 42;" {
+		t.Errorf("stmt.String() wrong. got = %q", stmt.String())
+	}
+}
+
+func TestMemberExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"math.pi", "(math[pi])"},
+		{"a.b.c", "((a[b])[c])"},
+		{"m.f(1) * 2", "((m[f])(1) * 2)"},
+		{"-h.x", "(-(h[x]))"},
+		{"h.x = 1", "((h[x]) = 1)"},
+	}
+
+	for _, tt := range tests {
+		program := InitializeTest(t, tt.input, 1)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected = %q, got = %q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestModuleSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "lib/my-util";`, `1:8: cannot use "my-util" as a module name. use import "lib/my-util" as <name>`},
+		{`import math;`, "1:8: expected next token to be STRING. got = IDENT"},
+		{`import "m" as 1;`, "1:15: expected next token to be IDENT. got = INT"},
+		{`export 1;`, "1:8: expected next token to be LET. got = INT"},
+		{`fn() { export let x = 1; }`, "1:8: export is only allowed at the top level"},
+		{`if (true) { export let x = 1; }`, "1:13: export is only allowed at the top level"},
+		{`m.1`, "1:3: expected next token to be IDENT. got = INT"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("no parser errors for %q", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %q. expected = %q, got = %q", tt.input, tt.expected, errors[0])
+		}
+	}
+}
+
+func TestCommentsAreKeptOnTokens(t *testing.T) {
+	input := `// 2 つの数を足す
+let add = fn(x, y) {
+	x + y // 和
+};
+// ファイル末尾`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.LetStatement. got = %T", program.Statements[0])
+	}
+
+	if len(stmt.Token.LeadingComments) != 1 || stmt.Token.LeadingComments[0].Text != "// 2 つの数を足す" {
+		t.Errorf("wrong doc comment on let. got = %+v", stmt.Token.LeadingComments)
+	}
+
+	fn := stmt.Value.(*ast.FunctionLiteral)
+	body := fn.Body.Statements[0].(*ast.ExpressionStatement)
+	infix := body.Expression.(*ast.InfixExpression)
+	y := infix.Right.(*ast.Identifier)
+
+	if len(y.Token.TrailingComments) != 1 || y.Token.TrailingComments[0].Text != "// 和" {
+		t.Errorf("wrong trailing comment on y. got = %+v", y.Token.TrailingComments)
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	p := New(lexer.New("let x = 1; /* oops"))
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) != 1 {
+		t.Fatalf("wrong number of errors. expected = 1, got = %d (%v)", len(errors), errors)
+	}
+
+	if errors[0] != "1:12: unterminated block comment" {
+		t.Errorf("wrong error. expected = %q, got = %q", "1:12: unterminated block comment", errors[0])
+	}
+}
+
+func TestWhileStatement(t *testing.T) {
+	program := InitializeTest(t, `while (x < y) { x; break; continue; }`, 1)
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got = %T",
+			program.Statements[0])
+	}
+
+	if !testInfixExpression(t, stmt.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 3 {
+		t.Fatalf("body is not 3 statements. got = %d\n", len(stmt.Body.Statements))
+	}
+
+	if _, ok := stmt.Body.Statements[1].(*ast.BreakStatement); !ok {
+		t.Errorf("Body.Statements[1] is not ast.BreakStatement. got = %T", stmt.Body.Statements[1])
+	}
+
+	if _, ok := stmt.Body.Statements[2].(*ast.ContinueStatement); !ok {
+		t.Errorf("Body.Statements[2] is not ast.ContinueStatement. got = %T", stmt.Body.Statements[2])
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	tests := []struct {
+		input             string
+		expectedVariables []string
+		expectedString    string
+	}{
+		{`for (x in xs) { x }`, []string{"x"}, "for (x in xs) x"},
+		{`for (k, v in hash) { v }`, []string{"k", "v"}, "for (k, v in hash) v"},
+	}
+
+	for _, tt := range tests {
+		program := InitializeTest(t, tt.input, 1)
+
+		stmt, ok := program.Statements[0].(*ast.ForStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ForStatement. got = %T",
+				program.Statements[0])
+		}
+
+		if len(stmt.Variables) != len(tt.expectedVariables) {
+			t.Fatalf("wrong number of variables. expected = %d, got = %d", len(tt.expectedVariables), len(stmt.Variables))
+		}
+
+		for i, name := range tt.expectedVariables {
+			testLiteralExpression(t, stmt.Variables[i], name)
+		}
+
+		if stmt.String() != tt.expectedString {
+			t.Errorf("stmt.String() wrong. expected = %q, got = %q", tt.expectedString, stmt.String())
+		}
+	}
+}
+
+func TestLoopParseErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`break;`, "1:1: break outside loop"},
+		{`if (true) { continue; }`, "1:13: continue outside loop"},
+		{`while (true) { fn() { break; } }`, "1:23: break outside loop"},
+		{`for (x of xs) { x }`, "1:8: expected next token to be IN. got = IDENT"},
+		{`for (a, b, c in xs) { a }`, "1:10: expected next token to be IN. got = ,"},
+		{`while true { }`, "1:7: expected next token to be (. got = TRUE"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("no parser errors for %q", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %q. expected = %q, got = %q", tt.input, tt.expected, errors[0])
+		}
+	}
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := `fn(x, y) { x + y; }`
 
@@ -781,6 +1291,24 @@ func TestFunctionLiteralParsing(t *testing.T) {
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestFunctionLiteralWithName(t *testing.T) {
+	program := InitializeTest(t, `let myFunction = fn() { };`, 1)
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.LetStatement. got = %T", program.Statements[0])
+	}
+
+	function, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.FunctionLiteral. got = %T", stmt.Value)
+	}
+
+	if function.Name != "myFunction" {
+		t.Errorf("function literal name wrong. expected = %q, got = %q", "myFunction", function.Name)
+	}
+}
+
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -870,3 +1398,66 @@ func TestMacroLiteralParsing(t *testing.T) {
 
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
+
+func TestParserErrorPosition(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{
+			"let x 5;",
+			"main.mk:1:7: expected next token to be =. got = INT",
+		},
+		{
+			"let x = 5;\nlet = 10;",
+			"main.mk:2:5: expected next token to be IDENT. got = =",
+		},
+		{
+			"let a = 1;\n\n  + 2;",
+			"main.mk:3:3: no prefix parse function for + found.",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewWithFilename("main.mk", tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("expected parser errors for %q. got none", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong parser error. expected = %q, got = %q", tt.expectedError, errors[0])
+		}
+	}
+}
+
+func TestNodePosition(t *testing.T) {
+	input := `let add = fn(x, y) {
+  x + y;
+};`
+
+	program := InitializeTest(t, input, 1)
+
+	stmt := program.Statements[0].(*ast.LetStatement)
+	if stmt.Pos().String() != "1:1" {
+		t.Errorf("let statement position wrong. got = %s", stmt.Pos())
+	}
+
+	fn := stmt.Value.(*ast.FunctionLiteral)
+	if fn.Pos().String() != "1:11" {
+		t.Errorf("function literal position wrong. got = %s", fn.Pos())
+	}
+
+	body := fn.Body.Statements[0].(*ast.ExpressionStatement)
+	infix := body.Expression.(*ast.InfixExpression)
+	if infix.Pos().String() != "2:5" {
+		t.Errorf("infix expression position wrong. got = %s", infix.Pos())
+	}
+	if infix.Left.Pos().String() != "2:3" {
+		t.Errorf("identifier position wrong. got = %s", infix.Left.Pos())
+	}
+}
@@ -0,0 +1,222 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Ctrl-C で入力が中断されたことを表す
+var errInterrupted = errors.New("interrupted")
+
+// 1 行読み込むためのインターフェース
+// 端末なら行編集付きの lineEditor、それ以外は scannerReader を使う
+type lineReader interface {
+	ReadLine(prompt string) (string, error)
+}
+
+// 端末ではない入力から 1 行ずつ読み込む
+type scannerReader struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func (r *scannerReader) ReadLine(prompt string) (string, error) {
+	io.WriteString(r.out, prompt)
+
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+
+	return r.scanner.Text(), nil
+}
+
+// カーソル移動・削除・履歴の呼び出しができる簡易的な行エディタ
+type lineEditor struct {
+	term    *os.File // raw モードにする端末 (nil ならモード変更しない)
+	in      *bufio.Reader
+	out     io.Writer
+	history *history
+
+	buf []rune // 編集中の行
+	pos int    // buf 上のカーソル位置
+}
+
+func newLineEditor(term *os.File, in io.Reader, out io.Writer, h *history) *lineEditor {
+	return &lineEditor{term: term, in: bufio.NewReader(in), out: out, history: h}
+}
+
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	if e.term != nil {
+		if restore, ok := makeRaw(e.term); ok {
+			defer restore()
+		}
+	}
+
+	e.buf = e.buf[:0]
+	e.pos = 0
+
+	// 履歴をさかのぼっている位置 (len(entries) なら編集中の行)
+	entries := e.history.Entries()
+	historyIdx := len(entries)
+	editing := ""
+
+	e.refresh(prompt)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			io.WriteString(e.out, "\r\n")
+			return string(e.buf), nil
+		case 3: // Ctrl-C
+			io.WriteString(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(e.buf) == 0 {
+				io.WriteString(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.deleteAt(e.pos)
+		case 127, 8: // Backspace
+			if e.pos > 0 {
+				e.pos -= 1
+				e.deleteAt(e.pos)
+			}
+		case 1: // Ctrl-A
+			e.pos = 0
+		case 5: // Ctrl-E
+			e.pos = len(e.buf)
+		case 2: // Ctrl-B
+			e.moveCursor(-1)
+		case 6: // Ctrl-F
+			e.moveCursor(1)
+		case 11: // Ctrl-K: カーソル以降を削除
+			e.buf = e.buf[:e.pos]
+		case 21: // Ctrl-U: カーソル以前を削除
+			e.buf = append([]rune{}, e.buf[e.pos:]...)
+			e.pos = 0
+		case 27: // エスケープシーケンス
+			switch e.readEscape() {
+			case "[A", "OA": // ↑
+				if historyIdx > 0 {
+					if historyIdx == len(entries) {
+						editing = string(e.buf)
+					}
+					historyIdx -= 1
+					e.setLine(entries[historyIdx])
+				}
+			case "[B", "OB": // ↓
+				if historyIdx < len(entries) {
+					historyIdx += 1
+					if historyIdx == len(entries) {
+						e.setLine(editing)
+					} else {
+						e.setLine(entries[historyIdx])
+					}
+				}
+			case "[C", "OC": // →
+				e.moveCursor(1)
+			case "[D", "OD": // ←
+				e.moveCursor(-1)
+			case "[H", "OH", "[1~":
+				e.pos = 0
+			case "[F", "OF", "[4~":
+				e.pos = len(e.buf)
+			case "[3~": // Delete
+				e.deleteAt(e.pos)
+			}
+		default:
+			if r >= ' ' {
+				e.insert(r)
+			}
+		}
+
+		e.refresh(prompt)
+	}
+}
+
+// ESC に続くシーケンスを読み込む ("[A" など)
+func (e *lineEditor) readEscape() string {
+	var seq strings.Builder
+
+	first, _, err := e.in.ReadRune()
+	if err != nil {
+		return ""
+	}
+	seq.WriteRune(first)
+
+	if first != '[' && first != 'O' {
+		return seq.String()
+	}
+
+	// 英字か ~ が来るまでがひとつのシーケンス
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return seq.String()
+		}
+		seq.WriteRune(r)
+
+		if ('A' <= r && r <= 'Z') || ('a' <= r && r <= 'z') || r == '~' {
+			return seq.String()
+		}
+	}
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.pos += 1
+}
+
+func (e *lineEditor) deleteAt(idx int) {
+	if idx < 0 || idx >= len(e.buf) {
+		return
+	}
+	e.buf = append(e.buf[:idx], e.buf[idx+1:]...)
+}
+
+func (e *lineEditor) moveCursor(delta int) {
+	e.pos += delta
+	if e.pos < 0 {
+		e.pos = 0
+	}
+	if e.pos > len(e.buf) {
+		e.pos = len(e.buf)
+	}
+}
+
+func (e *lineEditor) setLine(line string) {
+	e.buf = []rune(line)
+	e.pos = len(e.buf)
+}
+
+// 行全体を描き直し、カーソルを編集位置に合わせる
+func (e *lineEditor) refresh(prompt string) {
+	var out strings.Builder
+
+	out.WriteString("\r")
+	out.WriteString(prompt)
+	out.WriteString(string(e.buf))
+	out.WriteString("\x1b[K")
+	out.WriteString("\r")
+
+	column := len([]rune(prompt)) + e.pos
+	if column > 0 {
+		out.WriteString(fmt.Sprintf("\x1b[%dC", column))
+	}
+
+	io.WriteString(e.out, out.String())
+}
@@ -0,0 +1,124 @@
+package repl
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 履歴として保持する最大行数
+const maxHistoryEntries = 1000
+
+// 入力履歴 (path が空でなければファイルにも保存する)
+type history struct {
+	path      string
+	entries   []string
+	fileLines int // 履歴ファイルの行数
+}
+
+// ユーザーのホームディレクトリ直下の履歴ファイル
+// MONKEY_HISTORY 環境変数が設定されていればそちらを使う
+func DefaultHistoryFile() string {
+	if path := os.Getenv("MONKEY_HISTORY"); path != "" {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".monkey_history")
+}
+
+// 履歴ファイルを読み込む (ファイルがなければ空の履歴になる)
+func loadHistory(path string) *history {
+	h := &history{path: path}
+	if path == "" {
+		return h
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		h.append(scanner.Text())
+		h.fileLines++
+	}
+
+	// ファイルが大きくなり続けないように、保持する分だけに書き直す
+	if h.fileLines > maxHistoryEntries {
+		h.rewrite()
+	}
+
+	return h
+}
+
+func (h *history) Entries() []string {
+	return h.entries
+}
+
+// 履歴に追加し、ファイルにも追記する
+// 空行と直前と同じ行は記録しない
+func (h *history) Add(line string) {
+	if !h.append(line) || h.path == "" {
+		return
+	}
+
+	if h.fileLines >= maxHistoryEntries {
+		h.rewrite()
+		return
+	}
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(line + "\n"); err == nil {
+		h.fileLines++
+	}
+}
+
+// 履歴ファイルを保持している履歴だけの内容に書き直す
+// 書き込みの途中で失敗しても元のファイルが残るように、一時ファイルに書いてから置き換える
+func (h *history) rewrite() {
+	var content strings.Builder
+	for _, entry := range h.entries {
+		content.WriteString(entry + "\n")
+	}
+
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content.String()), 0o600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	h.fileLines = len(h.entries)
+}
+
+func (h *history) append(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == line {
+		return false
+	}
+
+	h.entries = append(h.entries, line)
+	if len(h.entries) > maxHistoryEntries {
+		h.entries = h.entries[len(h.entries)-maxHistoryEntries:]
+	}
+
+	return true
+}
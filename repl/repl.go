@@ -4,41 +4,231 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"monkey/ast"
+	"monkey/compiler"
 	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/token"
+	"monkey/vm"
+	"os"
+	"strings"
 )
 
 const PROMPT = "> "
+const CONTINUATION_PROMPT = ".. " // 入力が完結していない間に表示するプロンプト
+
+// 実行エンジン
+const (
+	EngineEval = "eval" // 木構造を辿る評価器
+	EngineVM   = "vm"   // バイトコードコンパイラと仮想マシン
+)
+
+type Options struct {
+	HistoryFile string // 入力履歴を保存するファイル (空なら保存しない)
+	Engine      string // EngineEval (既定) か EngineVM
+}
 
 func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
-	env := object.NewEnvironment()
+	StartWithOptions(in, out, Options{HistoryFile: DefaultHistoryFile()})
+}
+
+func StartWithOptions(in io.Reader, out io.Writer, opts Options) {
+	h := loadHistory(opts.HistoryFile)
+	reader := newLineReader(in, out, h)
+	s := newSession(out, opts.Engine)
 
 	for {
-		fmt.Printf(PROMPT)
+		input, err := readInput(reader, h)
+		if err == errInterrupted {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		s.eval(input)
+	}
+}
+
+// 入力をまたいで引き継ぐ状態
+type session struct {
+	out    io.Writer
+	engine string
+
+	builtins map[string]*object.Builtin
+	env      *object.Environment
+	macroEnv *object.Environment
+
+	// VM で実行する場合に入力をまたいで引き継ぐ状態
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+}
+
+func newSession(out io.Writer, engine string) *session {
+	s := &session{
+		out:    out,
+		engine: engine,
+		// puts も結果と同じ out に出力する
+		builtins:    evaluator.NewBuiltins(evaluator.OSHost{Out: out}, nil),
+		env:         object.NewEnvironment(),
+		macroEnv:    object.NewEnvironment(),
+		symbolTable: compiler.NewGlobalSymbolTable(),
+		constants:   []object.Object{},
+		globals:     make([]object.Object, vm.GlobalsSize),
+	}
+	s.env.Execution().Builtins = s.builtins
+	return s
+}
+
+// ひとつの入力を評価して結果を表示する
+func (s *session) eval(input string) {
+	// インタプリタの不具合で panic しても、その入力を捨てるだけで REPL は続ける
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(s.out, "internal error: %v\n", r)
+			s.env.Execution().Depth = 0
+		}
+	}()
+
+	out := s.out
+
+	l := lexer.New(input)
+	p := parser.New(l)
 
-		scanned := scanner.Scan()
-		if !scanned {
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(out, p.Errors())
+		return
+	}
+
+	// マクロ定義を取り出してから展開し、展開後の AST を評価する
+	evaluator.DefineMacros(program, s.macroEnv)
+	expanded, expandErr := evaluator.ExpandMacros(program, s.macroEnv)
+	if expandErr != nil {
+		io.WriteString(out, expandErr.StackTrace())
+		io.WriteString(out, "\n")
+		return
+	}
+
+	var evaluated object.Object
+	if s.engine == EngineVM {
+		comp := compiler.NewWithState(s.symbolTable, s.constants)
+		if err := comp.Compile(expanded); err != nil {
+			fmt.Fprintf(out, "compile error: %s\n", err)
 			return
 		}
 
-		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
+		bytecode := comp.Bytecode()
+		s.constants = bytecode.Constants
 
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
-			continue
+		machine := vm.NewWithGlobalsStore(bytecode, s.globals)
+		machine.SetBuiltins(s.builtins)
+		if err := machine.Run(); err != nil {
+			fmt.Fprintf(out, "vm error: %s\n", err)
+			return
 		}
 
-		evaluated := evaluator.Eval(program, env)
-		if evaluated != nil {
-			io.WriteString(out, evaluated.Inspect())
-			io.WriteString(out, "\n")
+		// 評価器と同じく、let で終わる入力の結果は表示しない
+		evaluated = machine.Result()
+		if _, ok := evaluated.(*object.Error); !ok && !EndsWithExpression(expanded.(*ast.Program)) {
+			evaluated = nil
 		}
+	} else {
+		evaluated = evaluator.Eval(expanded, s.env)
+	}
+
+	if errObj, ok := evaluated.(*object.Error); ok {
+		// エラーは種類と呼び出し履歴を付けて表示する
+		io.WriteString(out, errObj.StackTrace())
+		io.WriteString(out, "\n")
+	} else if evaluated != nil {
+		io.WriteString(out, evaluated.Inspect())
+		io.WriteString(out, "\n")
+	}
+}
+
+// 端末なら行編集付きで、それ以外なら 1 行ずつ読み込む
+func newLineReader(in io.Reader, out io.Writer, h *history) lineReader {
+	if f, ok := in.(*os.File); ok {
+		if restore, ok := makeRaw(f); ok {
+			restore()
+			return newLineEditor(f, f, out, h)
+		}
+	}
+
+	return &scannerReader{scanner: bufio.NewScanner(in), out: out}
+}
+
+// 括弧や文字列が閉じるまで行を読み続け、ひとまとまりの入力として返す
+func readInput(reader lineReader, h *history) (string, error) {
+	var lines []string
+	prompt := PROMPT
+
+	for {
+		line, err := reader.ReadLine(prompt)
+		if err != nil {
+			// 継続行の途中で入力が終わったら、そこまでを評価する
+			if err == io.EOF && len(lines) > 0 {
+				return strings.Join(lines, "\n"), nil
+			}
+			return "", err
+		}
+
+		h.Add(line)
+		lines = append(lines, line)
+
+		input := strings.Join(lines, "\n")
+		if !isIncomplete(input) {
+			return input, nil
+		}
+
+		prompt = CONTINUATION_PROMPT
+	}
+}
+
+// 開き括弧やブロックコメントが閉じていない、または文字列が終端していない入力かどうか
+func isIncomplete(input string) bool {
+	l := lexer.New(input)
+	depth := 0
+
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LPAREN, token.LBRACE, token.LBRACKET:
+			depth += 1
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			depth -= 1
+		}
+	}
+
+	if depth > 0 {
+		return true
+	}
+
+	// 閉じていない文字列とブロックコメントは次の行に続く
+	for _, msg := range l.Errors() {
+		if strings.HasSuffix(msg, "unterminated string") || strings.HasSuffix(msg, "unterminated block comment") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// プログラムが値を持つ文 (式文か return 文) で終わるかどうか
+// VM で実行した結果を、評価器と同じく let で終わるプログラムでは表示しないために使う
+func EndsWithExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+
+	switch program.Statements[len(program.Statements)-1].(type) {
+	case *ast.ExpressionStatement, *ast.ReturnStatement:
+		return true
+	default:
+		return false
 	}
 }
 
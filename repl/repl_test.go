@@ -0,0 +1,200 @@
+package repl
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsIncomplete(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 + 2", false},
+		{"let add = fn(x, y) {", true},
+		{"let add = fn(x, y) {\n  x + y\n}", false},
+		{"[1, 2,", true},
+		{"puts(1,", true},
+		{`"hello`, true},
+		{`"hello {"`, false},
+		{`"hello" + "wor`, true},
+		{"1 + 2 }", false},
+		{`"say \"hi\"" + "`, true},
+		{`"say \"hi\""`, false},
+		{`// don't "quote`, false},
+		{"1 + /* comment", true},
+		{"1 + /* comment */ 2", false},
+		{"fn() { // }", true},
+	}
+
+	for _, tt := range tests {
+		if got := isIncomplete(tt.input); got != tt.expected {
+			t.Errorf("isIncomplete(%q) wrong. expected = %t, got = %t", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestStartMultiLineInput(t *testing.T) {
+	input := `let add = fn(x, y) {
+  x + y
+};
+add(1,
+  2)
+"multi
+line"
+`
+	var out bytes.Buffer
+	StartWithOptions(strings.NewReader(input), &out, Options{})
+
+	expected := PROMPT + CONTINUATION_PROMPT + CONTINUATION_PROMPT +
+		PROMPT + CONTINUATION_PROMPT + "3\n" +
+		PROMPT + CONTINUATION_PROMPT + "multi\nline\n" +
+		PROMPT
+	if out.String() != expected {
+		t.Errorf("wrong output.\nexpected = %q\ngot      = %q", expected, out.String())
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	var out bytes.Buffer
+	StartWithOptions(strings.NewReader("let a = 1;\n\nlet a = 1;\na\n"), &out, Options{HistoryFile: path})
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("history file was not written: %s", err)
+	}
+
+	expected := "let a = 1;\na\n"
+	if string(content) != expected {
+		t.Errorf("wrong history file. expected = %q, got = %q", expected, string(content))
+	}
+
+	h := loadHistory(path)
+	if len(h.Entries()) != 2 || h.Entries()[1] != "a" {
+		t.Errorf("wrong history entries. got = %q", h.Entries())
+	}
+}
+
+// 履歴ファイルは保持する行数より大きくならない
+func TestHistoryFileIsTrimmed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	var content strings.Builder
+	for i := 0; i < maxHistoryEntries+10; i++ {
+		fmt.Fprintf(&content, "%d\n", i)
+	}
+	if err := os.WriteFile(path, []byte(content.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := loadHistory(path)
+	for i := 0; i < 5; i++ {
+		h.Add(fmt.Sprintf("new %d", i))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != maxHistoryEntries {
+		t.Fatalf("history file should have %d lines. got = %d", maxHistoryEntries, len(lines))
+	}
+	if lines[0] != "15" || lines[len(lines)-1] != "new 4" {
+		t.Errorf("wrong history file. first = %q, last = %q", lines[0], lines[len(lines)-1])
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	tests := []struct {
+		keys     string
+		history  []string
+		expected string
+	}{
+		{"abc\r", nil, "abc"},
+		{"abc\x7f\x7fd\r", nil, "ad"},
+		{"abc\x1b[D\x1b[DX\r", nil, "aXbc"},
+		{"abc\x01X\x05Y\r", nil, "XabcY"},
+		{"abc\x1b[D\x1b[D\x0b\r", nil, "a"},
+		{"\x1b[A\r", []string{"first", "second"}, "second"},
+		{"\x1b[A\x1b[A\x1b[B\r", []string{"first", "second"}, "second"},
+		{"new\x1b[A\x1b[B\r", []string{"first"}, "new"},
+		{"日本\x1b[D語\r", nil, "日語本"},
+	}
+
+	for _, tt := range tests {
+		h := &history{}
+		for _, entry := range tt.history {
+			h.Add(entry)
+		}
+
+		var out bytes.Buffer
+		e := newLineEditor(nil, strings.NewReader(tt.keys), &out, h)
+
+		line, err := e.ReadLine(PROMPT)
+		if err != nil {
+			t.Fatalf("ReadLine returned error: %s", err)
+		}
+
+		if line != tt.expected {
+			t.Errorf("keys %q: wrong line. expected = %q, got = %q", tt.keys, tt.expected, line)
+		}
+	}
+}
+
+func TestLineEditorControl(t *testing.T) {
+	var out bytes.Buffer
+	e := newLineEditor(nil, strings.NewReader("abc\x03\x04"), &out, &history{})
+
+	if _, err := e.ReadLine(PROMPT); err != errInterrupted {
+		t.Errorf("Ctrl-C should interrupt. got = %v", err)
+	}
+
+	if _, err := e.ReadLine(PROMPT); err == nil || err == errInterrupted {
+		t.Errorf("Ctrl-D on empty line should be EOF. got = %v", err)
+	}
+}
+
+func TestStartWithVM(t *testing.T) {
+	input := `let add = fn(x, y) { x + y };
+let three = add(1, 2);
+three * 2
+foo
+`
+	var out bytes.Buffer
+	StartWithOptions(strings.NewReader(input), &out, Options{Engine: EngineVM})
+
+	expected := PROMPT + PROMPT + PROMPT + "6\n" +
+		PROMPT + "ERROR: NameError: Identifier Not Found: foo\n    at <main> (1:1)\n" +
+		PROMPT
+	if out.String() != expected {
+		t.Errorf("wrong output.\nexpected = %q\ngot      = %q", expected, out.String())
+	}
+}
+
+func TestSessionRecoversFromPanic(t *testing.T) {
+	var out bytes.Buffer
+	s := newSession(&out, EngineVM)
+
+	// グローバル変数の領域がない状態で代入させ、VM の中で panic を起こす
+	globals := s.globals
+	s.globals = nil
+	s.eval("let a = 1;")
+	if !strings.HasPrefix(out.String(), "internal error: ") {
+		t.Fatalf("panic is not reported. got = %q", out.String())
+	}
+
+	// panic の後も同じセッションで入力を続けられる
+	out.Reset()
+	s.globals = globals
+	s.eval("let b = 2; b + 1")
+	if out.String() != "3\n" {
+		t.Errorf("wrong output after panic. got = %q", out.String())
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package repl
+
+import "os"
+
+// raw モードに対応していない環境では行編集を行わず、1 行ずつ読み込む
+func makeRaw(f *os.File) (restore func(), ok bool) {
+	return nil, false
+}
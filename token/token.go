@@ -1,10 +1,50 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Pos     Position // トークン先頭の位置
+	End     Position // トークン末尾の直後の位置
+
+	// トークンに付随するコメント (フォーマッタやドキュメント生成で使う trivia)
+	LeadingComments  []Comment // トークンの前にあるコメント
+	TrailingComments []Comment // トークンと同じ行で、トークンの後ろにあるコメント
+}
+
+// ソースコード中のコメント
+type Comment struct {
+	Text string // 区切り文字を含むコメント全体 ("// ..." や "/* ... */")
+	Pos  Position
+	End  Position
+}
+
+// ソースコード上の位置 (Line, Column は 1 始まり)
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+// 位置情報が設定されているか (合成されたトークンなどは位置を持たない)
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+// file:line:col 形式の文字列を返す (ファイル名がなければ line:col)
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.Filename != "" {
+			return p.Filename
+		}
+		return "-"
+	}
+
+	if p.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 const (
@@ -14,6 +54,7 @@ const (
 	// 識別子 + リテラル
 	IDENT  = "IDENT"
 	INT    = "INT"
+	FLOAT  = "FLOAT"
 	STRING = "STRING"
 
 	// Operator
@@ -25,15 +66,34 @@ const (
 	SLASH    = "/"
 	LT       = "<"
 	GT       = ">"
+	PERCENT  = "%"
+	BIT_AND  = "&"
+	BIT_OR   = "|"
+	BIT_XOR  = "^"
+	TILDE    = "~"
 
 	// double Operator
-	EQ  = "=="
-	NEQ = "!="
+	EQ          = "=="
+	NEQ         = "!="
+	LT_EQ       = "<="
+	GT_EQ       = ">="
+	AND         = "&&"
+	OR          = "||"
+	POWER       = "**"
+	SHIFT_LEFT  = "<<"
+	SHIFT_RIGHT = ">>"
+
+	// 複合代入
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
 
 	// デリミタ
 	COMMA     = ","
 	SEMICOLON = ";"
 	COLON     = ":"
+	DOT       = "."
 
 	LPAREN   = "("
 	RPAREN   = ")"
@@ -51,17 +111,37 @@ const (
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
 	MACRO    = "MACRO"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	THROW    = "THROW"
+	WHILE    = "WHILE"
+	FOR      = "FOR"
+	IN       = "IN"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	IMPORT   = "IMPORT"
+	EXPORT   = "EXPORT"
 )
 
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
-	"macro":  MACRO,
+	"fn":       FUNCTION,
+	"let":      LET,
+	"true":     TRUE,
+	"false":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"macro":    MACRO,
+	"try":      TRY,
+	"catch":    CATCH,
+	"throw":    THROW,
+	"while":    WHILE,
+	"for":      FOR,
+	"in":       IN,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"import":   IMPORT,
+	"export":   EXPORT,
 }
 
 func LookupIdent(ident string) TokenType {
@@ -0,0 +1,596 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 評価器と VM の両方で同じプログラムを実行し、結果が一致することを確かめる
+// 期待値は Inspect() の文字列で書く (エラーは位置も含めて一致させる)
+var engineTests = []struct {
+	input    string
+	expected string
+}{
+	// 整数・真偽値・文字列
+	{"1 + 2 * 3", "7"},
+	{"(5 + 10 * 2 + 15 / 3) * 2 + -10", "50"},
+	{"-5 - -5", "0"},
+	{"1 < 2 == true", "true"},
+	{"!5", "false"},
+	{"!!true", "true"},
+	{`"Hello" + " " + "World!"`, "Hello World!"},
+	{`"a" == "a"`, "true"},
+	{"1 < 2 && 3 || false", "3"},
+	{"false && undefined", "false"},
+	{`if (false) { 1 } || "x"`, "x"},
+	{"let x = 1; true || (x = 2); false && (x = 3); x", "1"},
+	{"[3 <= 3, 2 >= 3, 1.5 <= 1, 17 % 5, -17 % 5, 2 ** 62, 3 ** 2 ** 2, 2 ** -2]", "[true, false, false, 2, -2, 4611686018427387904, 81, 0.25]"},
+	{"[6 & 3, 6 | 3, 6 ^ 3, 1 << 10, -1 >> 60, ~0, 5.5 % 2]", "[2, 7, 5, 1024, -1, -1, 1.5]"},
+	// 多倍長整数
+	{"9223372036854775807 + 1", "9223372036854775808"},
+	{"-9223372036854775807 - 2", "-9223372036854775809"},
+	{"let f = fn(n) { if (n < 2) { 1 } else { n * f(n - 1) } }; f(30)", "265252859812191058636308480000000"},
+	{"[2 ** 64 - 2 ** 64 + 1, 2 ** 64 > 2 ** 63, 2 ** 64 == 2.0 ** 64, {2 ** 64: 1}[2 ** 32 * 2 ** 32]]", "[1, true, true, 1]"},
+	{"let x = 2 ** 63; x - 1 <= 9223372036854775807", "true"},
+	{"2 ** 2 ** 30", "ERROR: 1:3: integer overflow. result exceeds 1048576 bits"},
+	{"let h = {2 ** 64: 1}; [has(h, 2 ** 64), has(h, 2 ** 65), keys(delete(h, 2 ** 64))]", "[true, false, []]"},
+	{"reduce([1, 2], 2 ** 64, fn(acc, x) { acc + x })", "18446744073709551619"},
+	{"sort([2 ** 64, 1, -(2 ** 65)])", "[-36893488147419103232, 1, 18446744073709551616]"},
+	// 配列・ハッシュの構造的な等価性と配列のキー
+	{`[[1, 2] == [1, 2], [1, [2]] != [1, [2.0]], {"a": [1], "b": 2} == {"b": 2, "a": [1]}, [fn() {}] == [fn() {}]]`, "[true, false, true, false]"},
+	{`let h = {[1, "a"]: "x"}; h[[2]] = "y"; [h[[1, "a"]], h[[2]], h[[3]]]`, "[x, y, null]"},
+	{`"a" != "b"`, "true"},
+
+	// 浮動小数点数
+	{"1.5 + 2", "3.5"},
+	{"-0.5 * 4", "-2.0"},
+	{"7 / 2.0", "3.5"},
+	{"1 == 1.0", "true"},
+	{"2.5 > 2", "true"},
+	{`{1: "one"}[1.0]`, "one"},
+	{"int(2.9) + float(1)", "3.0"},
+	{"1.5 + true", "ERROR: 1:5: Type Mismatch: FLOAT + BOOLEAN"},
+
+	// ループ
+	{`let i = 0; let sum = 0; while (i < 5) { let sum = sum + i; let i = i + 1; }; sum`, "10"},
+	{`let i = 0; while (true) { let i = i + 1; if (i == 3) { break; } }; i`, "3"},
+	{`let sum = 0; for (x in [1, 2, 3, 4]) { if (x == 2) { continue; } let sum = sum + x; }; sum`, "8"},
+	{`let r = []; for (i, x in ["a", "b"]) { let r = push(r, [i, x]); }; r`, "[[0, a], [1, b]]"},
+	{`let r = []; for (k, v in {"b": 2, "a": 1}) { let r = push(r, [k, v]); }; r`, "[[b, 2], [a, 1]]"},
+	{`let r = []; for (k in {"b": 2, "a": 1}) { let r = push(r, k); }; r`, "[b, a]"},
+	{`let s = ""; for (c in "日本") { let s = s + c + "."; }; s`, "日.本."},
+	{`let n = 0; for (x in [1, 2, 3]) { for (y in [1, 2, 3]) { if (y == 2) { break; } let n = n + 1; } }; n`, "3"},
+	{`let n = 0; for (x in [1, 2]) { try { if (x == 1) { break; } } catch (e) { 0 } let n = n + 1; }; n`, "0"},
+	{`let f = fn() { for (x in [1, 2]) { try { continue; } catch (e) { 0 } } 1 + true }; f()`, "ERROR: 1:74: Type Mismatch: INTEGER + BOOLEAN"},
+	{`let find = fn(xs, y) { for (i, x in xs) { if (x == y) { return i; } } -1 }; [find([5, 6, 7], 7), find([5], 8)]`, "[2, -1]"},
+	{`let f = fn(xs) { let n = 0; for (x in xs) { let n = n + x; } n }; f([1, 2, 3])`, "6"},
+	{`let f = fn() { for (x in [1, 2]) { if (x == 1) { break; } } }; f(); 5`, "5"},
+	{`let r = 0; while (true) { let x = if (true) { break; }; r = r + 1; if (r > 3) { break; } }; r`, "0"},
+	{`let r = 0; for (x in [1, 2, 3]) { r = r + if (x == 2) { continue; } else { x }; }; r`, "4"},
+	{`let r = []; for (x in [1, 2, 3]) { let r = push(r, if (x == 2) { break; } else { x }); }; r`, "[1]"},
+	{`fn() { let x = if (true) { return 5; }; 10 }()`, "5"},
+	{`fn() { [1, if (true) { return 7; }, 3]; 10 }()`, "7"},
+	{`let f = fn(x) { x }; fn() { f(if (true) { return 9; }) }()`, "9"},
+	{`let h = {"a": 0}; for (x in [1, 2, 3]) { h["a"] += [x, if (x == 2) { continue; } else { x }][1] }; h`, "{a: 4}"},
+	{`let f = fn(a, b) { a + b }; let a = [0]; for (x in [1, 2]) { a[0] += f(1, if (x == 1) { continue; } else { x }) }; a`, "[3]"},
+	{`let n = 0; for (x in [1, 2]) { n = n + [1, 2][if (true) { continue; }] }; for (y in [5]) { n = y }; n`, "5"},
+	{`for (x in 5) { x }`, "ERROR: 1:1: cannot iterate over INTEGER"},
+
+	// 例外処理
+	{`try { 1 } catch (e) { 2 }`, "1"},
+	{`try { 1 + true; 1 } catch (e) { e["message"] }`, "Type Mismatch: INTEGER + BOOLEAN"},
+	{`try { throw "oops" } catch (e) { e["kind"] + ": " + e["message"] }`, "Error: oops"},
+	{`try { foo } catch (e) { e["position"] }`, "1:7"},
+	{`try { error("bad", "ValueError") } catch (e) { e["kind"] }`, "ValueError"},
+	{`try { error("x", "LimitError") } catch (e) { [e["kind"], e["message"]] }`, "[ArgumentError, cannot raise LimitError from a program]"},
+	{`try { throw {"message": "x", "kind": "LimitError"} } catch (e) { e["kind"] }`, "ArgumentError"},
+	{`throw {"message": "x", "kind": "LimitError"}`, "ERROR: 1:1: cannot raise LimitError from a program"},
+	{`let f = fn(x) { if (x < 0) { throw "negative" } x }; try { f(-1) } catch (e) { e["message"] }`, "negative"},
+	{`let f = fn() { try { return 1; } catch (e) { 2 }; 3 }; f()`, "1"},
+	{`let f = fn() { try { return 1; } catch (e) { 2 } }; let g = fn() { 1 + true }; f(); g()`, "ERROR: 1:70: Type Mismatch: INTEGER + BOOLEAN"},
+	{`let f = fn(n) { if (n == 0) { throw "bottom" } try { [n, f(n - 1)] } catch (e) { n } }; f(3)`, "[3, [2, 1]]"},
+	{`try { try { throw "inner" } catch (e) { throw e } } catch (e) { e["message"] }`, "inner"},
+	{`let x = try { 1 + true } catch (err) { 0 }; x + 1`, "1"},
+	{`throw "oops"`, "ERROR: 1:1: oops"},
+
+	// 条件分岐
+	{"if (1 < 2) { 10 } else { 20 }", "10"},
+	{"if (false) { 10 }", "null"},
+	{"if (0) { 10 } else { 20 }", "10"},
+	{"if ((if (false) { 10 })) { 10 } else { 20 }", "20"},
+	{"if (true) { let a = 1; }", "null"},
+
+	// 変数
+	{"let a = 5; let b = a * 2; a + b", "15"},
+	{"let a = 1; let a = a + 1; a", "2"},
+
+	// 配列・ハッシュ
+	{"[1, 2 * 2, 3 + 3]", "[1, 4, 6]"},
+	{"[1, 2, 3][1]", "2"},
+	{"[1, 2, 3][3]", "null"},
+	{"[1, 2, 3][-1]", "3"},
+	{"[1, 2, 3][-4]", "null"},
+	{"let a = [1, 2, 3]; a[-1] = 9; a", "[1, 2, 9]"},
+	{"let a = [1, 2, 3, 4, 5]; [a[1:3], a[:2], a[3:], a[::2], a[::-1], a[-2:], a[10:], a[-100:1]]", "[[2, 3], [1, 2], [4, 5], [1, 3, 5], [5, 4, 3, 2, 1], [4, 5], [], [1]]"},
+	{`let s = "日本語テキスト"; [s[-1], s[:3], s[::-2], s[1:-1:3]]`, "[ト, 日本語, トキ語日, 本キ]"},
+	{"[1, 2][::0]", "ERROR: 1:7: slice step cannot be zero"},
+	{`1[0:1]`, "ERROR: 1:2: slice operator is not supported: INTEGER"},
+	{`{"one": 1}["one"]`, "1"},
+	{`{"one": 1}["two"]`, "null"},
+	{`{1: 1 + 1}[1]`, "2"},
+	{`{true: "yes"}[true]`, "yes"},
+
+	// 関数・クロージャ・再帰
+	{"let add = fn(a, b) { a + b }; add(1, 2)", "3"},
+	{"let early = fn() { return 1; 2 }; early()", "1"},
+	{"fn() { if (true) { if (true) { return 10; } return 1; } }()", "10"},
+	{"let noReturn = fn() { }; noReturn()", "null"},
+	{"let newAdder = fn(a) { fn(b) { a + b } }; newAdder(2)(3)", "5"},
+	{
+		`let newClosure = fn(a, b) {
+			let one = fn() { a };
+			let two = fn() { b };
+			fn() { one() + two() };
+		};
+		newClosure(9, 90)()`,
+		"99",
+	},
+	{
+		`let fibonacci = fn(x) {
+			if (x == 0) { return 0; }
+			if (x == 1) { return 1; }
+			fibonacci(x - 1) + fibonacci(x - 2)
+		};
+		fibonacci(15)`,
+		"610",
+	},
+	{
+		`let wrapper = fn() {
+			let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } };
+			countDown(5);
+		};
+		wrapper()`,
+		"0",
+	},
+	{
+		`let callLater = fn() { later() };
+		let later = fn() { "defined later" };
+		callLater()`,
+		"defined later",
+	},
+	{"let f = fn(a) { a }; f(1, 2)", "1"},
+	{"fn(x) { x }", "fn(x) {\nx\n}"},
+	{"return 5; 10", "5"},
+
+	// 組み込み関数
+	{`len("four")`, "4"},
+	{"len([1, 2, 3])", "3"},
+	{"first([1, 2])", "1"},
+	{"last([1, 2])", "2"},
+	{"rest([1, 2, 3])", "[2, 3]"},
+	{"rest([])", "null"},
+	{"push([1], 2)", "[1, 2]"},
+	{
+		`let map = fn(arr, f) {
+			let iter = fn(arr, acc) {
+				if (len(arr) == 0) { acc } else { iter(rest(arr), push(acc, f(first(arr)))) }
+			};
+			iter(arr, []);
+		};
+		map([1, 2, 3], fn(x) { x * 2 })`,
+		"[2, 4, 6]",
+	},
+	{"let len = fn(x) { 42 }; len([1])", "42"},
+
+	// 文字列
+	{`len("日本") + len("\u{1F600}")`, "3"},
+	{`"日本語"[2]`, "語"},
+	{`"abc"[5]`, "null"},
+	{`join(split("a b c"), ",")`, "a,b,c"},
+	{`format("{}-{}", upper("a"), substr("xyz", 1))`, "A-yz"},
+	{`repeat("a", -1)`, "ERROR: 1:7: count passed to `repeat` must not be negative. got = -1"},
+	{`repeat("ab", 4611686018427387904)`, "ERROR: 1:7: result of `repeat` is too large. exceeds 1073741824 bytes"},
+
+	// 高階関数
+	{"map([1, 2, 3], fn(x) { x * 2 })", "[2, 4, 6]"},
+	{"filter(range(10), fn(x) { x > 6 })", "[7, 8, 9]"},
+	{"try { range(0, 1 << 40) } catch (e) { e[\"kind\"] }", "ArgumentError"},
+	{`try { replace(repeat("x", 1 << 20), "x", repeat("y", 1025)) } catch (e) { e["kind"] }`, "ArgumentError"},
+	{"reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })", "10"},
+	{"sort([3, 1, 2], fn(a, b) { b - a })", "[3, 2, 1]"},
+	{"map([[1, 2], [3]], fn(xs) { map(xs, fn(x) { x + 1 }) })", "[[2, 3], [4]]"},
+	{"let total = 0; map([1, 2], fn(x) { total += x }); total", "3"},
+	{`try { map([1], fn(x) { throw "boom" }) } catch (e) { e["message"] }`, "boom"},
+	{"map([1, 2], len)", "ERROR: 1:4: argument to `len` is not supported. got = INTEGER"},
+	{"let f = fn(x) { x + true }; map([1], f)", "ERROR: 1:19: Type Mismatch: INTEGER + BOOLEAN"},
+	{`sort([1, "a"])`, "ERROR: 1:5: cannot compare STRING and INTEGER"},
+	{"map([1], 5)", "ERROR: 1:4: Not a function: INTEGER"},
+
+	// ハッシュの順序と組み込み関数
+	{`{"b": 1, "a": 2, 1: 3}`, "{b: 1, a: 2, 1: 3}"},
+	{`let h = {"b": 1}; h["a"] = 2; h["b"] = 3; h`, "{b: 3, a: 2}"},
+	{`entries(merge({"x": 1, "y": 2}, {"x": 3}))`, "[[x, 3], [y, 2]]"},
+	{`let h = {"a": 1, "b": 2}; [keys(delete(h, "a")), has(h, "a")]`, "[[b], true]"},
+	{`let r = []; for (k in delete({"c": 1, "a": 2, "b": 3}, "a")) { r = push(r, k) }; r`, "[c, b]"},
+	{`has({}, [fn() {}])`, "ERROR: 1:4: unusable as hash key: ARRAY"},
+
+	// 代入
+	{"let x = 1; x += 2; x", "3"},
+	{"let x = 1; x = 5", "5"},
+	{"let x = 1; let f = fn() { x = 2 }; f(); x", "2"},
+	{"let counter = fn() { let c = 0; fn() { c += 1 } }; let next = counter(); next(); next()", "2"},
+	{"let f = fn() { let c = 0; let g = fn() { c }; c = 7; g() }; f()", "7"},
+	{"let f = fn() { let c = 0; let g = fn() { fn() { c *= 2 } }; c = 3; g()(); c }; f()", "6"},
+	{"let fs = []; for (x in [1, 2]) { let fs = push(fs, fn() { x }) }; fs[0]()", "2"},
+	{"let f = fn() { f = 5; 1 }; f(); f", "5"},
+	{"let g = fn() { let f = fn() { fn() { f = 3 } }; f()(); f }; g()", "3"},
+
+	// 後で定義される変数と、組み込み関数を覆い隠す変数
+	{"let f = fn() { let g = fn() { n }; let n = 5; g() }; f()", "5"},
+	{"let f = fn() { let g = fn() { n }; let r = g(); let n = 5; r }; f()", "ERROR: 1:31: Identifier Not Found: n"},
+	{"let n = 1; let f = fn() { let g = fn() { n }; let r = g(); let n = 5; [r, g()] }; f()", "[1, 5]"},
+	{"let f = fn() { let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; [even(4), odd(7)] }; f()", "[true, true]"},
+	{"let x = 1; let f = fn() { let x = x + 1; x }; [f(), x]", "[2, 1]"},
+	{"let f = fn() { if (false) { let y = 1 }; y }; let y = 2; f()", "2"},
+	{"let outer = fn() { let x = 1; let inner = fn() { let y = x; let x = 2; y }; inner() }; outer()", "1"},
+	{"let outer = fn() { let x = 1; fn() { fn() { let y = x; let x = 2; y }() }() }; outer()", "1"},
+	{"let x = 0; let outer = fn() { let g = fn() { let y = x; let x = 2; y }; let r = g(); let x = 1; [r, g()] }; outer()", "[0, 1]"},
+	{"let x = 1; let f = fn() { x = 2; let x = 3; x }; [f(), x]", "[3, 2]"},
+	{"let x = 1; let f = fn() { x += 5; let x = 3; x }; [f(), x]", "[3, 6]"},
+	{"let outer = fn() { let x = 1; let inner = fn() { x = 2; let x = 3; x }; [inner(), x] }; outer()", "[3, 2]"},
+	{"let f = fn() { let g = fn() { x = 1 }; let r = g(); let x = 0; r }; f()", "ERROR: 1:33: cannot assign to undefined variable: x"},
+	{"let f = fn() { len = 1; let len = 2; len }; f()", "ERROR: 1:20: cannot assign to builtin function len"},
+	{"let f = fn(){ len(\"a\") }; let len = fn(x){ 99 }; f()", "99"},
+	{"let f = fn() { let len = fn(x) { 0 }; len(\"ab\") }; [f(), len(\"ab\")]", "[0, 2]"},
+	{"let f = fn() { if (false) { let len = 1 }; len(\"ab\") }; f()", "2"},
+	{"let a = [1, 2]; a[0] = 3; a", "[3, 2]"},
+	{`let h = {"a": 1}; h["a"] -= 2; h`, "{a: -1}"},
+	{"y = 1", "ERROR: 1:3: cannot assign to undefined variable: y"},
+	{"let a = [1]; a[3] = 1", "ERROR: 1:19: index out of range: 3 (length 1)"},
+	{"let a = [1]; a[0] = a; a", "[[...]]"},
+	{`let h = {}; h["self"] = h; h`, "{self: {...}}"},
+	{`let a = [1]; let h = {"a": a}; a[0] = h; [a, h]`, "[[{a: [...]}], {a: [{...}]}]"},
+	{"let b = [0]; [b, b]", "[[0], [0]]"},
+
+	// エラー
+	{"5 + true;", "ERROR: 1:3: Type Mismatch: INTEGER + BOOLEAN"},
+	{"5 + true; 5;", "ERROR: 1:3: Type Mismatch: INTEGER + BOOLEAN"},
+	{"-true", "ERROR: 1:1: Unknown Operator: -BOOLEAN"},
+	{"true + false", "ERROR: 1:6: Unknown Operator: BOOLEAN + BOOLEAN"},
+	{`"Hello" - "World"`, "ERROR: 1:9: Unknown Operator: STRING - STRING"},
+	{"foobar", "ERROR: 1:1: Identifier Not Found: foobar"},
+	{"if (false) { let y = 1; }; y", "ERROR: 1:28: Identifier Not Found: y"},
+	{"fn() { if (false) { let y = 1; }; y }()", "ERROR: 1:35: Identifier Not Found: y"},
+	{`{"name": "Monkey"}[fn(x) { x }];`, "ERROR: 1:19: unusable as hash key: FUNCTION"},
+	{`{[len]: 2}`, "ERROR: 1:1: unusable as hash key: ARRAY"},
+	{"1(2)", "ERROR: 1:2: Not a function: INTEGER"},
+	{`len(1)`, "ERROR: 1:4: argument to `len` is not supported. got = INTEGER"},
+	{"10 / 0", "ERROR: 1:4: division by zero"},
+	{"10 % 0", "ERROR: 1:4: modulo by zero"},
+	{"1 % 0.0", "ERROR: 1:3: modulo by zero"},
+	{"5.5 % 2", "1.5"},
+	{"let n = -1; try { 1 >> n } catch (e) { e.message }", "negative shift count: -1"},
+	{"~true", "ERROR: 1:1: Unknown Operator: ~BOOLEAN"},
+	{"let x = 0; try { 1 / x } catch (e) { e.kind }", "RuntimeError"},
+	{"1.0 / 0 > 1", "true"},
+	{"fn(a, b) { a }(1)", "ERROR: 1:15: wrong number of arguments. got = 1, want = 2"},
+	{"fn(a) { a }(1, 2)", "1"},
+	{`[1, 2]["a"]`, "ERROR: 1:7: array index must be INTEGER. got = STRING"},
+	{`[1, 2][1.0]`, "ERROR: 1:7: array index must be INTEGER. got = FLOAT"},
+	{`"abc"[true]`, "ERROR: 1:6: string index must be INTEGER. got = BOOLEAN"},
+	{
+		`let f = fn(x) {
+			x + true
+		};
+		f(1)`,
+		"ERROR: 2:6: Type Mismatch: INTEGER + BOOLEAN",
+	},
+}
+
+func TestEnginesAgree(t *testing.T) {
+	for _, tt := range engineTests {
+		evaluated := runEvaluator(t, tt.input)
+		executed := runVM(t, tt.input)
+
+		if inspect(evaluated) != tt.expected {
+			t.Errorf("evaluator: wrong result for %q.\nexpected = %q\ngot      = %q", tt.input, tt.expected, inspect(evaluated))
+		}
+
+		if inspect(executed) != tt.expected {
+			t.Errorf("vm: wrong result for %q.\nexpected = %q\ngot      = %q", tt.input, tt.expected, inspect(executed))
+		}
+	}
+}
+
+func inspect(obj object.Object) string {
+	if obj == nil {
+		return "null"
+	}
+	return obj.Inspect()
+}
+
+func runEvaluator(t *testing.T, input string) object.Object {
+	return evaluator.Eval(parse(t, input), object.NewEnvironment())
+}
+
+func TestEnginesAgreeOnStackTrace(t *testing.T) {
+	tests := []string{
+		`let inner = fn(x) { x + y };
+		let outer = fn(x) { inner(x) };
+		outer(1);`,
+		`let f = fn(n) { if (n == 0) { len(n) } else { f(n - 1) } }; f(2);`,
+		`fn() { 1 + true }();`,
+		`let x = 5; x();`,
+		`let check = fn(x) { if (x > 1) { throw "too big" } x };
+		let run = fn(xs) { map(xs, check) };
+		run([1, 2]);`,
+	}
+
+	for _, input := range tests {
+		evaluated, ok := runEvaluator(t, input).(*object.Error)
+		if !ok {
+			t.Errorf("evaluator: no error for %q", input)
+			continue
+		}
+
+		executed, ok := runVM(t, input).(*object.Error)
+		if !ok {
+			t.Errorf("vm: no error for %q", input)
+			continue
+		}
+
+		if evaluated.StackTrace() != executed.StackTrace() {
+			t.Errorf("stack traces differ for %q.\nevaluator = %q\nvm        = %q", input, evaluated.StackTrace(), executed.StackTrace())
+		}
+	}
+}
+
+func runVM(t *testing.T, input string) object.Object {
+	return runVMProgram(t, parse(t, input))
+}
+
+func runVMProgram(t *testing.T, program *ast.Program) object.Object {
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	return vm.Result()
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+// import するモジュール (main.mk と同じディレクトリに置く)
+var engineModules = map[string]string{
+	"shapes.mk": `
+		import "lib/math";
+		export let circle = fn(r) { math.pi * r * r };
+		export let unit = circle(1);
+	`,
+	"lib/math.mk": `
+		export let pi = 3;
+		export let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } };
+		let isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } };
+		let hidden = 1;
+	`,
+	"counter.mk": `
+		export let state = {"loads": 0};
+		state.loads += 1;
+	`,
+	"failing.mk": `
+		let check = fn(x) { if (x > 1) { throw "too big" } x };
+		export let checked = map([1, 2], check);
+	`,
+	"shadow.mk": `
+		let pi = 4;
+		export let get = fn() { pi };
+	`,
+}
+
+func TestEnginesAgreeOnModules(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range engineModules {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "shapes"; shapes.circle(2)`, "12"},
+		{`import "shapes"; shapes.unit`, "3"},
+		{`import "lib/math" as m; [m.pi, m.isEven(7), m]`, "[3, false, <module math>]"},
+		{`import "lib/math"; math.hidden`, "ERROR: main.mk:1:24: module math has no export hidden"},
+		{`import "counter"; import "counter" as c; c.state.loads`, "1"},
+		{`import "shapes"; import "lib/math"; math.pi = 1`, "ERROR: main.mk:1:45: index assignment is not supported: MODULE"},
+		{`let pi = 1; import "shadow"; import "lib/math"; [pi, shadow.get(), math.pi]`, "[1, 4, 3]"},
+		{`let load = fn() { import "counter"; counter.state.loads += 1 }; load(); load()`, "3"},
+		{`try { import "failing" } catch (e) { e.message }`, "too big"},
+	}
+
+	// エラーの位置は一時ディレクトリを除いて比べる
+	relative := func(obj object.Object) string {
+		return strings.ReplaceAll(inspect(obj), dir+string(filepath.Separator), "")
+	}
+
+	for _, tt := range tests {
+		program := parseFile(t, filepath.Join(dir, "main.mk"), tt.input)
+
+		evaluated := evaluator.Eval(program, object.NewEnvironment())
+		if relative(evaluated) != tt.expected {
+			t.Errorf("evaluator: wrong result for %q.\nexpected = %q\ngot      = %q", tt.input, tt.expected, relative(evaluated))
+		}
+
+		executed := runVMProgram(t, program)
+		if relative(executed) != tt.expected {
+			t.Errorf("vm: wrong result for %q.\nexpected = %q\ngot      = %q", tt.input, tt.expected, relative(executed))
+		}
+	}
+
+	// モジュールの中で起きたエラーのスタックトレースも一致する
+	program := parseFile(t, filepath.Join(dir, "main.mk"), `import "failing";`)
+	evaluated, ok := evaluator.Eval(program, object.NewEnvironment()).(*object.Error)
+	if !ok {
+		t.Fatalf("evaluator: no error for failing module")
+	}
+	executed, ok := runVMProgram(t, program).(*object.Error)
+	if !ok {
+		t.Fatalf("vm: no error for failing module")
+	}
+	if evaluated.StackTrace() != executed.StackTrace() {
+		t.Errorf("stack traces differ.\nevaluator = %q\nvm        = %q", evaluated.StackTrace(), executed.StackTrace())
+	}
+}
+
+func parseFile(t *testing.T, filename, input string) *ast.Program {
+	p := parser.New(lexer.NewWithFilename(filename, input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+// 実行の制限を超えたときは、どちらのエンジンも同じエラーを返す
+// (ステップの数え方はエンジンによって違うので、上限はどちらでも超える大きさにする)
+func TestEnginesAgreeOnLimits(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		limits   object.Limits
+		expected string
+	}{
+		{"while (true) { }", object.Limits{MaxSteps: 1000}, "LimitError: step limit exceeded (1000 steps)"},
+		// 制限によるエラーは try で捕まえられない
+		{"let f = fn() { try { while (true) { } } catch (e) { 1 } }; f()", object.Limits{MaxSteps: 1000}, "LimitError: step limit exceeded (1000 steps)"},
+		{"let x = 0; while (true) { x += 1 }", object.Limits{Context: cancelled}, "LimitError: execution cancelled: context canceled"},
+		{"map(range(10), fn(x) { while (true) { } })", object.Limits{Context: cancelled}, "LimitError: execution cancelled: context canceled"},
+		{"let f = fn(n) { f(n + 1) }; f(0)", object.Limits{MaxDepth: 100}, "RuntimeError: stack overflow. call depth exceeds 100"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(99)", object.Limits{MaxDepth: 100}, "0"},
+		{"let f = fn(n) { f(n + 1) }; try { f(0) } catch (e) { e.kind }", object.Limits{MaxDepth: 100}, "RuntimeError"},
+		{"1 + 2", object.Limits{MaxSteps: 1000, Context: cancelled}, "3"},
+		// 組み込み関数は処理した量をステップとして数える
+		{`len(repeat(repeat("x", 1000000), 2000))`, object.Limits{MaxSteps: 1000}, "LimitError: step limit exceeded (1000 steps)"},
+		{"len(range(10000000000))", object.Limits{MaxSteps: 1000}, "LimitError: step limit exceeded (1000 steps)"},
+		{`let s = "x"; while (true) { s = join([s, s], "") }`, object.Limits{MaxSteps: 100000}, "LimitError: step limit exceeded (100000 steps)"},
+		{`let f = fn() { try { sort(range(5000)) } catch (e) { 1 } }; f()`, object.Limits{MaxSteps: 1000}, "LimitError: step limit exceeded (1000 steps)"},
+		{`len(repeat("x", 2000))`, object.Limits{Context: cancelled}, "LimitError: execution cancelled: context canceled"},
+	}
+
+	for _, tt := range tests {
+		program := parse(t, tt.input)
+
+		env := object.NewEnvironment()
+		env.Execution().Reset(tt.limits)
+		evaluated := evaluator.Eval(program, env)
+
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		machine := New(comp.Bytecode())
+		machine.SetLimits(tt.limits)
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		results := map[string]object.Object{"evaluator": evaluated, "vm": machine.Result()}
+		for engine, result := range results {
+			got := result.Inspect()
+			if err, ok := result.(*object.Error); ok {
+				got = string(err.Kind) + ": " + err.Message
+			}
+			if got != tt.expected {
+				t.Errorf("%s: wrong result for %q. expected = %q, got = %q", engine, tt.input, tt.expected, got)
+			}
+		}
+	}
+}
+
+// 公開する組み込み関数を絞った場合も、どちらのエンジンも同じ結果になり、出力は Host に送られる
+func TestEnginesAgreeOnBuiltinPolicy(t *testing.T) {
+	tests := []struct {
+		input    string
+		policy   evaluator.BuiltinPolicy
+		expected string
+		output   string
+	}{
+		{`puts("a"); len("ab")`, nil, "2", "a\n"},
+		{`map([1, 2], fn(x) { puts(x) })`, nil, "[null, null]", "1\n2\n"},
+		{`len("ab") + 1`, evaluator.PureBuiltins, "3", ""},
+		{`let x = 1;\nputs(x)`, evaluator.PureBuiltins, "ERROR: 2:1: Identifier Not Found: puts", ""},
+		{`map([1], puts)`, evaluator.DenyBuiltins("puts"), "ERROR: 1:10: Identifier Not Found: puts", ""},
+		{`import "no_such_module"`, evaluator.PureBuiltins, "ERROR: 1:1: import is not allowed", ""},
+	}
+
+	for _, tt := range tests {
+		program := parse(t, strings.ReplaceAll(tt.input, `\n`, "\n"))
+
+		var evalOut, vmOut bytes.Buffer
+
+		env := object.NewEnvironment()
+		env.Execution().Builtins = evaluator.NewBuiltins(evaluator.OSHost{Out: &evalOut}, tt.policy)
+		env.Execution().ReadModule = evaluator.NewModuleReader(evaluator.OSHost{}, tt.policy)
+		evaluated := evaluator.Eval(program, env)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("evaluator: wrong result for %q. expected = %q, got = %q", tt.input, tt.expected, evaluated.Inspect())
+		}
+
+		// モジュールはコンパイル時に読むので、VM では import のエラーはコンパイルエラーになる
+		comp := compiler.New()
+		comp.SetModuleReader(evaluator.NewModuleReader(evaluator.OSHost{}, tt.policy))
+		if err := comp.Compile(program); err != nil {
+			if "ERROR: "+err.Error() != tt.expected {
+				t.Errorf("vm: wrong compile error for %q. expected = %q, got = %q", tt.input, tt.expected, err)
+			}
+			continue
+		}
+		machine := New(comp.Bytecode())
+		machine.SetBuiltins(evaluator.NewBuiltins(evaluator.OSHost{Out: &vmOut}, tt.policy))
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if machine.Result().Inspect() != tt.expected {
+			t.Errorf("vm: wrong result for %q. expected = %q, got = %q", tt.input, tt.expected, machine.Result().Inspect())
+		}
+
+		outputs := map[string]string{"evaluator": evalOut.String(), "vm": vmOut.String()}
+		for engine := range outputs {
+			if outputs[engine] != tt.output {
+				t.Errorf("%s: wrong output for %q. expected = %q, got = %q", engine, tt.input, tt.output, outputs[engine])
+			}
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package vm
+
+import (
+	"monkey/code"
+	"monkey/object"
+)
+
+// 関数呼び出しひとつ分の実行状態
+type Frame struct {
+	cl          *object.Closure
+	ip          int // 実行中の命令の位置
+	basePointer int // この呼び出しのローカル変数が始まるスタック位置
+}
+
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
+	return &Frame{cl: cl, ip: -1, basePointer: basePointer}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.cl.Fn.Instructions
+}
@@ -0,0 +1,877 @@
+package vm
+
+import (
+	"fmt"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/object"
+)
+
+const (
+	InitialStackSize = 2048
+	MaxStackSize     = 1 << 20 // スタックはこの大きさまで必要に応じて伸ばす
+	GlobalsSize      = 65536
+	MaxFrames        = 1 << 16 // 関数呼び出しの既定の最大の深さ
+)
+
+// 評価器と共通の固定オブジェクトを使う (== がポインタ比較で振る舞いを揃えるため)
+var (
+	True  = evaluator.TRUE
+	False = evaluator.FALSE
+	Null  = evaluator.NULL
+)
+
+type VM struct {
+	constants []object.Object
+
+	globals     []object.Object
+	globalNames []string
+
+	stack []object.Object
+	sp    int // 常に次に空いている位置を指す。スタックの先頭は stack[sp-1]
+
+	frames      []*Frame
+	framesIndex int
+
+	handlers []handler // 実行中の try ブロック (内側が末尾)
+
+	lastPopped object.Object
+	err        *object.Error // 実行を中断させた実行時エラー
+
+	exec object.Execution // 実行の制限・使える組み込み関数と、実行したステップ (命令) 数
+}
+
+// try ブロックに入ったときの状態。エラーが起きたらここまで巻き戻して catch 節に飛ぶ
+type handler struct {
+	framesIndex int
+	sp          int
+	catchIP     int
+}
+
+func New(bytecode *compiler.Bytecode) *VM {
+	return NewWithGlobalsStore(bytecode, make([]object.Object, GlobalsSize))
+}
+
+// REPL のように入力をまたいでグローバル変数を引き継ぐ場合に使う
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, globals []object.Object) *VM {
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		SourceMap:    bytecode.SourceMap,
+	}
+	mainClosure := &object.Closure{Fn: mainFn}
+	mainFrame := NewFrame(mainClosure, 0)
+
+	frames := make([]*Frame, 1, 64)
+	frames[0] = mainFrame
+
+	return &VM{
+		constants:   bytecode.Constants,
+		globals:     globals,
+		globalNames: bytecode.GlobalNames,
+		stack:       make([]object.Object, InitialStackSize),
+		sp:          0,
+		frames:      frames,
+		framesIndex: 1,
+	}
+}
+
+// 実行の制限を設定する (Run の前に呼ぶ)
+func (vm *VM) SetLimits(limits object.Limits) {
+	vm.exec.Reset(limits)
+}
+
+// 使える組み込み関数を設定する (evaluator.NewBuiltins で作る。nil なら既定の組み込み関数すべて)
+func (vm *VM) SetBuiltins(builtins map[string]*object.Builtin) {
+	vm.exec.Builtins = builtins
+}
+
+// 最後に OpPop で捨てられた値 (トップレベルの式文の値)
+func (vm *VM) LastPoppedStackElem() object.Object {
+	return vm.lastPopped
+}
+
+// プログラムの実行結果を返す
+// 実行時エラーで中断した場合はそのエラー、そうでなければ最後に評価された式文の値
+func (vm *VM) Result() object.Object {
+	if vm.err != nil {
+		return vm.err
+	}
+	return vm.lastPopped
+}
+
+// バイトコードを実行する
+// Monkey の実行時エラーは Result() で返し、error は不正なバイトコードの場合にだけ返す
+func (vm *VM) Run() error {
+	return vm.run(0)
+}
+
+// フレームの数が stopFrames まで減ったら (apply で呼び出した関数から戻ったら) 実行を止める
+// 0 ならプログラムの最後まで実行する
+func (vm *VM) run(stopFrames int) error {
+	var ip int
+	var ins code.Instructions
+	var op code.Opcode
+
+	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		vm.currentFrame().ip++
+
+		if err := vm.exec.Step(); err != nil {
+			vm.fail(err)
+			return nil
+		}
+
+		ip = vm.currentFrame().ip
+		ins = vm.currentFrame().Instructions()
+		op = code.Opcode(ins[ip])
+
+		switch op {
+		case code.OpConstant:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			vm.push(vm.constants[constIndex])
+
+		case code.OpPop:
+			vm.lastPopped = vm.pop()
+
+		case code.OpDup:
+			vm.push(vm.stack[vm.sp-1])
+
+		case code.OpDup2:
+			vm.push(vm.stack[vm.sp-2])
+			vm.push(vm.stack[vm.sp-2])
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv,
+			code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+			code.OpGreaterEqual, code.OpLessEqual, code.OpMod, code.OpPow,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight:
+			vm.executeBinaryOperation(op)
+
+		case code.OpMinus:
+			vm.pushResult(evaluator.EvalPrefix("-", vm.pop()))
+
+		case code.OpBang:
+			vm.pushResult(evaluator.EvalPrefix("!", vm.pop()))
+
+		case code.OpBitNot:
+			vm.pushResult(evaluator.EvalPrefix("~", vm.pop()))
+
+		case code.OpTrue:
+			vm.push(True)
+
+		case code.OpFalse:
+			vm.push(False)
+
+		case code.OpNull:
+			vm.push(Null)
+
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			array := vm.buildArray(vm.sp-numElements, vm.sp)
+			vm.sp = vm.sp - numElements
+
+			vm.push(array)
+
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			hash := vm.buildHash(vm.sp-numElements, vm.sp)
+			vm.sp = vm.sp - numElements
+
+			vm.pushResult(hash)
+
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+
+			vm.pushResult(evaluator.EvalIndex(left, index))
+
+		case code.OpSlice:
+			step := vm.pop()
+			end := vm.pop()
+			start := vm.pop()
+			left := vm.pop()
+
+			vm.pushResult(evaluator.EvalSlice(left, start, end, step))
+
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			vm.pushResult(evaluator.AssignIndex(left, index, value))
+
+		case code.OpJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip = pos - 1
+
+		case code.OpJumpNotTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			condition := vm.pop()
+			if !evaluator.IsTruthy(condition) {
+				vm.currentFrame().ip = pos - 1
+			}
+
+		case code.OpSetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			vm.globals[globalIndex] = vm.pop()
+
+		case code.OpGetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			val := vm.globals[globalIndex]
+			if val == nil {
+				vm.fail(newError(object.NAME_ERROR, "Identifier Not Found: %s", vm.globalNames[globalIndex]))
+				break
+			}
+			vm.push(val)
+
+		case code.OpAssignGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			if vm.globals[globalIndex] == nil {
+				name := vm.globalNames[globalIndex]
+				if _, ok := evaluator.LookupBuiltin(&vm.exec, name); ok {
+					vm.fail(newError(object.NAME_ERROR, "cannot assign to builtin function %s", name))
+				} else {
+					vm.fail(newError(object.NAME_ERROR, "cannot assign to undefined variable: %s", name))
+				}
+				break
+			}
+			vm.globals[globalIndex] = vm.pop()
+
+		case code.OpSetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			slot := frame.basePointer + int(localIndex)
+			if c, ok := vm.stack[slot].(*cell); ok {
+				c.Value = vm.pop()
+			} else {
+				vm.stack[slot] = vm.pop()
+			}
+
+		case code.OpGetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			val := deref(vm.stack[frame.basePointer+int(localIndex)])
+			if val == nil {
+				vm.fail(newError(object.NAME_ERROR, "Identifier Not Found: %s", frame.cl.Fn.LocalNames[localIndex]))
+				break
+			}
+			vm.push(val)
+
+		case code.OpGetBuiltin:
+			builtinIndex := code.ReadUint8(ins[ip+1:])
+			globalIndex := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+
+			// 評価器と同じく、同じ名前のグローバル変数が定義されていればそちらを使う
+			if val := vm.globals[globalIndex]; val != nil {
+				vm.push(val)
+				break
+			}
+
+			// 実行で公開されていない組み込み関数は、評価器と同じく未定義の識別子として扱う
+			name := evaluator.BuiltinNames()[builtinIndex]
+			builtin, ok := evaluator.LookupBuiltin(&vm.exec, name)
+			if !ok {
+				vm.fail(newError(object.NAME_ERROR, "Identifier Not Found: %s", name))
+				break
+			}
+			vm.push(builtin)
+
+		case code.OpGetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			vm.push(deref(vm.currentFrame().cl.Free[freeIndex]))
+
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			free := vm.currentFrame().cl.Free
+			if c, ok := free[freeIndex].(*cell); ok {
+				c.Value = vm.pop()
+			} else {
+				free[freeIndex] = vm.pop()
+			}
+
+		case code.OpTryGetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			// まだ定義されていなければ、続く命令で外側の変数を読む
+			frame := vm.currentFrame()
+			if val := deref(vm.stack[frame.basePointer+int(localIndex)]); val != nil {
+				vm.push(val)
+				frame.ip = pos - 1
+			}
+
+		case code.OpTryGetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			frame := vm.currentFrame()
+			if val := deref(frame.cl.Free[freeIndex]); val != nil {
+				vm.push(val)
+				frame.ip = pos - 1
+			}
+
+		case code.OpTrySetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			// まだ定義されていなければ、続く命令で外側の変数に代入する
+			frame := vm.currentFrame()
+			slot := frame.basePointer + int(localIndex)
+			if deref(vm.stack[slot]) != nil {
+				if c, ok := vm.stack[slot].(*cell); ok {
+					c.Value = vm.pop()
+				} else {
+					vm.stack[slot] = vm.pop()
+				}
+				frame.ip = pos - 1
+			}
+
+		case code.OpTrySetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			frame := vm.currentFrame()
+			free := frame.cl.Free
+			if deref(free[freeIndex]) != nil {
+				if c, ok := free[freeIndex].(*cell); ok {
+					c.Value = vm.pop()
+				} else {
+					free[freeIndex] = vm.pop()
+				}
+				frame.ip = pos - 1
+			}
+
+		case code.OpCaptureLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			// 初めて捕捉されるときに、スタック上の値をセルに入れ替える
+			slot := vm.currentFrame().basePointer + int(localIndex)
+			c, ok := vm.stack[slot].(*cell)
+			if !ok {
+				c = &cell{Value: vm.stack[slot]}
+				vm.stack[slot] = c
+			}
+			vm.push(c)
+
+		case code.OpCaptureFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			vm.push(vm.currentFrame().cl.Free[freeIndex])
+
+		case code.OpCurrentClosure:
+			vm.push(vm.currentFrame().cl)
+
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			vm.currentFrame().ip += 3
+
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			vm.executeCall(int(numArgs))
+
+		case code.OpIter:
+			numVars := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			items, err := evaluator.LoopItems(vm.pop(), numVars == 2)
+			if err != nil {
+				vm.fail(err)
+				break
+			}
+			vm.push(&iterator{items: items, withKey: numVars == 2})
+
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			iter := vm.stack[vm.sp-1].(*iterator)
+			if iter.pos >= len(iter.items) {
+				vm.sp--
+				vm.currentFrame().ip = pos - 1
+				break
+			}
+
+			item := iter.items[iter.pos]
+			iter.pos += 1
+
+			if iter.withKey {
+				vm.push(item.Key)
+			}
+			vm.push(item.Value)
+
+		case code.OpTry:
+			catchIP := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			vm.handlers = append(vm.handlers, handler{framesIndex: vm.framesIndex, sp: vm.sp, catchIP: catchIP})
+
+		case code.OpEndTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+		case code.OpThrow:
+			vm.fail(evaluator.ThrownError(vm.pop()))
+
+		case code.OpImport:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			globalIndex := code.ReadUint16(ins[ip+3:])
+			vm.currentFrame().ip += 4
+
+			// 一度評価したモジュールは再び評価しない
+			if module := vm.globals[globalIndex]; module != nil {
+				vm.push(module)
+				break
+			}
+
+			fn := vm.constants[constIndex].(*object.CompiledFunction)
+			module := vm.apply(&object.Closure{Fn: fn})
+			if err, ok := module.(*object.Error); ok {
+				vm.fail(err)
+				break
+			}
+
+			vm.globals[globalIndex] = module
+			vm.push(module)
+
+		case code.OpModule:
+			nameIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			name := vm.constants[nameIndex].(*object.String).Value
+			exports := vm.pop().(*object.Hash)
+			vm.push(&object.Module{Name: name, Exports: exports})
+
+		case code.OpReturnValue:
+			vm.discardHandlers()
+			returnValue := vm.pop()
+
+			// トップレベルの return はプログラムの実行を終える
+			if vm.framesIndex == 1 {
+				vm.lastPopped = returnValue
+				return nil
+			}
+
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+
+			vm.push(returnValue)
+			if vm.framesIndex == stopFrames {
+				return nil
+			}
+
+		case code.OpReturn:
+			vm.discardHandlers()
+			if vm.framesIndex == 1 {
+				vm.lastPopped = Null
+				return nil
+			}
+
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+
+			vm.push(Null)
+			if vm.framesIndex == stopFrames {
+				return nil
+			}
+
+		default:
+			def, err := code.Lookup(byte(op))
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("opcode %s is not supported by the vm", def.Name)
+		}
+
+		if vm.err != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+var binaryOperators = map[code.Opcode]string{
+	code.OpAdd:          "+",
+	code.OpSub:          "-",
+	code.OpMul:          "*",
+	code.OpDiv:          "/",
+	code.OpEqual:        "==",
+	code.OpNotEqual:     "!=",
+	code.OpGreaterThan:  ">",
+	code.OpLessThan:     "<",
+	code.OpGreaterEqual: ">=",
+	code.OpLessEqual:    "<=",
+	code.OpMod:          "%",
+	code.OpPow:          "**",
+	code.OpBitAnd:       "&",
+	code.OpBitOr:        "|",
+	code.OpBitXor:       "^",
+	code.OpShiftLeft:    "<<",
+	code.OpShiftRight:   ">>",
+}
+
+func (vm *VM) executeBinaryOperation(op code.Opcode) {
+	right := vm.pop()
+	left := vm.pop()
+
+	// 整数同士の演算はよく使うので、評価器を経由せずに計算する
+	// 桁あふれする場合は評価器で多倍長整数にする
+	if l, ok := left.(*object.Integer); ok {
+		if r, ok := right.(*object.Integer); ok {
+			switch op {
+			case code.OpAdd:
+				if sum := l.Value + r.Value; (sum > l.Value) == (r.Value > 0) {
+					vm.push(&object.Integer{Value: sum})
+					return
+				}
+			case code.OpSub:
+				if diff := l.Value - r.Value; (diff < l.Value) == (r.Value > 0) {
+					vm.push(&object.Integer{Value: diff})
+					return
+				}
+			case code.OpLessThan:
+				vm.push(nativeBoolToBooleanObject(l.Value < r.Value))
+				return
+			case code.OpGreaterThan:
+				vm.push(nativeBoolToBooleanObject(l.Value > r.Value))
+				return
+			case code.OpLessEqual:
+				vm.push(nativeBoolToBooleanObject(l.Value <= r.Value))
+				return
+			case code.OpGreaterEqual:
+				vm.push(nativeBoolToBooleanObject(l.Value >= r.Value))
+				return
+			case code.OpEqual:
+				vm.push(nativeBoolToBooleanObject(l.Value == r.Value))
+				return
+			case code.OpNotEqual:
+				vm.push(nativeBoolToBooleanObject(l.Value != r.Value))
+				return
+			}
+		}
+	}
+
+	vm.pushResult(evaluator.EvalInfix(binaryOperators[op], left, right))
+}
+
+func (vm *VM) executeCall(numArgs int) {
+	callee := vm.stack[vm.sp-1-numArgs]
+
+	switch callee := callee.(type) {
+	case *object.Closure:
+		vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		vm.callBuiltin(callee, numArgs)
+	default:
+		vm.fail(newError(object.TYPE_ERROR, "Not a function: %s", callee.Type()))
+	}
+}
+
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) {
+	if numArgs < cl.Fn.NumParameters {
+		vm.fail(newError(object.ARGUMENT_ERROR, "wrong number of arguments. got = %d, want = %d", numArgs, cl.Fn.NumParameters))
+		return
+	}
+
+	// 評価器と同じく、余分な引数は捨てる
+	if numArgs > cl.Fn.NumParameters {
+		vm.sp -= numArgs - cl.Fn.NumParameters
+		numArgs = cl.Fn.NumParameters
+	}
+
+	// 実行中の関数の数 (最初のフレームはプログラム本体)
+	if maxDepth := vm.exec.MaxDepth(MaxFrames); vm.framesIndex-1 >= maxDepth {
+		vm.fail(object.StackOverflowError(maxDepth))
+		return
+	}
+
+	basePointer := vm.sp - numArgs
+	if !vm.ensureStack(basePointer + cl.Fn.NumLocals) {
+		return
+	}
+
+	// 前の呼び出しで使われた値が残っていると未定義の変数を検出できないので消しておく
+	for i := basePointer + numArgs; i < basePointer+cl.Fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+
+	vm.pushFrame(NewFrame(cl, basePointer))
+	vm.sp = basePointer + cl.Fn.NumLocals
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+
+	result := evaluator.CallBuiltin(&vm.exec, builtin, vm.apply, args)
+	vm.sp = vm.sp - numArgs - 1
+
+	if result == nil {
+		result = Null
+	}
+	vm.pushResult(result)
+}
+
+// 組み込み関数 (map や sort など) から Monkey の関数を呼び出し、戻るまで実行して戻り値を返す
+// 呼び出した関数の中で起きたエラーは値として返し、組み込み関数の呼び出し元で改めて投げる
+func (vm *VM) apply(fn object.Object, args ...object.Object) object.Object {
+	switch fn := fn.(type) {
+	case *object.Builtin:
+		result := evaluator.CallBuiltin(&vm.exec, fn, vm.apply, args)
+		if result == nil {
+			return Null
+		}
+		return result
+	case *object.Closure:
+		// 呼び出す前の状態。エラーで中断したらここまで戻す
+		sp, framesIndex, handlers := vm.sp, vm.framesIndex, vm.handlers
+
+		// 外側の try には、組み込み関数がエラーを返してから飛ぶ
+		vm.handlers = nil
+		defer func() { vm.handlers = handlers }()
+
+		vm.push(fn)
+		for _, arg := range args {
+			vm.push(arg)
+		}
+
+		if vm.err == nil {
+			vm.callClosure(fn, len(args))
+		}
+		if vm.err == nil {
+			if err := vm.run(framesIndex); err != nil {
+				vm.err = newError(object.RUNTIME_ERROR, "%s", err)
+			}
+		}
+
+		if vm.err != nil {
+			err := vm.err
+			vm.err = nil
+			vm.sp, vm.framesIndex = sp, framesIndex
+			return err
+		}
+
+		return vm.pop()
+	default:
+		return newError(object.TYPE_ERROR, "Not a function: %s", fn.Type())
+	}
+}
+
+func (vm *VM) pushClosure(constIndex int, numFree int) error {
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+
+	free := make([]object.Object, numFree)
+	copy(free, vm.stack[vm.sp-numFree:vm.sp])
+	vm.sp = vm.sp - numFree
+
+	vm.push(&object.Closure{Fn: function, Free: free})
+	return nil
+}
+
+func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
+	elements := make([]object.Object, endIndex-startIndex)
+	copy(elements, vm.stack[startIndex:endIndex])
+
+	return &object.Array{Elements: elements}
+}
+
+func (vm *VM) buildHash(startIndex, endIndex int) object.Object {
+	hash := object.NewHash()
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key := vm.stack[i]
+		value := vm.stack[i+1]
+
+		hashKey, ok := object.HashKeyOf(key)
+		if !ok {
+			return newError(object.TYPE_ERROR, "unusable as hash key: %s", key.Type())
+		}
+
+		hash.Set(hashKey, object.HashPair{Key: key, Value: value})
+	}
+
+	return hash
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) {
+	if vm.framesIndex < len(vm.frames) {
+		vm.frames[vm.framesIndex] = f
+	} else {
+		vm.frames = append(vm.frames, f)
+	}
+	vm.framesIndex++
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+func (vm *VM) push(o object.Object) {
+	if !vm.ensureStack(vm.sp + 1) {
+		return
+	}
+
+	vm.stack[vm.sp] = o
+	vm.sp++
+}
+
+// 演算の結果を積む。エラーなら実行を中断する
+func (vm *VM) pushResult(o object.Object) {
+	if err, ok := o.(*object.Error); ok {
+		vm.fail(err)
+		return
+	}
+	vm.push(o)
+}
+
+func (vm *VM) pop() object.Object {
+	o := vm.stack[vm.sp-1]
+	vm.sp--
+	return o
+}
+
+// スタックが size 個の要素を持てるように伸ばす
+func (vm *VM) ensureStack(size int) bool {
+	if size <= len(vm.stack) {
+		return true
+	}
+
+	if size > MaxStackSize {
+		vm.fail(newError(object.RUNTIME_ERROR, "stack overflow. stack size exceeds %d", MaxStackSize))
+		return false
+	}
+
+	newSize := len(vm.stack) * 2
+	for newSize < size {
+		newSize *= 2
+	}
+	if newSize > MaxStackSize {
+		newSize = MaxStackSize
+	}
+
+	stack := make([]object.Object, newSize)
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return true
+}
+
+// 実行時エラーを記録して実行を中断させる
+// 位置を持たないエラーには、実行中の命令に対応するソース位置を付ける
+// try ブロックの中なら、中断せずに catch 節から実行を続ける
+func (vm *VM) fail(err *object.Error) {
+	if !err.Pos.IsValid() {
+		frame := vm.currentFrame()
+		err.Pos = frame.cl.Fn.SourceMap.Lookup(frame.ip)
+	}
+
+	// 実行の制限によるエラーは catch 節に渡さない
+	if len(vm.handlers) > 0 && err.Kind != object.LIMIT_ERROR {
+		h := vm.handlers[len(vm.handlers)-1]
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+		vm.framesIndex = h.framesIndex
+		vm.sp = h.sp
+		vm.currentFrame().ip = h.catchIP - 1
+		vm.push(evaluator.ErrorValue(err))
+		return
+	}
+
+	// 評価器と同じく、内側の関数から順に呼び出し位置を記録する
+	if err.Trace == nil {
+		for i := vm.framesIndex - 1; i > 0; i-- {
+			caller := vm.frames[i-1]
+			err.AddTrace(vm.frames[i].cl.Fn.Name, caller.cl.Fn.SourceMap.Lookup(caller.ip))
+		}
+	}
+
+	vm.err = err
+}
+
+// 現在の関数から return するときに、その関数内の try ブロックの登録を外す
+func (vm *VM) discardHandlers() {
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framesIndex >= vm.framesIndex {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+}
+
+func newError(kind object.ErrorKind, format string, a ...interface{}) *object.Error {
+	return &object.Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return True
+	}
+	return False
+}
+
+// for-in の途中経過。ループの間スタックに置いておく
+type iterator struct {
+	items   []evaluator.LoopItem
+	pos     int
+	withKey bool
+}
+
+func (it *iterator) Type() object.ObjectType { return "ITERATOR" }
+func (it *iterator) Inspect() string         { return "iterator" }
+
+// クロージャが捕捉した変数
+// 捕捉されたローカル変数はスタック上でもセルに入れ、関数の内側と外側で代入を共有する
+type cell struct {
+	Value object.Object
+}
+
+func (c *cell) Type() object.ObjectType { return "CELL" }
+func (c *cell) Inspect() string         { return "cell" }
+
+// セルに入っていればその中身を返す
+func deref(obj object.Object) object.Object {
+	if c, ok := obj.(*cell); ok {
+		return c.Value
+	}
+	return obj
+}
@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/object"
+	"testing"
+)
+
+func TestDeepRecursion(t *testing.T) {
+	// 初期サイズを超えてもスタックが伸びること
+	input := `
+	let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } };
+	sum(5000)
+	`
+
+	result := runVM(t, input)
+	integer, ok := result.(*object.Integer)
+	if !ok || integer.Value != 12502500 {
+		t.Errorf("wrong result. got = %s", inspect(result))
+	}
+}
+
+func TestCatchStackOverflow(t *testing.T) {
+	result := runVM(t, `let loop = fn() { loop() }; let x = try { loop() } catch (e) { e["kind"] }; [x, 1 + 2]`)
+
+	if inspect(result) != "[RuntimeError, 3]" {
+		t.Errorf("wrong result. got = %s", inspect(result))
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	result := runVM(t, "let loop = fn() { loop() }; loop()")
+
+	errObj, ok := result.(*object.Error)
+	if !ok {
+		t.Fatalf("expected error. got = %s", inspect(result))
+	}
+
+	expected := "stack overflow. call depth exceeds 65536"
+	if errObj.Message != expected {
+		t.Errorf("wrong error message. expected = %q, got = %q", expected, errObj.Message)
+	}
+}
+
+func TestGlobalsStore(t *testing.T) {
+	symbolTable := compiler.NewGlobalSymbolTable()
+	constants := []object.Object{}
+	globals := make([]object.Object, GlobalsSize)
+
+	inputs := []string{"let a = 40;", "let b = fn() { a + 2 };", "b()"}
+
+	var result object.Object
+	for _, input := range inputs {
+		comp := compiler.NewWithState(symbolTable, constants)
+		if err := comp.Compile(parse(t, input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := comp.Bytecode()
+		constants = bytecode.Constants
+
+		vm := NewWithGlobalsStore(bytecode, globals)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		result = vm.Result()
+	}
+
+	if inspect(result) != "42" {
+		t.Errorf("wrong result. got = %s", inspect(result))
+	}
+}
+
+const fibonacciInput = `
+let fibonacci = fn(x) {
+	if (x < 2) { return x; }
+	fibonacci(x - 1) + fibonacci(x - 2)
+};
+fibonacci(20);
+`
+
+func BenchmarkFibonacciVM(b *testing.B) {
+	program := parse(&testing.T{}, fibonacciInput)
+
+	for i := 0; i < b.N; i++ {
+		comp := compiler.New()
+		comp.Compile(program)
+
+		vm := New(comp.Bytecode())
+		vm.Run()
+	}
+}
+
+func BenchmarkFibonacciEvaluator(b *testing.B) {
+	program := parse(&testing.T{}, fibonacciInput)
+
+	for i := 0; i < b.N; i++ {
+		evaluator.Eval(program, object.NewEnvironment())
+	}
+}